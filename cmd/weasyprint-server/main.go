@@ -0,0 +1,49 @@
+// Command weasyprint-server starts an HTTP conversion service,
+// compatible with the HTML route of the Gotenberg API.
+//
+// See the server package for the supported features.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	goweasyprint "github.com/benoitkugler/go-weasyprint"
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":3000", "address to listen on")
+	maxConcurrency := flag.Int("max-concurrency", 0, "maximum number of simultaneous conversions, defaults to the number of CPUs")
+	timeout := flag.Duration("timeout", 30*time.Second, "maximum duration of one conversion")
+	allowRemote := flag.Bool("allow-remote", false, "allow the documents to load resources which are not uploaded, using http or https, except from private addresses")
+	fontCache := flag.String("font-cache", "", "file storing the index of the system fonts, created if needed")
+	cacheSize := flag.Int("cache-size", 64, "size in MB of the cache storing the images and fonts shared by the conversions, 0 to disable it")
+	maxBodySize := flag.Int64("max-body-size", 64, "maximum size in MB of a request, uploaded files included")
+	flag.Parse()
+
+	newFontConfig, err := goweasyprint.NewFontConfigFunc(nil, *fontCache)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := server.Config{
+		NewFontConfig:  newFontConfig,
+		MaxConcurrency: *maxConcurrency,
+		Timeout:        *timeout,
+		MaxBodySize:    *maxBodySize << 20,
+	}
+	if *cacheSize > 0 {
+		config.Cache = pdf.NewSharedCache(*cacheSize << 20)
+	}
+	if *allowRemote {
+		config.UrlFetcher = goweasyprint.FetchPolicy{AllowedSchemes: []string{"http", "https"}, Timeout: *timeout}.Fetcher(nil)
+	}
+	handler := server.New(config)
+
+	log.Printf("Listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -0,0 +1,310 @@
+// Command weasyprint converts HTML documents to PDF files.
+//
+// Its command line interface mirrors the one of the Python WeasyPrint tool:
+//
+//	weasyprint [options] <input> <output>
+//
+// where <input> is a filename, an URL or - for stdin, and <output>
+// is a filename or - for stdout.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	goweasyprint "github.com/benoitkugler/go-weasyprint"
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	"github.com/benoitkugler/webrender/backend"
+	"github.com/benoitkugler/webrender/html/tree"
+	"github.com/benoitkugler/webrender/logger"
+	"github.com/benoitkugler/webrender/utils"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "weasyprint:", err)
+		os.Exit(1)
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// optimizeSize is the repeatable -O flag, which accepts the values of the Python tool.
+type optimizeSize []string
+
+func (o *optimizeSize) String() string { return strings.Join(*o, ", ") }
+
+func (o *optimizeSize) Set(s string) error {
+	switch s {
+	case "images", "fonts", "hinting", "pdf", "all", "none":
+		*o = append(*o, s)
+		return nil
+	default:
+		return fmt.Errorf("invalid value %q: expected images, fonts, hinting, pdf, all or none", s)
+	}
+}
+
+// compression returns the closest compression mode : only "pdf" (and "all") have
+// an equivalent, the fonts being always subset, and the images kept as is.
+func (o optimizeSize) compression() pdf.Compression {
+	out := pdf.CompressStreams
+	for _, value := range o {
+		switch value {
+		case "none":
+			return pdf.CompressStreams
+		case "pdf", "all":
+			out = pdf.OptimizeSize
+		}
+	}
+	return out
+}
+
+type config struct {
+	stylesheets         stringList
+	mediaType           string
+	baseUrl             string
+	attachments         stringList
+	presentationalHints bool
+	zoom                float64
+	fontDirs            stringList
+	fontCache           string
+	reproducible        bool
+	uncompressed        bool
+	optimizeSize        optimizeSize
+	pdfVariant          string
+	pdfTags             bool
+	pdfForms            bool
+	pageLabels          string
+	verbose, quiet      bool
+	version             bool
+}
+
+func (cf *config) flagSet(stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("weasyprint", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: weasyprint [options] <input> <output>")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "Render web pages to PDF.")
+		fmt.Fprintln(stderr, "<input> is a filename, an URL or - for stdin, <output> is a filename or - for stdout.")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+
+	// short and long names share the same variable
+	fs.Var(&cf.stylesheets, "s", "URL or filename for a user CSS stylesheet (may be repeated)")
+	fs.Var(&cf.stylesheets, "stylesheet", "same as -s")
+	fs.StringVar(&cf.mediaType, "m", "", `media type to use for @media, defaults to "print"`)
+	fs.StringVar(&cf.mediaType, "media-type", "", "same as -m")
+	fs.StringVar(&cf.baseUrl, "u", "", "base for relative URLs in the HTML input, defaults to the input's own filename or URL, or the current directory for stdin")
+	fs.StringVar(&cf.baseUrl, "base-url", "", "same as -u")
+	fs.Var(&cf.attachments, "a", "URL or filename of a file to attach to the PDF document (may be repeated)")
+	fs.Var(&cf.attachments, "attachment", "same as -a")
+	fs.BoolVar(&cf.presentationalHints, "p", false, "follow HTML presentational hints")
+	fs.BoolVar(&cf.presentationalHints, "presentational-hints", false, "same as -p")
+	fs.Float64Var(&cf.zoom, "zoom", 1, "zoom factor in PDF output")
+	fs.Var(&cf.fontDirs, "font-dir", "directory to search for fonts, instead of the system ones (may be repeated)")
+	fs.StringVar(&cf.fontCache, "font-cache", "", "file storing the index of the system fonts, created if needed")
+	fs.BoolVar(&cf.uncompressed, "uncompressed-pdf", false, "do not compress the content of the PDF, for debugging purposes")
+	fs.Var(&cf.optimizeSize, "O", `optimize the size of the PDF for images, fonts, hinting, pdf, all or none (may be repeated); only "pdf" and "all" have an effect, packing the objects in object streams`)
+	fs.Var(&cf.optimizeSize, "optimize-size", "same as -O")
+	fs.StringVar(&cf.pdfVariant, "pdf-variant", "", "PDF/A level of the output: pdf/a-1b, pdf/a-2b or pdf/a-3b")
+	fs.BoolVar(&cf.pdfTags, "pdf-tags", false, "tag the PDF for accessibility (PDF/UA)")
+	fs.BoolVar(&cf.pdfForms, "pdf-forms", false, "include PDF forms")
+	fs.StringVar(&cf.pageLabels, "page-labels", "", `page labels shown by PDF viewers, like "1:lower-roman,5:decimal,20:decimal:A-"`)
+	fs.BoolVar(&cf.reproducible, "reproducible", false, "write the same file for the same input, dated from SOURCE_DATE_EPOCH if set")
+	fs.BoolVar(&cf.verbose, "v", false, "show warnings and information messages")
+	fs.BoolVar(&cf.verbose, "verbose", false, "same as -v")
+	fs.BoolVar(&cf.quiet, "q", false, "hide logging messages")
+	fs.BoolVar(&cf.quiet, "quiet", false, "same as -q")
+	fs.BoolVar(&cf.version, "version", false, "print the version number and exit")
+	return fs
+}
+
+// parseArgs parses [args], allowing flags and positional arguments
+// to be interleaved, as the Python tool does.
+func parseArgs(fs *flag.FlagSet, args []string) (positionals []string, err error) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positionals, nil
+		}
+		if args[0] == "--" { // only positionals remain
+			return append(positionals, args[1:]...), nil
+		}
+		positionals = append(positionals, args[0])
+		args = args[1:]
+	}
+}
+
+// run executes the command, returning an error
+// instead of exiting, so that it may be tested.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var cf config
+	fs := cf.flagSet(stderr)
+	positionals, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if cf.version {
+		fmt.Fprintln(stdout, utils.VersionString)
+		return nil
+	}
+
+	if len(positionals) != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected 2 arguments (input and output), got %d", len(positionals))
+	}
+	input, output := positionals[0], positionals[1]
+
+	if cf.quiet {
+		logger.WarningLogger.SetOutput(io.Discard)
+		logger.ProgressLogger.SetOutput(io.Discard)
+	} else {
+		logger.WarningLogger.SetOutput(stderr)
+		if cf.verbose {
+			logger.ProgressLogger.SetOutput(stderr)
+		} else {
+			logger.ProgressLogger.SetOutput(io.Discard)
+		}
+	}
+	// the pdf backend uses the standard logger
+	log.SetOutput(logger.WarningLogger.Writer())
+
+	var content goweasyprint.ContentInput
+	switch {
+	case input == "-":
+		content = goweasyprint.InputReader{ReadCloser: io.NopCloser(stdin)}
+		if cf.baseUrl == "" {
+			cf.baseUrl = "."
+		}
+	case isUrl(input):
+		content = goweasyprint.InputUrl(input)
+	default:
+		content = goweasyprint.InputFilename(input)
+	}
+
+	opts := goweasyprint.Options{
+		BaseUrl:             cf.baseUrl,
+		MediaType:           cf.mediaType,
+		PresentationalHints: cf.presentationalHints,
+		Zoom:                cf.zoom,
+		Reproducible:        cf.reproducible,
+		Tagged:              cf.pdfTags,
+		Forms:               cf.pdfForms,
+	}
+	opts.Conformance, err = pdf.ParseConformance(cf.pdfVariant)
+	if err != nil {
+		return err
+	}
+	if cf.pageLabels != "" {
+		opts.PageLabels, err = pdf.ParsePageLabels(cf.pageLabels)
+		if err != nil {
+			return err
+		}
+	}
+	if cf.uncompressed {
+		opts.Compression = pdf.Uncompressed
+	} else {
+		opts.Compression = cf.optimizeSize.compression()
+	}
+	if cf.verbose && !cf.quiet {
+		opts.Progress = func(e progress.Event) { logger.ProgressLogger.Println(e) }
+	}
+
+	for _, source := range cf.stylesheets {
+		css, err := tree.NewCSSDefault(contentInput(source))
+		if err != nil {
+			return fmt.Errorf("invalid stylesheet %s: %s", source, err)
+		}
+		opts.Stylesheets = append(opts.Stylesheets, css)
+	}
+
+	for _, source := range cf.attachments {
+		att, err := loadAttachment(source)
+		if err != nil {
+			return fmt.Errorf("invalid attachment %s: %s", source, err)
+		}
+		opts.Attachments = append(opts.Attachments, att)
+	}
+
+	fontConfig, err := goweasyprint.LoadFontConfig(cf.fontDirs, cf.fontCache)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		return goweasyprint.Convert(stdout, content, fontConfig, opts)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = goweasyprint.Convert(f, content, fontConfig, opts)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// isUrl returns true if [s] looks like an absolute URL, as opposed to a file path.
+func isUrl(s string) bool {
+	u, err := url.Parse(s)
+	// single letter schemes are Windows drive letters
+	return err == nil && len(u.Scheme) > 1
+}
+
+func contentInput(source string) utils.ContentInput {
+	if isUrl(source) {
+		return utils.InputUrl(source)
+	}
+	return utils.InputFilename(source)
+}
+
+func loadAttachment(source string) (backend.Attachment, error) {
+	if !isUrl(source) {
+		content, err := os.ReadFile(source)
+		if err != nil {
+			return backend.Attachment{}, err
+		}
+		return backend.Attachment{Title: filepath.Base(source), Content: content}, nil
+	}
+
+	res, err := utils.DefaultUrlFetcher(source)
+	if err != nil {
+		return backend.Attachment{}, err
+	}
+	content, err := io.ReadAll(res.Content)
+	if err != nil {
+		return backend.Attachment{}, err
+	}
+	title := res.Filename
+	if title == "" {
+		title = filepath.Base(source)
+	}
+	return backend.Attachment{Title: title, Content: content}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/pdf/test"
+	"github.com/benoitkugler/pdf/reader"
+)
+
+// fontCache is the font index built by test.LoadTestFontConfig
+const fontCache = "../../pdf/test/cache.fc"
+
+func init() {
+	if _, err := test.LoadTestFontConfig(filepath.Dir(fontCache)); err != nil {
+		panic(err)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	var cf config
+	fs := cf.flagSet(&bytes.Buffer{})
+	pos, err := parseArgs(fs, []string{"in.html", "-s", "a.css", "--stylesheet", "b.css", "-p", "out.pdf", "--zoom", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pos, []string{"in.html", "out.pdf"}) {
+		t.Fatalf("unexpected positionals %v", pos)
+	}
+	if !reflect.DeepEqual([]string(cf.stylesheets), []string{"a.css", "b.css"}) || !cf.presentationalHints || cf.zoom != 2 {
+		t.Fatalf("unexpected flags %v", cf)
+	}
+
+	for _, test := range []struct {
+		args     []string
+		expected pdf.Compression
+	}{
+		{nil, pdf.CompressStreams},
+		{[]string{"-O", "images"}, pdf.CompressStreams},
+		{[]string{"-O", "fonts", "--optimize-size", "pdf"}, pdf.OptimizeSize},
+		{[]string{"-O", "all"}, pdf.OptimizeSize},
+		{[]string{"-O", "all", "-O", "none"}, pdf.CompressStreams},
+	} {
+		var cf config
+		if _, err := parseArgs(cf.flagSet(&bytes.Buffer{}), test.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := cf.optimizeSize.compression(); got != test.expected {
+			t.Fatalf("unexpected compression %d for %v", got, test.args)
+		}
+	}
+	if _, err := parseArgs(cf.flagSet(&bytes.Buffer{}), []string{"-O", "in.html"}); err == nil {
+		t.Fatal("expected error for invalid optimization")
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	css := filepath.Join(dir, "style.css")
+	if err := os.WriteFile(css, []byte("@page { size: 3in 4in }"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	attachment := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(attachment, []byte("some data"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err := run([]string{"--font-cache", fontCache, "-q", "-", "-s", css, "-a", attachment, "-"},
+		strings.NewReader("<p>Hello</p>"), &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(stdout.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := doc.Catalog.Pages.Flatten()
+	if len(pages) != 1 {
+		t.Fatalf("expected one page, got %d", len(pages))
+	}
+	if mb := pages[0].MediaBox; mb == nil || mb.Urx != 216 || mb.Ury != 288 {
+		t.Fatalf("unexpected media box %v", mb)
+	}
+	if files := doc.Catalog.Names.EmbeddedFiles; len(files) != 1 || files[0].FileSpec.UF != "data.txt" {
+		t.Fatalf("unexpected attachments %v", files)
+	}
+
+	output := filepath.Join(dir, "out.pdf")
+	err = run([]string{"--font-cache", fontCache, "-q", "-u", dir, "-m", "screen", "-", output},
+		strings.NewReader("<p>Hello</p>"), &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte("%PDF")) {
+		t.Fatal("invalid PDF output")
+	}
+}
+
+func TestRunInvalid(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"in.html"}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("expected error for missing output")
+	}
+	if err := run([]string{"--unknown", "in.html", "out.pdf"}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("expected error for unknown flag")
+	}
+
+	stdout.Reset()
+	if err := run([]string{"--version"}, nil, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() == 0 {
+		t.Fatal("missing version")
+	}
+}
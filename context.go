@@ -0,0 +1,163 @@
+package goweasyprint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// contextFetcher wraps `fetcher` so that fetches fail once `ctx` is done.
+// If `fetcher` is nil, HTTP requests are directly bound to `ctx`, and other
+// URLs are resolved with utils.DefaultUrlFetcher.
+func contextFetcher(ctx context.Context, fetcher utils.UrlFetcher) utils.UrlFetcher {
+	return func(urlTarget string) (utils.RemoteRessource, error) {
+		if err := ctx.Err(); err != nil {
+			return utils.RemoteRessource{}, err
+		}
+
+		if fetcher == nil {
+			if u, err := url.Parse(urlTarget); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+				return httpFetch(ctx, http.DefaultClient, urlTarget, 0)
+			}
+			return utils.DefaultUrlFetcher(urlTarget)
+		}
+
+		// custom fetchers are not aware of the context : run them
+		// concurrently to return as soon as the context is done
+		type result struct {
+			res      utils.RemoteRessource
+			err      error
+			panicked any
+		}
+		done := make(chan result, 1)
+		go func() {
+			var r result
+			defer func() {
+				r.panicked = recover()
+				done <- r
+			}()
+			r.res, r.err = fetcher(urlTarget)
+		}()
+		select {
+		case <-ctx.Done():
+			return utils.RemoteRessource{}, ctx.Err()
+		case r := <-done:
+			if r.panicked != nil {
+				panic(r.panicked) // propagate in the caller goroutine
+			}
+			return r.res, r.err
+		}
+	}
+}
+
+// httpFetch performs a GET request bound to `ctx`, handling
+// the HTTP headers the same way utils.DefaultUrlFetcher does.
+// See `readResponse` for `maxSize`.
+func httpFetch(ctx context.Context, client *http.Client, urlTarget string, maxSize int64) (utils.RemoteRessource, error) {
+	req, err := newRequest(ctx, urlTarget)
+	if err != nil {
+		return utils.RemoteRessource{}, err
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return utils.RemoteRessource{}, err
+	}
+	defer response.Body.Close()
+
+	return readResponse(response, response.Body, maxSize)
+}
+
+// newRequest returns a GET request with the same headers as utils.DefaultUrlFetcher.
+func newRequest(ctx context.Context, urlTarget string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlTarget, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", utils.VersionString)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	return req, nil
+}
+
+// errTooLarge is returned when a resource exceeds its maximum size
+var errTooLarge = errors.New("resource too large")
+
+// readResponse extracts the resource metadata from the headers of `response`,
+// and reads its (possibly compressed) `body`.
+// If `maxSize` is positive, errTooLarge is returned for bodies larger than `maxSize`
+// bytes, once decompressed.
+func readResponse(response *http.Response, body io.Reader, maxSize int64) (utils.RemoteRessource, error) {
+	result := utils.RemoteRessource{}
+	if redirect, err := response.Location(); err == nil {
+		result.RedirectedUrl = redirect.String()
+	} else if response.Request != nil {
+		result.RedirectedUrl = response.Request.URL.String()
+	}
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err == nil {
+		result.MimeType = mediaType
+		result.ProtocolEncoding = params["charset"]
+	}
+	_, params, err = mime.ParseMediaType(response.Header.Get("Content-Disposition"))
+	if err == nil {
+		result.Filename = params["filename"]
+	}
+
+	switch strings.ToLower(response.Header.Get("Content-Encoding")) {
+	case "gzip":
+		body, err = gzip.NewReader(body)
+		if err != nil {
+			return utils.RemoteRessource{}, err
+		}
+	case "deflate":
+		body, err = zlib.NewReader(body)
+		if err != nil {
+			return utils.RemoteRessource{}, err
+		}
+	}
+
+	content, err := readAll(body, maxSize)
+	if err != nil {
+		return utils.RemoteRessource{}, err
+	}
+	result.Content = bytes.NewReader(content)
+
+	return result, nil
+}
+
+// readAll reads `r` until EOF, returning errTooLarge if
+// `maxSize` is positive and more than `maxSize` bytes are available.
+func readAll(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(buf.Len()) > maxSize {
+		return nil, errTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// contextWriter fails once `ctx` is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -0,0 +1,105 @@
+package goweasyprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// PanicError is returned when the conversion is interrupted
+// by an unexpected panic.
+type PanicError struct {
+	// Step is the conversion step which panicked, "layout" or "drawing".
+	Step string
+
+	// Page is the 0-based index of the page being processed, or -1 if unknown.
+	Page int
+
+	// Value is the value passed to panic.
+	Value any
+
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (pe *PanicError) Error() string {
+	if pe.Page >= 0 {
+		return fmt.Sprintf("unexpected error during %s (page %d): %v", pe.Step, pe.Page+1, pe.Value)
+	}
+	return fmt.Sprintf("unexpected error during %s: %v", pe.Step, pe.Value)
+}
+
+// Unwrap returns the panic value, if it is an error.
+func (pe *PanicError) Unwrap() error {
+	err, _ := pe.Value.(error)
+	return err
+}
+
+// diagnostic returns the diagnostic reported for the panic
+func (pe *PanicError) diagnostic() diagnostics.Diagnostic {
+	return diagnostics.Diagnostic{
+		Severity: diagnostics.Error,
+		Code:     diagnostics.Panic,
+		Message:  pe.Error(),
+		Page:     pe.Page,
+	}
+}
+
+// diagnosticFetcher wraps `fetcher` to report the failures in `collector`.
+func diagnosticFetcher(ctx context.Context, collector *diagnostics.Collector, fetcher utils.UrlFetcher) utils.UrlFetcher {
+	if collector == nil {
+		return fetcher
+	}
+	return func(url string) (utils.RemoteRessource, error) {
+		res, err := fetcher(url)
+		if err != nil && ctx.Err() == nil {
+			code := diagnostics.ResourceFetchFailed
+			var denied *FetchDeniedError
+			if errors.As(err, &denied) {
+				code = diagnostics.ResourceDenied
+			}
+			collector.Add(diagnostics.Diagnostic{
+				Severity: diagnostics.Warning,
+				Code:     code,
+				Message:  err.Error(),
+				URL:      url,
+				Page:     -1,
+			})
+		}
+		return res, err
+	}
+}
+
+// recoverPanic must be deferred : it converts the panics
+// raised by the output when `ctx` is done into `ctx.Err()`, and the other
+// panics into a *PanicError, stored in `err`.
+// `currentPage` returns the page being drawn (see `pdf.Output.CurrentPage`), or -1.
+func recoverPanic(ctx context.Context, currentPage func() int, collector *diagnostics.Collector, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && r == any(ctxErr) {
+		*err = ctxErr
+		return
+	}
+	pe := &PanicError{Step: "drawing", Page: currentPage(), Value: r, Stack: debug.Stack()}
+	collector.Add(pe.diagnostic())
+	*err = pe
+}
+
+// currentPage returns the page being drawn by `*output`, which
+// may not be created yet when a panic is recovered.
+func currentPage(output **pdf.Output) func() int {
+	return func() int {
+		if *output == nil {
+			return -1
+		}
+		return (*output).CurrentPage()
+	}
+}
@@ -0,0 +1,137 @@
+// Package diagnostics defines the warnings reported
+// while converting a document.
+package diagnostics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Severity indicates the impact of a diagnostic on the output.
+type Severity uint8
+
+const (
+	// Info is used when the output is correct, but may be improved.
+	Info Severity = iota
+	// Warning is used when some content is missing or wrong in the output.
+	Warning
+	// Error is used when the conversion failed.
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("<severity %d>", s)
+	}
+}
+
+// Code identifies the kind of a diagnostic.
+type Code string
+
+const (
+	// ResourceFetchFailed is used when a resource (stylesheet, image, font, etc...) can't be loaded.
+	ResourceFetchFailed Code = "resource-fetch-failed"
+	// ResourceDenied is used when a resource is not allowed by the fetch policy.
+	ResourceDenied Code = "resource-denied"
+	// ImageInvalid is used when an image can't be decoded, and is skipped.
+	ImageInvalid Code = "image-invalid"
+	// FontUnsupported is used for fonts which can't be embedded (like bitmap fonts) :
+	// the text using them is not drawn.
+	FontUnsupported Code = "font-unsupported"
+	// FontSubsetFailed is used when a font can't be subsetted, and is embedded as a whole.
+	FontSubsetFailed Code = "font-subset-failed"
+	// Panic is used when an unexpected error interrupted the conversion.
+	Panic Code = "panic"
+	// NonConformant is used when a feature forbidden by the requested PDF/A level
+	// is dropped or degraded, or, with the Error severity, when the output can't conform.
+	NonConformant Code = "non-conformant"
+)
+
+// Diagnostic is one issue reported during a conversion.
+type Diagnostic struct {
+	Severity Severity
+	Code     Code
+	Message  string
+
+	// URL is the resource concerned by the diagnostic, or empty.
+	URL string
+
+	// Page is the 0-based index of the page concerned by the diagnostic, or -1.
+	Page int
+}
+
+func (d Diagnostic) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s [%s]", d.Severity, d.Code)
+	if d.Page >= 0 {
+		fmt.Fprintf(&out, " (page %d)", d.Page+1)
+	}
+	out.WriteString(": " + d.Message)
+	if d.URL != "" {
+		out.WriteString(" (" + d.URL + ")")
+	}
+	return out.String()
+}
+
+// Collector accumulates the diagnostics of a conversion.
+// It is safe for concurrent use, and a nil *Collector
+// simply discards the diagnostics.
+type Collector struct {
+	mu          sync.Mutex
+	diagnostics []Diagnostic
+}
+
+// Add records the given diagnostic.
+func (c *Collector) Add(d Diagnostic) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.diagnostics = append(c.diagnostics, d)
+}
+
+// Diagnostics returns a copy of the diagnostics collected so far.
+func (c *Collector) Diagnostics() []Diagnostic {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Diagnostic(nil), c.diagnostics...)
+}
+
+// Err returns a *StrictError wrapping the diagnostics with
+// at least the `Warning` severity, or nil if there is none.
+func (c *Collector) Err() error {
+	var out StrictError
+	for _, d := range c.Diagnostics() {
+		if d.Severity >= Warning {
+			out.Diagnostics = append(out.Diagnostics, d)
+		}
+	}
+	if len(out.Diagnostics) == 0 {
+		return nil
+	}
+	return &out
+}
+
+// StrictError is returned in strict mode, when warnings have been emitted.
+type StrictError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *StrictError) Error() string {
+	if len(e.Diagnostics) == 1 {
+		return e.Diagnostics[0].String()
+	}
+	return fmt.Sprintf("%s (and %d more)", e.Diagnostics[0], len(e.Diagnostics)-1)
+}
@@ -0,0 +1,30 @@
+package diagnostics
+
+import "testing"
+
+func TestCollector(t *testing.T) {
+	var nilCollector *Collector
+	nilCollector.Add(Diagnostic{Severity: Error})
+	if nilCollector.Err() != nil || len(nilCollector.Diagnostics()) != 0 {
+		t.Fatal("nil collector should discard diagnostics")
+	}
+
+	var c Collector
+	c.Add(Diagnostic{Severity: Info, Code: FontSubsetFailed, Message: "subset", Page: -1})
+	if c.Err() != nil {
+		t.Fatal("info should not trigger an error")
+	}
+
+	c.Add(Diagnostic{Severity: Warning, Code: ResourceFetchFailed, Message: "not found", URL: "image.png", Page: -1})
+	c.Add(Diagnostic{Severity: Warning, Code: ImageInvalid, Message: "invalid", Page: 2})
+	err := c.Err()
+	if err == nil || len(err.(*StrictError).Diagnostics) != 2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if s := err.Error(); s != "warning [resource-fetch-failed]: not found (image.png) (and 1 more)" {
+		t.Fatalf("unexpected message %s", s)
+	}
+	if s := c.Diagnostics()[2].String(); s != "warning [image-invalid] (page 3): invalid" {
+		t.Fatalf("unexpected message %s", s)
+	}
+}
@@ -0,0 +1,437 @@
+package goweasyprint
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// CachingFetcher is an UrlFetcher storing the HTTP resources in a directory,
+// so that they are shared by the conversions, and by the processes using the
+// same directory.
+//
+// The HTTP caching headers are honoured : fresh resources (see Cache-Control max-age and Expires)
+// are served without request, and stale ones are revalidated using ETag and Last-Modified.
+// Concurrent fetches of the same URL are collapsed in one request, which is only
+// cancelled once all the callers have given up.
+//
+// To bind the requests to the conversions, use `Options.FetchCache`.
+//
+// The other URLs (like data or file URLs) are resolved with utils.DefaultUrlFetcher.
+type CachingFetcher struct {
+	dir     string
+	maxSize int64
+	client  *http.Client
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry // by key, see `cacheKey`
+	size     int64                  // total size of the bodies
+	inflight map[string]*inflightFetch
+}
+
+// cacheEntry is the metadata of a cached resource, stored
+// as JSON next to its body.
+type cacheEntry struct {
+	URL              string
+	MimeType         string
+	ProtocolEncoding string
+	RedirectedUrl    string
+	Filename         string
+
+	ETag         string
+	LastModified string
+	// Expires is the end of the freshness of the resource.
+	// The zero value means the resource must always be revalidated.
+	Expires time.Time
+
+	Size int64
+
+	lastUsed time.Time // in memory only, used for eviction
+}
+
+// inflightFetch is a request shared by concurrent fetches
+type inflightFetch struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int // protected by CachingFetcher.mu
+	entry   cacheEntry
+	content []byte
+	err     error
+}
+
+// NewCachingFetcher returns a fetcher storing the resources in `dir`,
+// which is created if needed, and may already contain resources.
+// `maxSize` is the maximum total size in bytes of the stored resources, the least recently
+// used ones being removed first. A zero or negative value means no limit.
+// `client` is used for the HTTP requests; if nil, http.DefaultClient is used.
+func NewCachingFetcher(dir string, maxSize int64, client *http.Client) (*CachingFetcher, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	cf := &CachingFetcher{
+		dir:      dir,
+		maxSize:  maxSize,
+		client:   client,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*inflightFetch),
+	}
+	if err := cf.load(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// load reads the metadata of the resources already stored
+func (cf *CachingFetcher) load() error {
+	files, err := filepath.Glob(filepath.Join(cf.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		key := strings.TrimSuffix(filepath.Base(file), ".json")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var entry cacheEntry
+		info, statErr := os.Stat(cf.bodyPath(key))
+		if json.Unmarshal(data, &entry) != nil || statErr != nil || info.Size() != entry.Size || cacheKey(entry.URL) != key {
+			cf.remove(key) // invalid entry
+			continue
+		}
+		entry.lastUsed = info.ModTime()
+		cf.entries[key] = &entry
+		cf.size += entry.Size
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.evict()
+	return nil
+}
+
+// Len returns the number of resources stored.
+func (cf *CachingFetcher) Len() int {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return len(cf.entries)
+}
+
+// Size returns the total size in bytes of the resources stored.
+func (cf *CachingFetcher) Size() int64 {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.size
+}
+
+func cacheKey(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(h[:])
+}
+
+func (cf *CachingFetcher) bodyPath(key string) string { return filepath.Join(cf.dir, key+".body") }
+
+func (cf *CachingFetcher) metaPath(key string) string { return filepath.Join(cf.dir, key+".json") }
+
+// remove deletes the files of the entry `key`
+func (cf *CachingFetcher) remove(key string) {
+	os.Remove(cf.metaPath(key))
+	os.Remove(cf.bodyPath(key))
+}
+
+// Fetch implements utils.UrlFetcher.
+func (cf *CachingFetcher) Fetch(urlTarget string) (utils.RemoteRessource, error) {
+	return cf.FetchContext(context.Background(), urlTarget)
+}
+
+// FetchContext is the same as Fetch, but returns as soon as `ctx` is done.
+// The HTTP request, which may be shared with concurrent calls, is cancelled
+// when the contexts of all these calls are done.
+func (cf *CachingFetcher) FetchContext(ctx context.Context, urlTarget string) (utils.RemoteRessource, error) {
+	if u, err := url.Parse(urlTarget); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return utils.DefaultUrlFetcher(urlTarget)
+	}
+
+	key := cacheKey(urlTarget)
+	cf.mu.Lock()
+	call, ok := cf.inflight[key]
+	if !ok {
+		// the request is not bound to the first caller, which may give up before the others
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &inflightFetch{done: make(chan struct{}), cancel: cancel}
+		cf.inflight[key] = call
+		go func() {
+			defer cancel()
+			call.entry, call.content, call.err = cf.fetch(fetchCtx, key, urlTarget)
+
+			cf.mu.Lock()
+			if cf.inflight[key] == call {
+				delete(cf.inflight, key)
+			}
+			close(call.done)
+			cf.mu.Unlock()
+		}()
+	}
+	call.waiters++
+	cf.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		cf.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 { // nobody is waiting anymore
+			call.cancel()
+			if cf.inflight[key] == call {
+				delete(cf.inflight, key)
+			}
+		}
+		cf.mu.Unlock()
+		return utils.RemoteRessource{}, ctx.Err()
+	}
+	if call.err != nil {
+		return utils.RemoteRessource{}, call.err
+	}
+	return utils.RemoteRessource{
+		Content:          bytes.NewReader(call.content),
+		MimeType:         call.entry.MimeType,
+		ProtocolEncoding: call.entry.ProtocolEncoding,
+		RedirectedUrl:    call.entry.RedirectedUrl,
+		Filename:         call.entry.Filename,
+	}, nil
+}
+
+// fetcher returns an UrlFetcher whose requests are bound to `ctx`.
+func (cf *CachingFetcher) fetcher(ctx context.Context) utils.UrlFetcher {
+	return func(urlTarget string) (utils.RemoteRessource, error) {
+		return cf.FetchContext(ctx, urlTarget)
+	}
+}
+
+// fetch returns the resource from the disk if it is fresh,
+// or performs a (conditional) request
+func (cf *CachingFetcher) fetch(ctx context.Context, key, urlTarget string) (cacheEntry, []byte, error) {
+	cf.mu.Lock()
+	cached, hasCached := cf.entries[key]
+	var entry cacheEntry
+	if hasCached {
+		entry = *cached
+	}
+	cf.mu.Unlock()
+
+	var content []byte
+	if hasCached {
+		var err error
+		content, err = os.ReadFile(cf.bodyPath(key))
+		if err != nil || int64(len(content)) != entry.Size { // the file has been removed or corrupted
+			hasCached = false
+		} else if time.Now().Before(entry.Expires) {
+			cf.touch(key)
+			return entry, content, nil
+		}
+	}
+
+	req, err := newRequest(ctx, urlTarget)
+	if err != nil {
+		return cacheEntry{}, nil, err
+	}
+	if hasCached {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	response, err := cf.client.Do(req)
+	if err != nil {
+		return cacheEntry{}, nil, err
+	}
+	defer response.Body.Close()
+
+	if hasCached && response.StatusCode == http.StatusNotModified {
+		expires, store := freshness(response.Header, time.Now())
+		if !store {
+			cf.drop(key)
+			return entry, content, nil
+		}
+		entry.Expires = expires
+		if etag := response.Header.Get("ETag"); etag != "" {
+			entry.ETag = etag
+		}
+		cf.store(key, entry, content)
+		return entry, content, nil
+	}
+
+	res, err := readResponse(response, response.Body, 0)
+	if err != nil {
+		return cacheEntry{}, nil, err
+	}
+	content = make([]byte, res.Content.Len())
+	res.Content.Read(content)
+	entry = cacheEntry{
+		URL:              urlTarget,
+		MimeType:         res.MimeType,
+		ProtocolEncoding: res.ProtocolEncoding,
+		RedirectedUrl:    res.RedirectedUrl,
+		Filename:         res.Filename,
+		ETag:             response.Header.Get("ETag"),
+		LastModified:     response.Header.Get("Last-Modified"),
+		Size:             int64(len(content)),
+	}
+	expires, store := freshness(response.Header, time.Now())
+	if response.StatusCode != http.StatusOK || !store {
+		cf.drop(key)
+		return entry, content, nil
+	}
+	entry.Expires = expires
+	cf.store(key, entry, content)
+	return entry, content, nil
+}
+
+// freshness returns the expiration date of a response, and false
+// if the response must not be stored.
+func freshness(header http.Header, now time.Time) (expires time.Time, store bool) {
+	if strings.TrimSpace(header.Get("Vary")) == "*" {
+		return time.Time{}, false
+	}
+	maxAge, hasMaxAge := -1, false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return time.Time{}, false
+		case "no-cache":
+			return time.Time{}, true
+		case "max-age":
+			if age, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge, hasMaxAge = age, true
+			}
+		}
+	}
+	if hasMaxAge {
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+			maxAge -= age
+		}
+		return now.Add(time.Duration(maxAge) * time.Second), true
+	}
+	if expiresS := header.Get("Expires"); expiresS != "" {
+		// invalid dates, like "0", mean already expired
+		expires, _ := http.ParseTime(expiresS)
+		return expires, true
+	}
+	// heuristic freshness (RFC 9111, section 4.2.2)
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && lastModified.Before(now) {
+		return now.Add(now.Sub(lastModified) / 10), true
+	}
+	return time.Time{}, true
+}
+
+// store writes the entry and its content, then
+// removes the least recently used entries if needed.
+func (cf *CachingFetcher) store(key string, entry cacheEntry, content []byte) {
+	if cf.maxSize > 0 && entry.Size > cf.maxSize {
+		cf.drop(key)
+		return
+	}
+	if err := writeFileAtomic(cf.bodyPath(key), content); err != nil {
+		cf.drop(key)
+		return
+	}
+	meta, _ := json.Marshal(entry)
+	if err := writeFileAtomic(cf.metaPath(key), meta); err != nil {
+		cf.drop(key)
+		return
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if previous, ok := cf.entries[key]; ok {
+		cf.size -= previous.Size
+	}
+	entry.lastUsed = time.Now()
+	cf.entries[key] = &entry
+	cf.size += entry.Size
+	cf.evict()
+}
+
+// drop removes the entry `key`, if any
+func (cf *CachingFetcher) drop(key string) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if entry, ok := cf.entries[key]; ok {
+		cf.size -= entry.Size
+		delete(cf.entries, key)
+		cf.remove(key)
+	}
+}
+
+// touch marks the entry as used
+func (cf *CachingFetcher) touch(key string) {
+	now := time.Now()
+	cf.mu.Lock()
+	if entry, ok := cf.entries[key]; ok {
+		entry.lastUsed = now
+	}
+	cf.mu.Unlock()
+	// persist the usage for the next processes
+	os.Chtimes(cf.bodyPath(key), now, now)
+}
+
+// evict removes the least recently used entries, until
+// the size limit is respected. `cf.mu` must be locked.
+func (cf *CachingFetcher) evict() {
+	if cf.maxSize <= 0 || cf.size <= cf.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(cf.entries))
+	for key := range cf.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return cf.entries[keys[i]].lastUsed.Before(cf.entries[keys[j]].lastUsed) })
+	for _, key := range keys {
+		if cf.size <= cf.maxSize {
+			break
+		}
+		cf.size -= cf.entries[key].Size
+		delete(cf.entries, key)
+		cf.remove(key)
+	}
+}
+
+// writeFileAtomic writes `content` in a temporary file, renamed to `path`,
+// so that other processes never read partial files.
+func writeFileAtomic(path string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("caching resource: %s", err)
+	}
+	return nil
+}
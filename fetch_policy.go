@@ -0,0 +1,340 @@
+package goweasyprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// FetchPolicy restricts the resources fetched during a conversion,
+// which is required when rendering untrusted HTML documents.
+// The zero value allows the http, https and data URLs, except for private addresses.
+type FetchPolicy struct {
+	// AllowedSchemes lists the URL schemes which may be fetched.
+	// It defaults to "http", "https" and "data".
+	// Note that allowing "file" gives access to the whole file system.
+	AllowedSchemes []string
+
+	// AllowedHosts, if not empty, restricts the hosts of the fetched URLs.
+	// An entry like "*.example.com" matches the subdomains of example.com,
+	// but not example.com itself.
+	AllowedHosts []string
+
+	// AllowPrivateIPs disables the blocking of the addresses which are not public,
+	// like the loopback, private, link-local, carrier-grade NAT, multicast and
+	// unspecified addresses, also when they are embedded in IPv6 addresses
+	// (IPv4-mapped or NAT64). The blocking is done after DNS resolution.
+	AllowPrivateIPs bool
+
+	// MaxResourceSize, if positive, is the maximum size in bytes of one resource.
+	MaxResourceSize int64
+
+	// Timeout, if positive, is the maximum duration of the fetching of one resource.
+	Timeout time.Duration
+
+	// MaxTotalSize, if positive, is the maximum number of bytes fetched in total.
+	// Since the resources may be fetched concurrently, the maximum size of a
+	// resource is reserved from this budget during its fetching.
+	MaxTotalSize int64
+
+	// MaxTotalDuration, if positive, is the maximum time spent fetching resources in total.
+	MaxTotalDuration time.Duration
+}
+
+// FetchDeniedError is returned when fetching a resource is not
+// allowed by a FetchPolicy.
+type FetchDeniedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *FetchDeniedError) Error() string {
+	return fmt.Sprintf("fetching %s is not allowed: %s", e.URL, e.Reason)
+}
+
+// privateAddressError is returned when dialing a private address.
+type privateAddressError struct {
+	address string
+}
+
+func (e privateAddressError) Error() string { return fmt.Sprintf("private address %s", e.address) }
+
+// Fetcher returns an UrlFetcher enforcing the policy.
+//
+// If `fetcher` is nil, HTTP requests are done by the policy, and the other allowed
+// URLs are resolved with utils.DefaultUrlFetcher. Otherwise, `fetcher` is called for the
+// allowed URLs : in this case, private addresses are detected by resolving the host
+// before calling `fetcher`, which may still connect to another address.
+//
+// The total limits apply to all the resources fetched with the returned UrlFetcher,
+// so a new one should be used for each conversion, as `Options.FetchPolicy` does.
+func (p FetchPolicy) Fetcher(fetcher utils.UrlFetcher) utils.UrlFetcher {
+	return p.fetcher(context.Background(), fetcher)
+}
+
+// fetcher returns an UrlFetcher enforcing the policy, bound to `ctx`.
+func (p FetchPolicy) fetcher(ctx context.Context, fetcher utils.UrlFetcher) utils.UrlFetcher {
+	pf := &policyFetcher{policy: p, ctx: ctx, fetcher: fetcher}
+	if fetcher == nil {
+		pf.client = p.newClient()
+	}
+	return pf.fetch
+}
+
+// policyFetcher stores the state of a FetchPolicy
+// shared by the fetches of one conversion
+type policyFetcher struct {
+	policy  FetchPolicy
+	ctx     context.Context
+	fetcher utils.UrlFetcher // may be nil
+	client  *http.Client     // used if fetcher is nil
+
+	mu            sync.Mutex
+	totalSize     int64
+	totalDuration time.Duration
+}
+
+func (pf *policyFetcher) fetch(urlTarget string) (utils.RemoteRessource, error) {
+	if err := pf.ctx.Err(); err != nil {
+		return utils.RemoteRessource{}, err
+	}
+	deny := func(format string, args ...any) (utils.RemoteRessource, error) {
+		return utils.RemoteRessource{}, &FetchDeniedError{URL: urlTarget, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	var host string
+	scheme := "data"
+	// data URLs may contain spaces, which are not accepted by url.Parse
+	if !strings.HasPrefix(strings.ToLower(urlTarget), "data:") {
+		u, err := url.Parse(urlTarget)
+		if err != nil {
+			return utils.RemoteRessource{}, err
+		}
+		scheme, host = strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	}
+	if reason := pf.policy.checkURL(scheme, host); reason != "" {
+		return deny("%s", reason)
+	}
+
+	// budget : the maximum size is reserved until the resource is fetched
+	maxSize, timeout, reason := pf.reserve()
+	if reason != "" {
+		return deny("%s", reason)
+	}
+	ctx := pf.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	res, err := pf.fetchAllowed(ctx, urlTarget, scheme, host, maxSize)
+	pf.mu.Lock()
+	pf.totalDuration += time.Since(start)
+	if pf.policy.MaxTotalSize > 0 {
+		pf.totalSize -= maxSize // refund the reservation
+	}
+	if err == nil {
+		pf.totalSize += res.Content.Size()
+	}
+	pf.mu.Unlock()
+
+	var privateErr privateAddressError
+	switch {
+	case errors.Is(err, errTooLarge):
+		return deny("resource larger than %d bytes", maxSize)
+	case errors.As(err, &privateErr):
+		return deny("%s", privateErr)
+	}
+	return res, err
+}
+
+// reserve checks the total limits, and returns the limits of the next fetch, or the reason
+// why it is denied. If MaxTotalSize is set, the returned size is reserved and must be refunded.
+func (pf *policyFetcher) reserve() (maxSize int64, timeout time.Duration, reason string) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	maxSize, timeout = pf.policy.MaxResourceSize, pf.policy.Timeout
+	if max := pf.policy.MaxTotalDuration; max > 0 {
+		if pf.totalDuration >= max {
+			return 0, 0, fmt.Sprintf("total duration limit of %s reached", max)
+		}
+		if timeout <= 0 || max-pf.totalDuration < timeout {
+			timeout = max - pf.totalDuration
+		}
+	}
+	if max := pf.policy.MaxTotalSize; max > 0 {
+		if pf.totalSize >= max {
+			return 0, 0, fmt.Sprintf("total size limit of %d bytes reached", max)
+		}
+		if maxSize <= 0 || max-pf.totalSize < maxSize {
+			maxSize = max - pf.totalSize
+		}
+		pf.totalSize += maxSize
+	}
+	return maxSize, timeout, ""
+}
+
+// fetchAllowed fetches an URL accepted by the policy.
+func (pf *policyFetcher) fetchAllowed(ctx context.Context, urlTarget, scheme, host string, maxSize int64) (utils.RemoteRessource, error) {
+	if pf.fetcher == nil && (scheme == "http" || scheme == "https") {
+		return httpFetch(ctx, pf.client, urlTarget, maxSize)
+	}
+
+	fetcher := utils.DefaultUrlFetcher
+	if pf.fetcher != nil {
+		if host != "" && !pf.policy.AllowPrivateIPs {
+			if err := checkHost(ctx, host); err != nil {
+				return utils.RemoteRessource{}, err
+			}
+		}
+		fetcher = contextFetcher(ctx, pf.fetcher)
+	}
+	res, err := fetcher(urlTarget)
+	if err != nil {
+		return utils.RemoteRessource{}, err
+	}
+	if maxSize > 0 && res.Content.Size() > maxSize {
+		return utils.RemoteRessource{}, errTooLarge
+	}
+	return res, nil
+}
+
+// checkURL returns the reason why the URL is denied, or an empty string.
+func (p FetchPolicy) checkURL(scheme, host string) string {
+	schemes := p.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https", "data"}
+	}
+	if !containsFold(schemes, scheme) {
+		return fmt.Sprintf("scheme %q not allowed", scheme)
+	}
+	if host == "" || len(p.AllowedHosts) == 0 {
+		return ""
+	}
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if domain, isWildcard := strings.CutPrefix(allowed, "*."); isWildcard {
+			if strings.HasSuffix(host, "."+domain) {
+				return ""
+			}
+		} else if host == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("host %q not allowed", host)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedPrefixes are the special-purpose ranges not covered by the netip.Addr methods
+// used in isPrivateIP
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, including the broadcast address
+	netip.MustParsePrefix("::/96"),          // IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fec0::/10"),      // site-local
+}
+
+// isPrivateIP returns true for the addresses which must not
+// be reached from untrusted documents.
+func isPrivateIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap() // IPv4-mapped IPv6 addresses
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range deniedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost resolves `host` and returns a privateAddressError
+// if one of its addresses is private.
+func checkHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if isPrivateIP(ip) {
+			return privateAddressError{host}
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) {
+			return privateAddressError{addr.IP.String()}
+		}
+	}
+	return nil
+}
+
+// newClient returns an HTTP client checking the addresses
+// it connects to, and the redirections.
+func (p FetchPolicy) newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !p.AllowPrivateIPs {
+		// the address is checked after DNS resolution
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return privateAddressError{host}
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		// proxies are not used, so that the addresses may be checked
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if reason := p.checkURL(req.URL.Scheme, strings.ToLower(req.URL.Hostname())); reason != "" {
+				return &FetchDeniedError{URL: req.URL.String(), Reason: reason}
+			}
+			return nil
+		},
+	}
+}
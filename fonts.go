@@ -0,0 +1,67 @@
+package goweasyprint
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	fc "github.com/benoitkugler/textprocessing/fontconfig"
+	"github.com/benoitkugler/textprocessing/pango/fcfonts"
+	"github.com/benoitkugler/webrender/logger"
+	"github.com/benoitkugler/webrender/text"
+)
+
+// LoadFontConfig returns a font configuration using the fonts found in `fontDirs`,
+// or, if `fontDirs` is empty, the system fonts.
+//
+// Since scanning the system fonts is slow, their index is stored in `cacheFile`,
+// which is created if needed. An empty `cacheFile` selects a file in the user cache directory.
+func LoadFontConfig(fontDirs []string, cacheFile string) (text.FontConfiguration, error) {
+	newFontConfig, err := NewFontConfigFunc(fontDirs, cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	return newFontConfig(), nil
+}
+
+// NewFontConfigFunc is the same as LoadFontConfig, but returns a function building
+// independent font configurations using the same fonts, which are only scanned once.
+// Since a font configuration is used by one conversion at a time, concurrent
+// conversions should each use their own (see `server.Config.NewFontConfig`).
+func NewFontConfigFunc(fontDirs []string, cacheFile string) (func() text.FontConfiguration, error) {
+	var (
+		fontset fc.Fontset
+		err     error
+	)
+	if len(fontDirs) != 0 {
+		fontset, err = fc.Standard.ScanFontDirectories(fontDirs...)
+		if err != nil {
+			return nil, fmt.Errorf("scanning fonts: %s", err)
+		}
+	} else {
+		if cacheFile == "" {
+			dir, err := os.UserCacheDir()
+			if err != nil {
+				return nil, fmt.Errorf("locating font index: %s", err)
+			}
+			dir = filepath.Join(dir, "go-weasyprint")
+			if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+				return nil, fmt.Errorf("creating font index: %s", err)
+			}
+			cacheFile = filepath.Join(dir, "fonts.fc")
+		}
+
+		fontset, err = fc.LoadFontsetFile(cacheFile)
+		if err != nil { // build the index
+			logger.ProgressLogger.Println("Scanning fonts...")
+			fontset, err = fc.ScanAndCache(cacheFile)
+			if err != nil {
+				return nil, fmt.Errorf("scanning fonts: %s", err)
+			}
+		}
+	}
+
+	return func() text.FontConfiguration {
+		return text.NewFontConfigurationPango(fcfonts.NewFontMap(fc.Standard.Copy(), fontset))
+	}, nil
+}
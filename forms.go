@@ -0,0 +1,108 @@
+package goweasyprint
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/utils"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// formFieldAttr marks the form elements converted to interactive fields,
+// and stores the URL identifying their box (see `pdf.FormFieldURL`).
+const formFieldAttr = "data-weasyprint-field"
+
+// formsCSS gives the box of the marked elements to the backend, as a link.
+const formsCSS = "[" + formFieldAttr + "] { link: attr(" + formFieldAttr + ") }"
+
+// formFields marks the supported form elements of the document whose root
+// element is `root`, and returns the corresponding fields, numbered from `first`.
+// The fields without name are named after their number.
+func formFields(root *utils.HTMLNode, first int) []pdf.FormField {
+	var out []pdf.FormField
+	iter := root.Iter(atom.Input, atom.Textarea, atom.Select)
+	for iter.HasNext() {
+		node := iter.Next()
+		field, ok := formField(node)
+		if !ok {
+			continue
+		}
+		index := first + len(out)
+		if field.Name == "" {
+			field.Name = fmt.Sprintf("field%d", index)
+		}
+		node.Attr = append(node.Attr, html.Attribute{Key: formFieldAttr, Val: pdf.FormFieldURL(index)})
+		out = append(out, field)
+	}
+	return out
+}
+
+// formField returns the field of the form element `node`, or false if
+// it is not supported, like the buttons, the hidden inputs and the list boxes.
+func formField(node *utils.HTMLNode) (pdf.FormField, bool) {
+	field := pdf.FormField{
+		Name:     node.Get("name"),
+		ReadOnly: node.HasAttr("readonly") || node.HasAttr("disabled"),
+		Required: node.HasAttr("required"),
+	}
+	switch node.DataAtom {
+	case atom.Textarea:
+		field.Kind = pdf.MultilineTextField
+		field.Value = string(node.GetChildrenText())
+	case atom.Select:
+		if node.HasAttr("multiple") {
+			return field, false
+		}
+		field.Kind = pdf.ComboBox
+		iter := node.Iter(atom.Option)
+		for iter.HasNext() {
+			option := iter.Next()
+			label := option.Get("label")
+			if label == "" {
+				label = strings.Join(strings.Fields(string(option.GetChildrenText())), " ")
+			}
+			value := label
+			if option.HasAttr("value") {
+				value = option.Get("value")
+			}
+			field.Options = append(field.Options, pdf.FormOption{Value: value, Label: label})
+			// the first option is selected by default
+			if option.HasAttr("selected") || len(field.Options) == 1 {
+				field.Value = value
+			}
+		}
+	case atom.Input:
+		switch strings.ToLower(node.Get("type")) {
+		case "", "text", "email", "number", "search", "tel", "url", "date", "time", "datetime-local", "month", "week":
+			field.Kind = pdf.TextField
+			field.Value = node.Get("value")
+		case "checkbox", "radio":
+			field.Kind = pdf.CheckBox
+			if strings.EqualFold(node.Get("type"), "radio") {
+				field.Kind = pdf.RadioButton
+			}
+			field.Value = "on"
+			if node.HasAttr("value") {
+				field.Value = node.Get("value")
+			}
+			field.Checked = node.HasAttr("checked")
+		default:
+			return field, false
+		}
+	default:
+		return field, false
+	}
+	return field, true
+}
+
+// formFieldLabel returns the alternate description of the form element `node`
+func formFieldLabel(node *utils.HTMLNode) string {
+	for _, attr := range [...]string{"aria-label", "title", "name"} {
+		if label := strings.TrimSpace(node.Get(attr)); label != "" {
+			return label
+		}
+	}
+	return ""
+}
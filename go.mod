@@ -9,6 +9,7 @@ require (
 	github.com/benoitkugler/textprocessing v0.0.5
 	github.com/benoitkugler/webrender v0.0.14
 	github.com/go-text/typesetting v0.3.1-0.20250404103358-86159049fd02
+	golang.org/x/net v0.42.0
 )
 
 require (
@@ -16,6 +17,5 @@ require (
 	github.com/benoitkugler/textlayout v0.3.2 // indirect
 	github.com/hhrutter/lzw v1.0.0 // indirect
 	golang.org/x/image v0.29.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/text v0.27.0 // indirect
 )
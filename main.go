@@ -1,9 +1,13 @@
 package goweasyprint
 
 import (
+	"context"
 	"io"
+	"runtime/debug"
+	"sync"
 
 	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/progress"
 	"github.com/benoitkugler/webrender/backend"
 	"github.com/benoitkugler/webrender/html/document"
 	"github.com/benoitkugler/webrender/html/tree"
@@ -27,9 +31,9 @@ type (
 //   - ... which is transformed into an in-memory PDF by `document.WriteDocument`, using the `pdf.Ouput` backend.
 //   - model.Write eventually serialize the PDF into `target`
 //
-// See `HtmlToPdfOptions` for more options.
+// See `Convert` for more options.
 func HtmlToPdf(target io.Writer, htmlContent ContentInput, fontConfig text.FontConfiguration) error {
-	return HtmlToPdfOptions(target, htmlContent, "", nil, "", nil, false, fontConfig, 1, nil)
+	return Convert(target, htmlContent, fontConfig, Options{})
 }
 
 // HtmlToPdfOptions is the same as HtmlToPdf, with control overs the following parameters:
@@ -40,16 +44,154 @@ func HtmlToPdf(target io.Writer, htmlContent ContentInput, fontConfig text.FontC
 //   - `presentationHints` controls whether or not the additional presentation stylesheet is used. It defaults to "false".
 //   - `zoom` is a zoom factor. It defaults to 1.
 //   - `attachements` is an additional list of attachements to include into the PDF file.
+//
+// New code should prefer `Convert`, which accepts an `Options` struct.
 func HtmlToPdfOptions(target io.Writer, htmlContent ContentInput, baseUrl string, urlFetcher utils.UrlFetcher,
 	mediaType string, stylesheets []tree.CSS, presentationalHints bool, fontConfig text.FontConfiguration, zoom float64, attachments []backend.Attachment,
 ) error {
-	parsedHtml, err := tree.NewHTML(htmlContent, baseUrl, urlFetcher, mediaType)
+	return Convert(target, htmlContent, fontConfig, Options{
+		BaseUrl:             baseUrl,
+		UrlFetcher:          urlFetcher,
+		MediaType:           mediaType,
+		Stylesheets:         stylesheets,
+		PresentationalHints: presentationalHints,
+		Zoom:                zoom,
+		Attachments:         attachments,
+	})
+}
+
+// Convert performs the conversion of an HTML document (`htmlContent`) to a PDF file,
+// written in `target`, using the settings given in `opts`.
+// `fontConfig` is mandatory. Its caches are not safe for concurrent use, so that the
+// conversions sharing a font configuration are laid out and drawn one at a time :
+// concurrent conversions should use their own (see `NewFontConfigFunc`).
+func Convert(target io.Writer, htmlContent ContentInput, fontConfig text.FontConfiguration, opts Options) error {
+	return ConvertContext(context.Background(), target, htmlContent, fontConfig, opts)
+}
+
+// ConvertContext is the same as Convert, but stops as soon as possible
+// once `ctx` is done, returning `ctx.Err()`.
+//
+// Cancellation is forwarded to the resource fetching, and checked between pages
+// and while writing the PDF file. Note that the layout step can't be interrupted :
+// in this case, ConvertContext returns early but the layout goroutine keeps running in
+// the background until completion.
+//
+// Unexpected panics are recovered and returned as a *PanicError.
+//
+// To write the same document several times, see `Render`.
+func ConvertContext(ctx context.Context, target io.Writer, htmlContent ContentInput, fontConfig text.FontConfiguration, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	opts = opts.prepare(ctx)
+
+	doc, parsedHtml, fields, err := renderContext(ctx, htmlContent, fontConfig, opts, 0)
 	if err != nil {
 		return err
 	}
-	doc := document.Render(parsedHtml, stylesheets, presentationalHints, fontConfig)
-	output := pdf.NewOutput()
-	doc.Write(output, utils.Fl(zoom), attachments)
-	pdfDoc := output.Finalize()
-	return pdfDoc.Write(target, nil)
+
+	rd := &RenderedDocument{doc: doc, baseUrl: parsedHtml.BaseUrl, root: parsedHtml.Root, fields: fields, fontConfig: fontConfig}
+	return rd.write(ctx, target, opts)
+}
+
+// renderContext parses and lays out the document in a separate goroutine,
+// so that it may return when `ctx` is done.
+// The parsed document, giving its base URL, is also returned, with the
+// form fields, numbered from `firstField`, if `opts.Forms` is set.
+func renderContext(ctx context.Context, htmlContent ContentInput, fontConfig text.FontConfiguration, opts Options, firstField int) (document.Document, *tree.HTML, []pdf.FormField, error) {
+	type result struct {
+		doc        document.Document
+		parsedHtml *tree.HTML
+		fields     []pdf.FormField
+		err        error
+	}
+	opts.Progress.Report(progress.Parsing, 0, 1)
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			if r := recover(); r != nil {
+				pe := &PanicError{Step: "layout", Page: -1, Value: r, Stack: debug.Stack()}
+				opts.Diagnostics.Add(pe.diagnostic())
+				res.err = pe
+			}
+			done <- res
+		}()
+
+		parsedHtml, err := tree.NewHTML(htmlContent, opts.BaseUrl, opts.UrlFetcher, opts.MediaType)
+		if err != nil {
+			res.err = err
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			res.err = err
+			return
+		}
+		opts.Progress.Report(progress.Parsing, 1, 1)
+		opts.Progress.Report(progress.Layout, 0, 0)
+		res.parsedHtml = parsedHtml
+		stylesheets := opts.Stylesheets
+		if opts.Forms {
+			formsStylesheet, err := tree.NewCSSDefault(utils.InputString(formsCSS))
+			if err != nil {
+				res.err = err
+				return
+			}
+			res.fields = formFields(parsedHtml.Root, firstField)
+			// the form elements are drawn as widgets, without their value
+			stylesheets = append([]tree.CSS{tree.Html5UAFormsStylesheet, formsStylesheet}, stylesheets...)
+		}
+		defer lockFontConfig(fontConfig)()
+		res.doc = document.Render(parsedHtml, stylesheets, opts.PresentationalHints, fontConfig)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return document.Document{}, nil, nil, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return document.Document{}, nil, nil, res.err
+		}
+		opts.Progress.Report(progress.Layout, len(res.doc.Pages), len(res.doc.Pages))
+		// the layout may have been done with failing fetches
+		return res.doc, res.parsedHtml, res.fields, ctx.Err()
+	}
+}
+
+// fontLocks stores the locks of the font configurations
+// being used, removed once released.
+var fontLocks = struct {
+	sync.Mutex
+	m map[text.FontConfiguration]*fontLock
+}{m: make(map[text.FontConfiguration]*fontLock)}
+
+type fontLock struct {
+	sync.Mutex
+	users int // number of goroutines holding or waiting for the lock
+}
+
+// lockFontConfig serializes the use of `fontConfig`, whose caches are not
+// safe for concurrent use : it must be held during the layout and the drawing of a document.
+// The returned function releases the lock.
+func lockFontConfig(fontConfig text.FontConfiguration) (unlock func()) {
+	fontLocks.Lock()
+	l := fontLocks.m[fontConfig]
+	if l == nil {
+		l = new(fontLock)
+		fontLocks.m[fontConfig] = l
+	}
+	l.users++
+	fontLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		fontLocks.Lock()
+		defer fontLocks.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(fontLocks.m, fontConfig)
+		}
+	}
 }
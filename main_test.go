@@ -1,15 +1,47 @@
 package goweasyprint
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/pdf"
 	"github.com/benoitkugler/go-weasyprint/pdf/test"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	cs "github.com/benoitkugler/pdf/contentstream"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader"
 	"github.com/benoitkugler/pdf/reader/file"
+	"github.com/benoitkugler/pdf/reader/parser"
+	"github.com/benoitkugler/webrender/backend"
 	"github.com/benoitkugler/webrender/logger"
 	"github.com/benoitkugler/webrender/text"
 	"github.com/benoitkugler/webrender/utils"
@@ -183,6 +215,715 @@ func TestSVGGradient(t *testing.T) {
 	}
 }
 
+func TestConvertOptions(t *testing.T) {
+	input := utils.InputString(`<style>@page { size: 3in 4in }</style><p>Hello</p>`)
+	for _, test := range []struct {
+		opts     Options
+		expected model.Rectangle
+	}{
+		{Options{}, model.Rectangle{Urx: 216, Ury: 288}},
+		{Options{Zoom: 2}, model.Rectangle{Urx: 432, Ury: 576}},
+		{Options{MediaType: "screen"}, model.Rectangle{Urx: 216, Ury: 288}},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, input, fontconfig, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := doc.Catalog.Pages.FlattenInherit()
+		if len(pages) != 1 {
+			t.Fatalf("unexpected number of pages %d", len(pages))
+		}
+		if got := *pages[0].MediaBox; got != test.expected {
+			t.Fatalf("unexpected MediaBox %v", got)
+		}
+	}
+}
+
+func TestConvertContext(t *testing.T) {
+	input := utils.InputString(`<p>Hello</p><img src="http://example.invalid/slow.png">`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ConvertContext(ctx, io.Discard, input, fontconfig, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// a fetcher blocking forever
+	block := make(chan struct{})
+	defer close(block)
+	slowFetcher := func(url string) (utils.RemoteRessource, error) {
+		<-block
+		return utils.RemoteRessource{}, errors.New("unreachable")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ti := time.Now()
+	err = ConvertContext(ctx, io.Discard, input, fontconfig, Options{UrlFetcher: slowFetcher})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(ti); elapsed > time.Second {
+		t.Fatalf("cancellation took too long: %s", elapsed)
+	}
+
+	// no cancellation
+	var buf bytes.Buffer
+	err = ConvertContext(context.Background(), &buf, utils.InputString("<p>Hello</p>"), fontconfig, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF")) {
+		t.Fatal("invalid PDF output")
+	}
+}
+
+func TestConvertParts(t *testing.T) {
+	parts := []Part{
+		{Content: utils.InputString(`<h1>Cover</h1>`), BaseUrl: "http://example.com/cover.html"},
+		{Content: utils.InputString(`<h1>Chapter</h1><a href="appendix.html#a1">see appendix</a>`), Label: "Chapter 1", BaseUrl: "http://example.com/chapter.html"},
+		{Content: utils.InputString(`<h1 id="a1">Appendix</h1>`), Label: "Appendix", BaseUrl: "http://example.com/appendix.html"},
+	}
+	var buf bytes.Buffer
+	err := ConvertParts(&buf, parts, fontconfig, Options{
+		Attachments: []backend.Attachment{{Title: "data.txt", Content: []byte("some data")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if L := len(doc.Catalog.Pages.Flatten()); L != 3 {
+		t.Fatalf("expected 3 pages, got %d", L)
+	}
+	if L := len(doc.Catalog.Names.EmbeddedFiles); L != 1 {
+		t.Fatalf("expected 1 attachment, got %d", L)
+	}
+	var titles []string
+	for item := doc.Catalog.Outlines.First; item != nil; item = item.Next {
+		titles = append(titles, item.Title)
+	}
+	if !reflect.DeepEqual(titles, []string{"Cover", "Chapter 1", "Appendix"}) {
+		t.Fatalf("unexpected outline %v", titles)
+	}
+	link := doc.Catalog.Pages.Flatten()[1].Annots[0].Subtype.(model.AnnotationLink)
+	if _, has := doc.Catalog.Names.Dests.LookupTable()[link.Dest.(model.DestinationString)]; !has {
+		t.Fatalf("unexpected link destination %v", link.Dest)
+	}
+}
+
+func TestRenderedDocument(t *testing.T) {
+	input := utils.InputString(`<style>@page{size:3in 4in}</style><p id="a">x</p><p style="break-before:page">y</p>`)
+	rd, err := Render(input, fontconfig, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.PageCount() != 2 {
+		t.Fatalf("expected 2 pages, got %d", rd.PageCount())
+	}
+	if sizes := rd.PageSizes(); sizes[0] != (PageSize{288, 384}) {
+		t.Fatalf("unexpected page size %v", sizes[0])
+	}
+	if anchors := rd.Anchors(); len(anchors) != 2 || len(anchors[0]) != 1 || anchors[0][0].Name != "a" {
+		t.Fatalf("unexpected anchors %v", anchors)
+	}
+
+	for _, zoom := range []model.Fl{1, 2} {
+		var buf bytes.Buffer
+		err = rd.Write(&buf, Options{Zoom: float64(zoom)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := doc.Catalog.Pages.Flatten()
+		if len(pages) != 2 {
+			t.Fatalf("expected 2 pages, got %d", len(pages))
+		}
+		if box := *pages[0].MediaBox; box.Urx != 216*zoom || box.Ury != 288*zoom {
+			t.Fatalf("unexpected media box %v for zoom %g", box, zoom)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = rd.Write(&buf, Options{Pages: "last"}); err != nil {
+		t.Fatal(err)
+	}
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if L := len(doc.Catalog.Pages.Flatten()); L != 1 {
+		t.Fatalf("expected 1 page, got %d", L)
+	}
+	if err = rd.Write(io.Discard, Options{Pages: "2-1"}); err == nil {
+		t.Fatal("expected error for invalid page selection")
+	}
+
+	buf.Reset()
+	if err = rd.Write(&buf, Options{Stream: true}); err != nil {
+		t.Fatal(err)
+	}
+	doc, _, err = reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if L := len(doc.Catalog.Pages.Flatten()); L != 2 {
+		t.Fatalf("expected 2 pages, got %d", L)
+	}
+	if err = rd.Write(io.Discard, Options{Stream: true, Pages: "1"}); err == nil {
+		t.Fatal("expected error for page selection in streaming mode")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	input := utils.InputString(`<p>Hello</p><img src="resources_test/missing.png">`)
+
+	var diags diagnostics.Collector
+	err := Convert(io.Discard, input, fontconfig, Options{BaseUrl: ".", Diagnostics: &diags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := diags.Diagnostics()
+	if len(ds) != 1 || ds[0].Code != diagnostics.ResourceFetchFailed || !strings.HasSuffix(ds[0].URL, "resources_test/missing.png") {
+		t.Fatalf("unexpected diagnostics: %v", ds)
+	}
+
+	// strict mode
+	var buf bytes.Buffer
+	err = Convert(&buf, input, fontconfig, Options{BaseUrl: ".", Strict: true})
+	var strictErr *diagnostics.StrictError
+	if !errors.As(err, &strictErr) || len(strictErr.Diagnostics) != 1 {
+		t.Fatalf("expected strict error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("unexpected output in strict mode")
+	}
+
+	err = Convert(io.Discard, utils.InputString("<p>Hello</p>"), fontconfig, Options{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	input := utils.InputString(`<p>Hello</p><img src="resources_test/pattern.png"><p style="break-before:page">World</p>`)
+
+	for _, stream := range []bool{false, true} {
+		var events []progress.Event
+		var buf bytes.Buffer
+		err := Convert(&buf, input, fontconfig, Options{
+			BaseUrl:  ".",
+			Stream:   stream,
+			Progress: func(e progress.Event) { events = append(events, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		byPhase := map[progress.Phase][]progress.Event{}
+		for _, e := range events {
+			byPhase[e.Phase] = append(byPhase[e.Phase], e)
+		}
+		ev := func(phase progress.Phase, current, total int) progress.Event {
+			return progress.Event{Phase: phase, Current: current, Total: total}
+		}
+		expected := map[progress.Phase][]progress.Event{
+			progress.Parsing:        {ev(progress.Parsing, 0, 1), ev(progress.Parsing, 1, 1)},
+			progress.Layout:         {ev(progress.Layout, 0, 0), ev(progress.Layout, 2, 2)},
+			progress.Drawing:        {ev(progress.Drawing, 0, 2), ev(progress.Drawing, 1, 2), ev(progress.Drawing, 2, 2)},
+			progress.FontSubsetting: {ev(progress.FontSubsetting, 0, 1), ev(progress.FontSubsetting, 1, 1)},
+			progress.ImageEncoding:  {ev(progress.ImageEncoding, 1, 0)},
+		}
+		for phase, exp := range expected {
+			if !reflect.DeepEqual(byPhase[phase], exp) {
+				t.Fatalf("unexpected events for %s: %v", phase, byPhase[phase])
+			}
+		}
+		ser := byPhase[progress.Serialization]
+		if first, last := ser[0], ser[len(ser)-1]; first.Current != 0 || last.Current != buf.Len() || last.Total != buf.Len() {
+			t.Fatalf("unexpected serialization events %v", ser)
+		}
+		if events[len(events)-1] != ser[len(ser)-1] {
+			t.Fatal("serialization should be the last phase")
+		}
+	}
+}
+
+func TestFetchPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/redirect":
+			http.Redirect(w, r, "http://example.invalid/", http.StatusFound)
+			return
+		}
+		w.Write(make([]byte, 100))
+	}))
+	defer server.Close()
+
+	isDenied := func(err error) bool {
+		var denied *FetchDeniedError
+		return errors.As(err, &denied)
+	}
+
+	fetch := FetchPolicy{}.Fetcher(nil)
+	if _, err := fetch("file:///etc/passwd"); !isDenied(err) {
+		t.Fatalf("expected denied scheme, got %v", err)
+	}
+	if _, err := fetch(server.URL); !isDenied(err) {
+		t.Fatalf("expected denied private address, got %v", err)
+	}
+	if _, err := fetch("data:text/plain,hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	custom := func(url string) (utils.RemoteRessource, error) {
+		return utils.RemoteRessource{Content: bytes.NewReader(nil)}, nil
+	}
+	if _, err := (FetchPolicy{}).Fetcher(custom)("http://10.0.0.1/image.png"); !isDenied(err) {
+		t.Fatalf("expected denied private address, got %v", err)
+	}
+
+	fetch = FetchPolicy{AllowedHosts: []string{"*.example.com"}, AllowPrivateIPs: true}.Fetcher(custom)
+	if _, err := fetch("https://example.com/image.png"); !isDenied(err) {
+		t.Fatalf("expected denied host, got %v", err)
+	}
+	if _, err := fetch("https://cdn.example.com/image.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch("https://EXAMPLE.com/image.png"); !isDenied(err) {
+		t.Fatalf("expected denied host, got %v", err)
+	}
+
+	policy := FetchPolicy{AllowPrivateIPs: true, AllowedHosts: []string{"127.0.0.1"}}
+	fetch = policy.Fetcher(nil)
+	if res, err := fetch(server.URL); err != nil || res.Content.Len() != 100 {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+	if _, err := fetch(server.URL + "/redirect"); !isDenied(err) {
+		t.Fatalf("expected denied redirection, got %v", err)
+	}
+
+	policy.MaxResourceSize = 50
+	if _, err := policy.Fetcher(nil)(server.URL); !isDenied(err) {
+		t.Fatalf("expected too large resource, got %v", err)
+	}
+
+	policy.MaxResourceSize = 0
+	policy.Timeout = 50 * time.Millisecond
+	if _, err := policy.Fetcher(nil)(server.URL + "/slow"); !errors.Is(err, context.DeadlineExceeded) || isDenied(err) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	policy.Timeout = 0
+	policy.MaxTotalSize = 150
+	fetch = policy.Fetcher(nil)
+	if _, err := fetch(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(server.URL); !isDenied(err) {
+		t.Fatalf("expected exhausted budget, got %v", err)
+	}
+
+	// the budget is respected by concurrent fetches
+	fetch = policy.Fetcher(nil)
+	var (
+		wg      sync.WaitGroup
+		fetched atomic.Int64
+	)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := fetch(server.URL + "/slow"); err == nil {
+				fetched.Add(int64(res.Content.Len()))
+			}
+		}()
+	}
+	wg.Wait()
+	if fetched.Load() > policy.MaxTotalSize {
+		t.Fatalf("exceeded budget: %d bytes fetched", fetched.Load())
+	}
+
+	// denied fetches are reported
+	var diags diagnostics.Collector
+	err := Convert(io.Discard, utils.InputString(`<img src="file:///etc/passwd">`), fontconfig,
+		Options{FetchPolicy: &FetchPolicy{}, Diagnostics: &diags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds := diags.Diagnostics(); len(ds) != 1 || ds[0].Code != diagnostics.ResourceDenied {
+		t.Fatalf("unexpected diagnostics %v", ds)
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, test := range []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::808:808", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"2606:4700::1111", false},
+		{"::ffff:8.8.8.8", false},
+	} {
+		if got := isPrivateIP(net.ParseIP(test.ip)); got != test.private {
+			t.Fatalf("isPrivateIP(%s): expected %v, got %v", test.ip, test.private, got)
+		}
+	}
+}
+
+func TestCachingFetcher(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	image, err := os.ReadFile("resources_test/pattern.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/pattern.png":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+			return
+		}
+		w.Write(make([]byte, 100))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	cf, err := NewCachingFetcher(dir, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchTwice := func(cf *CachingFetcher, path string) {
+		for range [2]int{} {
+			res, err := cf.Fetch(server.URL + path)
+			if err != nil || res.Content.Len() != 100 {
+				t.Fatalf("unexpected result for %s: %v %v", path, res, err)
+			}
+		}
+	}
+	fetchTwice(cf, "/fresh")
+	fetchTwice(cf, "/etag")
+	fetchTwice(cf, "/no-store")
+	if requests["/fresh"] != 1 || requests["/etag"] != 2 || requests["/no-store"] != 2 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	if cf.Len() != 2 || cf.Size() != 200 {
+		t.Fatalf("unexpected cache content: %d entries, %d bytes", cf.Len(), cf.Size())
+	}
+
+	// concurrent fetches are collapsed
+	var wg sync.WaitGroup
+	for range [5]int{} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cf.Fetch(server.URL + "/slow"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests["/slow"] != 1 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+
+	// the resources are persisted
+	cf, err = NewCachingFetcher(dir, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchTwice(cf, "/fresh")
+	if cf.Len() != 3 || requests["/fresh"] != 1 {
+		t.Fatalf("unexpected cache content: %d entries, requests %v", cf.Len(), requests)
+	}
+
+	// size limit
+	cf, err = NewCachingFetcher(dir, 150, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.Len() != 1 || cf.Size() != 100 {
+		t.Fatalf("unexpected cache content: %d entries, %d bytes", cf.Len(), cf.Size())
+	}
+	fetchTwice(cf, "/slow")
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.body")); len(files) != 1 {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	// usage in a conversion
+	for range [2]int{} {
+		err = HtmlToPdfOptions(io.Discard, utils.InputString(`<img src="pattern.png">`), server.URL+"/", cf.Fetch, "", nil, false, fontconfig, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests["/pattern.png"] != 1 {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+}
+
+// waiters returns the number of callers waiting for the shared request of `urlTarget`
+func (cf *CachingFetcher) waiters(urlTarget string) int {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if call := cf.inflight[cacheKey(urlTarget)]; call != nil {
+		return call.waiters
+	}
+	return 0
+}
+
+func TestCachingFetcherCancel(t *testing.T) {
+	started, release, cancelled := make(chan struct{}, 2), make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		switch r.URL.Path {
+		case "/block":
+			<-release
+			w.Write(make([]byte, 100))
+		case "/hang":
+			<-r.Context().Done()
+			close(cancelled)
+		}
+	}))
+	defer server.Close()
+
+	cf, err := NewCachingFetcher(t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first caller giving up does not cancel the shared request
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := cf.FetchContext(ctx, server.URL+"/block")
+		firstErr <- err
+	}()
+	<-started
+	second := make(chan error, 1)
+	go func() {
+		res, err := cf.FetchContext(context.Background(), server.URL+"/block")
+		if err == nil && res.Content.Len() != 100 {
+			err = fmt.Errorf("unexpected content length %d", res.Content.Len())
+		}
+		second <- err
+	}()
+	for cf.waiters(server.URL+"/block") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+
+	// the conversion context is forwarded to the request
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = ConvertContext(ctx, io.Discard, utils.InputString(`<img src="hang">`), fontconfig, Options{BaseUrl: server.URL + "/", FetchCache: cf})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not cancelled")
+	}
+}
+
+type templateRecord struct {
+	Name string
+	Fail bool
+}
+
+func (r templateRecord) Check() (string, error) {
+	if r.Fail {
+		return "", errors.New("invalid record")
+	}
+	return "ok", nil
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (cb *closingBuffer) Close() error {
+	cb.closed = true
+	return nil
+}
+
+func TestConvertTemplate(t *testing.T) {
+	tmpl := Template{
+		Template: template.Must(template.New("doc").Parse(`<img src="pattern.png">
+		<p>{{ .Name }} {{ .Check }}</p>`)),
+		BaseDir: "resources_test",
+	}
+
+	var (
+		buf   bytes.Buffer
+		diags diagnostics.Collector
+	)
+	err := ConvertTemplate(&buf, tmpl, templateRecord{Name: "Hello"}, fontconfig, Options{Diagnostics: &diags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds := diags.Diagnostics(); len(ds) != 0 {
+		t.Fatalf("unexpected diagnostics %v", ds)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF")) {
+		t.Fatal("invalid PDF output")
+	}
+
+	// template errors
+	var te *TemplateError
+	err = ConvertTemplate(io.Discard, tmpl, templateRecord{Fail: true}, fontconfig, Options{})
+	if !errors.As(err, &te) || te.Name != "doc" || te.Line != 2 {
+		t.Fatalf("expected template error, got %v", err)
+	}
+	_, err = ParseTemplateFS(fstest.MapFS{"page.html": {Data: []byte("<p>\n{{ if }}</p>")}}, "*.html")
+	if !errors.As(err, &te) || te.Name != "page.html" || te.Line != 2 {
+		t.Fatalf("expected template error, got %v", err)
+	}
+	tmpl.Template = template.Must(template.New("doc").Parse(`<a href="{{ .Name }}`)) // escaping error
+	err = ConvertTemplate(io.Discard, tmpl, templateRecord{}, fontconfig, Options{})
+	if !errors.As(err, &te) || te.Name != "doc" {
+		t.Fatalf("expected template error, got %v", err)
+	}
+
+	// batch mode
+	fsys := fstest.MapFS{"base.html": {Data: []byte(`{{ define "page" }}<p>{{ .Name }} {{ .Check }}</p>{{ end }}`)}}
+	parsed, err := ParseTemplateFS(fsys, "*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl = Template{Template: parsed, Name: "page"}
+	records := []any{templateRecord{Name: "a"}, templateRecord{Name: "b"}, templateRecord{Fail: true}, templateRecord{Name: "d"}}
+	targets := make([]*closingBuffer, len(records))
+	err = ConvertTemplateBatch(func(index int) (io.WriteCloser, error) {
+		targets[index] = new(closingBuffer)
+		return targets[index], nil
+	}, tmpl, records, 2, fontconfig, Options{})
+	var be *BatchError
+	if !errors.As(err, &be) || be.Index != 2 || !errors.As(err, &te) {
+		t.Fatalf("expected batch error, got %v", err)
+	}
+	for i, target := range targets {
+		if !target.closed {
+			t.Fatalf("target %d not closed", i)
+		}
+		if i != 2 && !bytes.HasPrefix(target.Bytes(), []byte("%PDF")) {
+			t.Fatalf("invalid PDF output for record %d", i)
+		}
+	}
+
+	// the diagnostics of a record do not fail the others
+	tmpl = Template{Template: template.Must(template.New("doc").Parse(`<img src="{{ .Name }}"><p>{{ .Name }}</p>`)), BaseDir: "resources_test"}
+	records = []any{templateRecord{Name: "pattern.png"}, templateRecord{Name: "missing.png"}, templateRecord{Name: "pattern.png"}, templateRecord{Name: "pattern.png"}}
+	diags = diagnostics.Collector{}
+	err = ConvertTemplateBatchContext(context.Background(), func(index int) (io.WriteCloser, error) {
+		return new(closingBuffer), nil
+	}, tmpl, records, 1, fontconfig, Options{Diagnostics: &diags, Strict: true})
+	var se *diagnostics.StrictError
+	if !errors.As(err, &be) || be.Index != 1 || !errors.As(err, &se) || strings.Count(err.Error(), "record") != 1 {
+		t.Fatalf("expected one strict error, got %v", err)
+	}
+	if ds := diags.Diagnostics(); len(ds) != 1 || ds[0].Code != diagnostics.ResourceFetchFailed {
+		t.Fatalf("unexpected diagnostics %v", ds)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	panickingFetcher := func(url string) (utils.RemoteRessource, error) { panic("fetcher bug") }
+	var diags diagnostics.Collector
+	err := Convert(io.Discard, utils.InputString(`<img src="http://example.invalid/image.png">`), fontconfig,
+		Options{UrlFetcher: panickingFetcher, Diagnostics: &diags})
+	var pe *PanicError
+	if !errors.As(err, &pe) || pe.Step != "layout" || pe.Value != "fetcher bug" {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+	if ds := diags.Diagnostics(); len(ds) != 1 || ds[0].Code != diagnostics.Panic {
+		t.Fatalf("unexpected diagnostics %v", ds)
+	}
+
+	// panic while drawing the second page
+	output := pdf.NewOutput()
+	output.AddPage(0, 0, 10, 10)
+	output.AddPage(0, 0, 10, 10)
+	err = func() (err error) {
+		defer recoverPanic(context.Background(), output.CurrentPage, nil, &err)
+		panic("drawing bug")
+	}()
+	if !errors.As(err, &pe) || pe.Step != "drawing" || pe.Page != 1 || len(pe.Stack) == 0 {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+
+	// panic before the output is created
+	var notCreated *pdf.Output
+	err = func() (err error) {
+		defer recoverPanic(context.Background(), currentPage(&notCreated), nil, &err)
+		panic("setup bug")
+	}()
+	if !errors.As(err, &pe) || pe.Value != "setup bug" || pe.Page != -1 {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+}
+
 func TestFixUpstreamFont(t *testing.T) {
 	t.Skip()
 	f, _ := os.Open("resources_test/weasyprint.otb")
@@ -212,3 +953,978 @@ func TestFixUpstreamFont(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// infoEntries returns the raw entries of the document information dictionary.
+func infoEntries(t *testing.T, pdfBytes []byte) map[string]string {
+	t.Helper()
+	f, err := file.Read(bytes.NewReader(pdfBytes), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Info == nil {
+		t.Fatal("missing Info dictionary")
+	}
+	info, _ := f.ResolveObject(*f.Info).(model.ObjDict)
+	out := make(map[string]string)
+	for key, value := range info {
+		if s, ok := model.IsString(f.ResolveObject(value)); ok {
+			out[string(key)] = reader.DecodeTextString(s)
+		}
+	}
+	return out
+}
+
+func TestMetadata(t *testing.T) {
+	const html = `
+	<title>HTML title</title>
+	<meta name=author content="Alice">
+	<meta name=keywords content="html, invoice">
+	<p>Content</p>`
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	metadata := &pdf.Metadata{
+		Title:        "Invoice 42",
+		Keywords:     []string{"invoice", "2020"},
+		MergeLists:   true,
+		CreationDate: created,
+		Custom:       map[string]string{"InvoiceNumber": "INV-42", "Client Name": "Zoë Müller"},
+		XMP: []pdf.XMPNamespace{
+			{Prefix: "inv", URI: "http://example.com/invoice/1.0/", Properties: map[string]string{"Number": "INV-42"}},
+			{Prefix: "dc", URI: "http://example.com/ignored/"},
+		},
+	}
+
+	for _, stream := range []bool{false, true} {
+		var buf bytes.Buffer
+		err := Convert(&buf, utils.InputString(html), fontconfig, Options{Metadata: metadata, Stream: stream})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := doc.Trailer.Info
+		if info.Title != "Invoice 42" {
+			t.Fatalf("unexpected Title %q", info.Title)
+		}
+		if info.Author != "Alice" { // not overridden
+			t.Fatalf("unexpected Author %q", info.Author)
+		}
+		if info.Keywords != "html, invoice, 2020" {
+			t.Fatalf("unexpected Keywords %q", info.Keywords)
+		}
+		if !info.CreationDate.Equal(created) {
+			t.Fatalf("unexpected CreationDate %s", info.CreationDate)
+		}
+
+		entries := infoEntries(t, buf.Bytes())
+		// the reader does not decode the escaped names
+		if entries["InvoiceNumber"] != "INV-42" || entries["Client#20Name"] != "Zoë Müller" {
+			t.Fatalf("unexpected custom entries %v", entries)
+		}
+		if entries["Title"] != "Invoice 42" {
+			t.Fatalf("unexpected entries %v", entries)
+		}
+
+		// the XMP metadata matches the information dictionary
+		for _, item := range []string{
+			`<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Invoice 42</rdf:li></rdf:Alt></dc:title>`,
+			`<dc:creator><rdf:Seq><rdf:li>Alice</rdf:li></rdf:Seq></dc:creator>`,
+			`<dc:subject><rdf:Bag><rdf:li>html</rdf:li><rdf:li>invoice</rdf:li><rdf:li>2020</rdf:li></rdf:Bag></dc:subject>`,
+			`<xmp:CreateDate>2020-05-01T12:00:00Z</xmp:CreateDate>`,
+			`<pdf:Producer>Go-WebRender`,
+			`<inv:Number>INV-42</inv:Number>`,
+		} {
+			if !bytes.Contains(buf.Bytes(), []byte(item)) {
+				t.Fatalf("missing XMP %s", item)
+			}
+		}
+		if bytes.Contains(buf.Bytes(), []byte("http://example.com/ignored/")) {
+			t.Fatal("unexpected reserved namespace")
+		}
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	const html = `
+	<title>Report</title>
+	<style>
+		.serif { font-family: serif }
+		.mono { font-family: monospace; font-weight: bold }
+	</style>
+	<p>Plain text, with some <span class=serif>serif</span> and <span class=mono>monospace</span> words.</p>
+	<p style="page-break-before: always; opacity: 0.5">Second page <a href="#top">link</a></p>
+	<svg width=20 height=20><rect width=10 height=10 fill=red /></svg>`
+	timestamp := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, stream := range []bool{false, true} {
+		var first []byte
+		for i := 0; i < 4; i++ {
+			var buf bytes.Buffer
+			err := Convert(&buf, utils.InputString(html), fontconfig, Options{Reproducible: true, Timestamp: timestamp, Stream: stream})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = buf.Bytes()
+				continue
+			}
+			if !bytes.Equal(first, buf.Bytes()) {
+				t.Fatalf("stream=%v: output differs between conversions", stream)
+			}
+		}
+
+		if !bytes.Contains(first, []byte("/ID [<")) {
+			t.Fatal("missing document ID")
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(first), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info := doc.Trailer.Info; !info.CreationDate.Equal(timestamp) || !info.ModDate.Equal(timestamp) {
+			t.Fatalf("unexpected dates %s %s", info.CreationDate, info.ModDate)
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	var buf bytes.Buffer
+	if err := Convert(&buf, utils.InputString(html), fontconfig, Options{Reproducible: true}); err != nil {
+		t.Fatal(err)
+	}
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := doc.Trailer.Info.CreationDate; !d.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("unexpected CreationDate %s", d)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	const html = `
+	<title>Compressed</title>
+	<p>Some text, repeated. Some text, repeated. Some text, repeated.</p>
+	<p style="page-break-before: always; opacity: 0.5">Second page</p>`
+
+	for _, stream := range []bool{false, true} {
+		var sizes []int
+		for _, compression := range []pdf.Compression{pdf.Uncompressed, pdf.CompressStreams, pdf.OptimizeSize} {
+			var buf bytes.Buffer
+			err := Convert(&buf, utils.InputString(html), fontconfig, Options{Compression: compression, Stream: stream})
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(doc.Catalog.Pages.Flatten()) != 2 || doc.Trailer.Info.Title != "Compressed" {
+				t.Fatalf("unexpected document for compression %d", compression)
+			}
+
+			out := buf.Bytes()
+			isCompressed := bytes.Contains(out, []byte("/FlateDecode"))
+			hasObjStm := bytes.Contains(out, []byte("/ObjStm")) && bytes.Contains(out, []byte("/XRef"))
+			if isCompressed != (compression != pdf.Uncompressed) || hasObjStm != (compression == pdf.OptimizeSize) {
+				t.Fatalf("unexpected output for compression %d", compression)
+			}
+			sizes = append(sizes, len(out))
+		}
+		if !(sizes[0] > sizes[1] && sizes[1] > sizes[2]) {
+			t.Fatalf("unexpected sizes %v", sizes)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	const html = `
+	<title>Archived</title>
+	<p>Some text</p>
+	<p style="page-break-before: always; opacity: 0.5">Second page</p>`
+	attachments := []backend.Attachment{{Title: "data.txt", Content: []byte("some data")}}
+
+	for _, stream := range []bool{false, true} {
+		for _, conformance := range []pdf.Conformance{pdf.PDFA1B, pdf.PDFA2B, pdf.PDFA3B} {
+			var (
+				buf       bytes.Buffer
+				collector diagnostics.Collector
+			)
+			err := Convert(&buf, utils.InputString(html), fontconfig, Options{
+				Conformance: conformance, Stream: stream, Compression: pdf.Uncompressed,
+				Attachments: attachments, Diagnostics: &collector,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(doc.Catalog.Pages.Flatten()) != 2 || doc.Trailer.Info.Title != "Archived" {
+				t.Fatalf("unexpected document for %s", conformance)
+			}
+
+			out := buf.Bytes()
+			for _, entry := range []string{
+				"/Metadata", "/OutputIntents", "/GTS_PDFA1", "/ID [<",
+				fmt.Sprintf("<pdfaid:part>%d</pdfaid:part>", conformance),
+				"<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">Archived</rdf:li>",
+			} {
+				if !bytes.Contains(out, []byte(entry)) {
+					t.Fatalf("missing %s for %s", entry, conformance)
+				}
+			}
+
+			// attachments are only allowed in PDF/A-3
+			hasAttachment := len(doc.Catalog.Names.EmbeddedFiles) == 1
+			hasRelationship := bytes.Contains(out, []byte("/AFRelationship")) && bytes.Contains(out, []byte("/AF ["))
+			if hasAttachment != (conformance == pdf.PDFA3B) || hasRelationship != (conformance == pdf.PDFA3B) {
+				t.Fatalf("unexpected attachments for %s", conformance)
+			}
+
+			// transparency is dropped in PDF/A-1
+			hasTransparency := bytes.Contains(out, []byte("/ca 0.5"))
+			if hasTransparency != (conformance != pdf.PDFA1B) {
+				t.Fatalf("unexpected transparency for %s", conformance)
+			}
+
+			var issues []string
+			for _, d := range collector.Diagnostics() {
+				if d.Code == diagnostics.NonConformant {
+					issues = append(issues, d.Message)
+				}
+			}
+			if conformance == pdf.PDFA3B && len(issues) != 0 || conformance != pdf.PDFA3B && len(issues) == 0 {
+				t.Fatalf("unexpected diagnostics for %s: %v", conformance, issues)
+			}
+		}
+	}
+}
+
+func TestParseConformance(t *testing.T) {
+	for s, exp := range map[string]pdf.Conformance{"": pdf.NoConformance, "PDF/A-1b": pdf.PDFA1B, "pdf/a-3b": pdf.PDFA3B} {
+		if got, err := pdf.ParseConformance(s); err != nil || got != exp {
+			t.Fatalf("unexpected conformance for %q: %s %v", s, got, err)
+		}
+	}
+	if _, err := pdf.ParseConformance("pdf/a-4"); err == nil {
+		t.Fatal("expected error for unsupported level")
+	}
+}
+
+func TestTagged(t *testing.T) {
+	const html = `<html lang="en">
+	<head><title>Accessible</title>
+	<style>@page { @top-center { content: "Running header" } }</style></head>
+	<body>
+	<h1>Main title</h1>
+	<p>A paragraph with a <a href="https://example.com">link to a site</a>
+	and an <a href="#second">internal link</a>.</p>
+	<ul><li>First item</li><li>Second item</li></ul>
+	<table>
+		<thead><tr><th>Name</th><th>Value</th></tr></thead>
+		<tbody><tr><th>Row</th><td>1</td></tr></tbody>
+	</table>
+	<img src="resources_test/pattern.png" alt="A pattern">
+	<img src="resources_test/blue.jpg" alt="">
+	<h2 id="second" style="break-before: page">Second page</h2>
+	<p lang="fr">Du texte</p>
+	</body></html>`
+
+	for _, opts := range []Options{
+		{Tagged: true, Compression: pdf.Uncompressed},
+		{Tagged: true, Compression: pdf.Uncompressed, Stream: true},
+		{Tagged: true, Conformance: pdf.PDFA2B},
+	} {
+		var buf bytes.Buffer
+		opts.BaseUrl = "."
+		if err := Convert(&buf, utils.InputString(html), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		types := checkTagged(t, buf.Bytes())
+		for _, typ := range []model.Name{"Document", "H1", "H2", "P", "Link", "L", "LI", "LBody", "Table", "TH", "TD", "Figure"} {
+			if types[typ] == 0 {
+				t.Fatalf("missing %s element (stream: %v)", typ, opts.Stream)
+			}
+		}
+		if types["Figure"] != 1 || types["Link"] != 2 {
+			t.Fatalf("unexpected elements %v", types)
+		}
+		if opts.Compression == pdf.Uncompressed && !bytes.Contains(buf.Bytes(), []byte("/Artifact BMC")) {
+			t.Fatal("missing artifacts")
+		}
+	}
+
+	// each merged document is a part of the structure
+	var buf bytes.Buffer
+	parts := []Part{{Content: utils.InputString(html), BaseUrl: "."}, {Content: utils.InputString(html), BaseUrl: "."}}
+	if err := ConvertParts(&buf, parts, fontconfig, Options{Tagged: true}); err != nil {
+		t.Fatal(err)
+	}
+	if types := checkTagged(t, buf.Bytes()); types["Part"] != 2 || types["Figure"] != 2 || types["Link"] != 4 {
+		t.Fatalf("unexpected elements %v", types)
+	}
+}
+
+func TestTaggedRepeatedText(t *testing.T) {
+	// the running header, drawn after the content of the page (as the footnotes),
+	// repeats the paragraph of the second page, and the table cells repeat each other
+	const html = `<html lang="en">
+	<head><title>Repeated</title>
+	<style>@page { @top-center { content: "Chapter" } @bottom-center { content: counter(page) } }</style></head>
+	<body>
+	<p>Chapter</p>
+	<table><tr><td>Yes</td><td>Yes</td></tr><tr><td>Yes</td><td>2</td></tr></table>
+	<p>Note<span style="float: footnote">Chapter</span></p>
+	<p style="break-before: page">Chapter</p>
+	<p>Chapter</p>
+	</body></html>`
+
+	for _, opts := range []Options{
+		{Tagged: true, Compression: pdf.Uncompressed},
+		{Tagged: true, Compression: pdf.Uncompressed, Stream: true},
+	} {
+		var buf bytes.Buffer
+		if err := Convert(&buf, utils.InputString(html), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		if types := checkTagged(t, buf.Bytes()); types["P"] != 4 || types["TD"] != 4 {
+			t.Fatalf("unexpected elements %v", types)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := doc.Catalog.Pages.Flatten()
+		// the pages of the marked-content of each element, in document order
+		var got [][]int
+		var walk func(e *model.StructureElement)
+		walk = func(e *model.StructureElement) {
+			var onPages []int
+			for _, kid := range e.K {
+				switch kid := kid.(type) {
+				case *model.StructureElement:
+					walk(kid)
+				case model.ContentItemMarkedReference:
+					onPages = append(onPages, slices.Index(pages, kid.Container.(*model.PageObject))+1)
+				}
+			}
+			if e.S == "P" || e.S == "TD" {
+				got = append(got, onPages)
+			}
+		}
+		for _, e := range doc.Catalog.StructTreeRoot.K {
+			walk(e)
+		}
+		if exp := [][]int{{1}, {1}, {1}, {1}, {1}, {1, 1}, {2}, {2}}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected marked-content pages %v (stream: %v)", got, opts.Stream)
+		}
+	}
+}
+
+// checkTagged performs the structural checks of PDF/UA on `file` : the content is tagged
+// or marked as artifact, the parent tree matches the marked-content, and
+// the figures, header cells and annotations are described.
+// It returns the number of elements of each type.
+func checkTagged(t *testing.T, file []byte) map[model.Name]int {
+	t.Helper()
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(file), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := doc.Catalog
+	if catalog.MarkInfo == nil || !catalog.MarkInfo.Marked || catalog.Lang != "en" || catalog.StructTreeRoot == nil {
+		t.Fatal("missing tagged PDF entries")
+	}
+	if doc.Trailer.Info.Title == "" || !bytes.Contains(file, []byte("/DisplayDocTitle true")) {
+		t.Fatal("missing title")
+	}
+	if !bytes.Contains(file, []byte("<pdfuaid:part>1</pdfuaid:part>")) {
+		t.Fatal("missing PDF/UA identification")
+	}
+
+	types := make(map[model.Name]int)
+	type mcr struct {
+		page *model.PageObject
+		mcid int
+	}
+	owners := make(map[mcr]*model.StructureElement)
+	annotOwners := make(map[*model.AnnotationDict]*model.StructureElement)
+	var walk func(e *model.StructureElement)
+	walk = func(e *model.StructureElement) {
+		types[e.S]++
+		if e.S == "Figure" && e.Alt == "" {
+			t.Fatal("missing alternate text")
+		}
+		if e.S == "TH" && (len(e.A) == 0 || e.A[0].Attributes["Scope"] == nil) {
+			t.Fatal("missing header scope")
+		}
+		for _, kid := range e.K {
+			switch kid := kid.(type) {
+			case *model.StructureElement:
+				if kid.P != e {
+					t.Fatal("invalid parent element")
+				}
+				walk(kid)
+			case model.ContentItemMarkedReference:
+				page, _ := kid.Container.(*model.PageObject)
+				owners[mcr{page, kid.MCID}] = e
+			case model.ContentItemObjectReference:
+				annotOwners[kid.Obj.(*model.AnnotationDict)] = e
+			}
+		}
+	}
+	for _, e := range catalog.StructTreeRoot.K {
+		walk(e)
+	}
+
+	parents := make(map[int]model.NumToParent)
+	for _, num := range catalog.StructTreeRoot.ParentTree.Nums {
+		parents[num.Num] = num
+	}
+	painting := func(op cs.Operation) bool {
+		switch op.(type) {
+		case cs.OpShowSpaceGlyph, cs.OpShowText, cs.OpFill, cs.OpEOFill, cs.OpStroke, cs.OpFillStroke,
+			cs.OpEOFillStroke, cs.OpXObject, cs.OpShFill:
+			return true
+		}
+		return false
+	}
+	for i, page := range doc.Catalog.Pages.Flatten() {
+		var content []byte
+		for _, c := range page.Contents {
+			decoded, err := c.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, decoded...)
+		}
+		ops, err := parser.ParseContent(content, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depth, mcids := 0, 0
+		for _, op := range ops {
+			switch op := op.(type) {
+			case cs.OpBeginMarkedContent:
+				depth++
+				props, _ := op.Properties.(cs.PropertyListDict)
+				mcid, ok := props["MCID"].(model.ObjInt)
+				if !ok {
+					continue
+				}
+				key, _ := page.StructParents.(model.ObjInt)
+				parent := parents[int(key)]
+				if int(mcid) >= len(parent.Parents) || parent.Parents[mcid] == nil ||
+					parent.Parents[mcid] != owners[mcr{page, int(mcid)}] || model.Name(op.Tag) != parent.Parents[mcid].S {
+					t.Fatalf("invalid parent tree for MCID %d on page %d", mcid, i+1)
+				}
+				mcids++
+			case cs.OpEndMarkedContent:
+				depth--
+			default:
+				if painting(op) && depth == 0 {
+					t.Fatalf("untagged content %T on page %d", op, i+1)
+				}
+			}
+		}
+		if depth != 0 || mcids == 0 {
+			t.Fatalf("invalid marked content on page %d", i+1)
+		}
+
+		for _, annot := range page.Annots {
+			key, _ := annot.StructParent.(model.ObjInt)
+			if owner := annotOwners[annot]; owner == nil || parents[int(key)].Parent != owner || annot.Contents == "" {
+				t.Fatalf("untagged annotation on page %d", i+1)
+			}
+		}
+	}
+	return types
+}
+
+func TestEncryption(t *testing.T) {
+	const html = `
+	<title>Payslip</title>
+	<p>Confidential salary</p>
+	<p style="page-break-before: always">Second page <a href="https://example.com">link</a></p>`
+	enc := &pdf.Encryption{
+		UserPassword: "employee", OwnerPassword: "employer",
+		Permissions: pdf.PermitPrint | pdf.PermitCopy, Algorithm: pdf.AES128,
+	}
+
+	for _, compression := range []pdf.Compression{pdf.Uncompressed, pdf.CompressStreams} {
+		var buf bytes.Buffer
+		err := Convert(&buf, utils.InputString(html), fontconfig, Options{Encryption: enc, Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := buf.Bytes()
+		if bytes.Contains(out, []byte("Payslip")) || !bytes.Contains(out, []byte("/AESV2")) {
+			t.Fatalf("unexpected output for compression %d", compression)
+		}
+		for _, password := range []string{enc.UserPassword, enc.OwnerPassword} {
+			doc, encrypt, err := reader.ParsePDFReader(bytes.NewReader(out), reader.Options{UserPassword: password})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(doc.Catalog.Pages.Flatten()) != 2 || doc.Trailer.Info.Title != "Payslip" {
+				t.Fatalf("unexpected document for compression %d", compression)
+			}
+			if encrypt == nil || encrypt.P&model.PermissionPrint == 0 || encrypt.P&model.PermissionCopy == 0 ||
+				encrypt.P&model.PermissionModify != 0 {
+				t.Fatalf("unexpected permissions %v", encrypt)
+			}
+		}
+		if _, _, err := reader.ParsePDFReader(bytes.NewReader(out), reader.Options{UserPassword: "wrong"}); err == nil {
+			t.Fatal("expected error for invalid password")
+		}
+	}
+
+	// AES-256 uses the revision 6, which is not supported by the reader
+	var buf bytes.Buffer
+	err := Convert(&buf, utils.InputString(html), fontconfig, Options{Encryption: &pdf.Encryption{UserPassword: "employee"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"/AESV3", "/V 5", "/R 6", "/Perms", "/Encrypt"} {
+		if !bytes.Contains(buf.Bytes(), []byte(entry)) {
+			t.Fatalf("missing %s", entry)
+		}
+	}
+
+	// reproducible output
+	var outputs [2][]byte
+	for i := range outputs {
+		var buf bytes.Buffer
+		err := Convert(&buf, utils.InputString(html), fontconfig, Options{Encryption: enc, Reproducible: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("output differs between conversions")
+	}
+
+	if err := Convert(io.Discard, utils.InputString(html), fontconfig, Options{Encryption: enc, Conformance: pdf.PDFA2B}); err == nil {
+		t.Fatal("expected error for encrypted PDF/A")
+	}
+	if err := Convert(io.Discard, utils.InputString(html), fontconfig, Options{Encryption: enc, Compression: pdf.OptimizeSize}); err == nil {
+		t.Fatal("expected error for encrypted object streams")
+	}
+	rd, err := Render(utils.InputString(html), fontconfig, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Write(io.Discard, Options{Encryption: enc, Compression: pdf.OptimizeSize}); err == nil {
+		t.Fatal("expected error for encrypted object streams")
+	}
+	if err := Convert(io.Discard, utils.InputString(html), fontconfig, Options{Encryption: enc, Stream: true}); err == nil {
+		t.Fatal("expected error in streaming mode")
+	}
+}
+
+// newTestCertificate returns a self-signed certificate, and its key.
+func newTestCertificate(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// checkSignature verifies the signature of the PDF `file`, signed by `cert`.
+func checkSignature(t *testing.T, file []byte, cert *x509.Certificate) {
+	t.Helper()
+	var byteRange [4]int
+	i := bytes.LastIndex(file, []byte("/ByteRange ["))
+	if i == -1 {
+		t.Fatal("missing ByteRange")
+	}
+	if _, err := fmt.Sscanf(string(file[i:]), "/ByteRange [%d %d %d %d]", &byteRange[0], &byteRange[1], &byteRange[2], &byteRange[3]); err != nil {
+		t.Fatal(err)
+	}
+	if byteRange[0] != 0 || byteRange[2]+byteRange[3] != len(file) ||
+		file[byteRange[1]] != '<' || file[byteRange[2]-1] != '>' {
+		t.Fatalf("invalid ByteRange %v", byteRange)
+	}
+	contents, err := hex.DecodeString(string(file[byteRange[1]+1 : byteRange[2]-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(file[:byteRange[1]])
+	h.Write(file[byteRange[2]:])
+	digest := h.Sum(nil)
+
+	var (
+		info struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		signed struct {
+			Version          int
+			DigestAlgorithms asn1.RawValue
+			EncapContentInfo asn1.RawValue
+			Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+			SignerInfos      []struct {
+				Version            int
+				SID                asn1.RawValue
+				DigestAlgorithm    asn1.RawValue
+				SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+				SignatureAlgorithm asn1.RawValue
+				Signature          []byte
+			} `asn1:"set"`
+		}
+		attrs []struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		}
+	)
+	if _, err := asn1.Unmarshal(contents, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if len(signed.SignerInfos) != 1 || !bytes.Contains(signed.Certificates.Bytes, cert.Raw) {
+		t.Fatal("unexpected signed data")
+	}
+	signer := signed.SignerInfos[0]
+	// the signature is computed on the attributes, tagged as a SET
+	signedAttrs := append([]byte{0x31}, signer.SignedAttrs.FullBytes[1:]...)
+	if err := cert.CheckSignature(x509.SHA256WithRSA, signedAttrs, signer.Signature); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.UnmarshalWithParams(signedAttrs, &attrs, "set"); err != nil {
+		t.Fatal(err)
+	}
+	var messageDigest []byte
+	for _, attr := range attrs {
+		if attr.Type.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}) {
+			asn1.Unmarshal(attr.Values[0].FullBytes, &messageDigest)
+		}
+	}
+	if !bytes.Equal(messageDigest, digest) {
+		t.Fatal("the signature does not match the content")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	const html = `
+	<title>Contract</title>
+	<p>The parties agree.</p>
+	<div style="link: url(weasyprint:signature); width: 6cm; height: 2cm; margin-left: 2cm"></div>`
+	key, cert := newTestCertificate(t, "Jane Doe")
+	signature := &pdf.Signature{Signer: key, Certificates: []*x509.Certificate{cert}, Reason: "Agreement", Location: "Paris"}
+
+	for _, opts := range []Options{
+		{Signature: signature},
+		{Signature: signature, Compression: pdf.OptimizeSize},
+		{Signature: signature, Conformance: pdf.PDFA2B},
+		{Signature: signature, Tagged: true},
+	} {
+		var buf bytes.Buffer
+		if err := Convert(&buf, utils.InputString(html), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		checkSignature(t, buf.Bytes(), cert)
+
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := doc.Catalog.AcroForm.Fields
+		if len(fields) != 1 || len(fields[0].Widgets) != 1 || doc.Catalog.AcroForm.SigFlags != 3 {
+			t.Fatalf("unexpected form %v", doc.Catalog.AcroForm)
+		}
+		widget := fields[0].Widgets[0]
+		if !bytes.Contains(buf.Bytes(), []byte("/Name (Jane Doe) /Reason (Agreement)")) {
+			t.Fatal("missing signature entries")
+		}
+		// the box is 6cm x 2cm
+		if w, h := widget.Rect.Width(), widget.Rect.Height(); math.Abs(float64(w)-6/2.54*72) > 1 || math.Abs(float64(h)-2/2.54*72) > 1 {
+			t.Fatalf("unexpected signature box %v", widget.Rect)
+		}
+		hasText := bytes.Contains(buf.Bytes(), []byte("/Helvetica"))
+		if hasText != (opts.Conformance == pdf.NoConformance) {
+			t.Fatal("unexpected appearance")
+		}
+	}
+
+	// without visible box, and reproducible
+	const plain = `<title>Contract</title><p>The parties agree.</p>`
+	var outputs [2][]byte
+	for i := range outputs {
+		var buf bytes.Buffer
+		opts := Options{Signature: signature, Reproducible: true, Timestamp: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)}
+		if err := Convert(&buf, utils.InputString(plain), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("output differs between conversions")
+	}
+	checkSignature(t, outputs[0], cert)
+	if !bytes.Contains(outputs[0], []byte("/Rect [0 0 0 0]")) || !bytes.Contains(outputs[0], []byte("(D:20210304050607+00'00')")) {
+		t.Fatal("expected an invisible signature, dated from the timestamp")
+	}
+
+	// the field is ignored without signature
+	var buf bytes.Buffer
+	if err := Convert(&buf, utils.InputString(html), fontconfig, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if regexp.MustCompile(`/FT\s*/Sig`).Match(buf.Bytes()) || bytes.Contains(buf.Bytes(), []byte("weasyprint:signature")) {
+		t.Fatal("unexpected signature field")
+	}
+
+	if err := Convert(io.Discard, utils.InputString(html), fontconfig, Options{Signature: signature, Stream: true}); err == nil {
+		t.Fatal("expected error in streaming mode")
+	}
+}
+
+func TestForms(t *testing.T) {
+	const html = `<html lang="en"><title>Form</title>
+	<p>Please fill the form.</p>
+	<form>
+	<input name="city" value="Paris">
+	<textarea name="comment">A long comment, spanning several lines once wrapped in its box.</textarea>
+	<input type="checkbox" name="agree" checked>
+	<input type="radio" name="size" value="small">
+	<input type="radio" name="size" value="large" checked>
+	<select name="color"><option value="r">Red</option><option value="g" selected>Green</option></select>
+	<input type="submit" value="Send">
+	</form></html>`
+
+	for _, opts := range []Options{
+		{Forms: true, Compression: pdf.Uncompressed},
+		{Forms: true, Conformance: pdf.PDFA2B},
+		{Forms: true, Tagged: true},
+	} {
+		var buf bytes.Buffer
+		if err := Convert(&buf, utils.InputString(html), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf.Bytes(), []byte(pdf.FormFieldURLPrefix)) {
+			t.Fatal("unexpected link to a form field")
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := doc.Catalog.AcroForm.Flatten()
+		if len(doc.Catalog.AcroForm.Fields) != 5 {
+			t.Fatalf("unexpected fields %v", fields)
+		}
+		if v := fields["city"].Merged.FT.(model.FormFieldText).V; v != "Paris" {
+			t.Fatalf("unexpected value %s", v)
+		}
+		if ff := fields["comment"].Merged.Ff; ff&model.Multiline == 0 {
+			t.Fatalf("unexpected flags %d", ff)
+		}
+		if v := fields["agree"].Merged.FT.(model.FormFieldButton).V; v != "on" {
+			t.Fatalf("unexpected value %s", v)
+		}
+		// the kids without name are read as widgets
+		size := fields["size"]
+		if v := size.Merged.FT.(model.FormFieldButton).V; v != "large" || len(size.Field.Widgets) != 2 || size.Merged.Ff&model.Radio == 0 {
+			t.Fatalf("unexpected radio group %v", size)
+		}
+		if choice := fields["color"].Merged.FT.(model.FormFieldChoice); len(choice.V) != 1 || choice.V[0] != "g" || len(choice.Opt) != 2 {
+			t.Fatalf("unexpected choice %v", choice)
+		}
+		// the values are drawn with an embedded font
+		ap := fields["city"].Field.Widgets[0].AP.N[""]
+		if font := ap.Resources.Font["FT0"]; font == nil {
+			t.Fatal("missing appearance font")
+		} else if _, ok := font.Subtype.(model.FontType0); !ok {
+			t.Fatalf("unexpected appearance font %T", font.Subtype)
+		}
+		// and the viewers use a standard font for the typed values
+		font := doc.Catalog.AcroForm.DR.Font["Helv"]
+		if font == nil {
+			t.Fatal("missing form font")
+		}
+		if t1, ok := font.Subtype.(model.FontType1); !ok || t1.BaseFont != "Helvetica" || t1.Encoding != model.WinAnsiEncoding {
+			t.Fatalf("unexpected form font %v", font.Subtype)
+		}
+		if da := doc.Catalog.AcroForm.DA; da != "/Helv 0 Tf 0 g" {
+			t.Fatalf("unexpected default appearance %s", da)
+		}
+		if opts.Tagged {
+			checkTagged(t, buf.Bytes())
+		}
+	}
+
+	// without the option, the form elements are drawn
+	var buf bytes.Buffer
+	if err := Convert(&buf, utils.InputString(html), fontconfig, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("/AcroForm")) {
+		t.Fatal("unexpected form")
+	}
+
+	// the field links are ignored without the option
+	buf.Reset()
+	injected := `<p style="link: url(weasyprint:field:0)">Field</p>`
+	if err := Convert(&buf, utils.InputString(injected), fontconfig, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("/AcroForm")) || bytes.Contains(buf.Bytes(), []byte(pdf.FormFieldURLPrefix)) {
+		t.Fatal("unexpected form")
+	}
+
+	if err := Convert(io.Discard, utils.InputString(html), fontconfig, Options{Forms: true, Stream: true}); err == nil {
+		t.Fatal("expected error in streaming mode")
+	}
+}
+
+func TestPageLabels(t *testing.T) {
+	const html = `<style>p { page-break-after: always }</style>
+	<p>Cover</p><p>Preface</p><p>Contents</p><p>Chapter 1</p><p>Chapter 2</p><p>Appendix</p>`
+	labels := []pdf.PageLabel{
+		{Page: 0, Style: pdf.LabelNone, Prefix: "Cover"},
+		{Page: 1, Style: pdf.LabelLowerRoman},
+		{Page: 3, Style: pdf.LabelDecimal},
+		{Page: 5, Style: pdf.LabelDecimal, Prefix: "A-"},
+	}
+
+	for _, opts := range []Options{
+		{PageLabels: labels},
+		{PageLabels: labels, Stream: true},
+		{PageLabels: labels, Pages: "1,3-last"},
+	} {
+		var buf bytes.Buffer
+		if err := Convert(&buf, utils.InputString(html), fontconfig, opts); err != nil {
+			t.Fatal(err)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Catalog.PageLabels == nil {
+			t.Fatal("missing page labels")
+		}
+		got := doc.Catalog.PageLabels.LookupTable()
+		expected := map[int]model.PageLabel{
+			0: {P: "Cover", St: 1}, 1: {S: "r", St: 1}, 3: {S: "D", St: 1}, 5: {S: "D", P: "A-", St: 1},
+		}
+		if opts.Pages != "" {
+			expected = map[int]model.PageLabel{
+				0: {P: "Cover", St: 1}, 1: {S: "r", St: 2}, 2: {S: "D", St: 1}, 4: {S: "D", P: "A-", St: 1},
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("unexpected page labels %v", got)
+		}
+		if regexp.MustCompile(`/S\s*/[\s>]`).Match(buf.Bytes()) {
+			t.Fatal("unexpected empty numbering style")
+		}
+	}
+}
+
+func TestViewerPreferences(t *testing.T) {
+	const html = `<html dir="rtl"><title>Book</title><p>First page</p><p style="page-break-before: always">Second page</p></html>`
+	prefs := pdf.ViewerPreferences{
+		PageLayout: pdf.TwoPageRight, PageMode: pdf.ShowBookmarks, OpenView: pdf.FitWidth,
+		DisplayDocTitle: true, NoPrintScaling: true, Duplex: pdf.DuplexFlipLongEdge,
+	}
+
+	for _, stream := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := Convert(&buf, utils.InputString(html), fontconfig, Options{ViewerPreferences: prefs, Stream: stream}); err != nil {
+			t.Fatal(err)
+		}
+		doc, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cat := doc.Catalog
+		if cat.PageLayout != "TwoPageRight" || cat.PageMode != "UseOutlines" {
+			t.Fatalf("unexpected layout %s and mode %s", cat.PageLayout, cat.PageMode)
+		}
+		// the direction is given by <html dir>
+		if cat.ViewerPreferences == nil || !cat.ViewerPreferences.DirectionRTL {
+			t.Fatalf("unexpected viewer preferences %v", cat.ViewerPreferences)
+		}
+		goTo, ok := cat.OpenAction.ActionType.(model.ActionGoTo)
+		if !ok {
+			t.Fatalf("unexpected open action %v", cat.OpenAction)
+		}
+		dest, ok := goTo.D.(model.DestinationExplicitIntern)
+		if !ok || dest.Page != cat.Pages.Flatten()[0] {
+			t.Fatalf("unexpected open destination %v", goTo.D)
+		}
+		if location, ok := dest.Location.(model.DestinationLocationFitDim); !ok || location.Name != "FitH" {
+			t.Fatalf("unexpected open location %v", dest.Location)
+		}
+		for _, entry := range []string{"/DisplayDocTitle true", "/PrintScaling /None", "/Duplex /DuplexFlipLongEdge"} {
+			if !bytes.Contains(buf.Bytes(), []byte(entry)) {
+				t.Fatalf("missing %s", entry)
+			}
+		}
+	}
+
+	// the direction may be overridden, and nothing is added by default
+	var buf bytes.Buffer
+	if err := Convert(&buf, utils.InputString(html), fontconfig, Options{ViewerPreferences: pdf.ViewerPreferences{Direction: pdf.LeftToRight}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"/ViewerPreferences", "/OpenAction", "/PageLayout", "/PageMode"} {
+		if bytes.Contains(buf.Bytes(), []byte(entry)) {
+			t.Fatalf("unexpected %s", entry)
+		}
+	}
+}
+
+func TestLockFontConfig(t *testing.T) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		running int
+	)
+	for range [4]int{} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer lockFontConfig(fontconfig)()
+			mu.Lock()
+			running++
+			if running != 1 {
+				t.Error("font configuration used concurrently")
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// the locks are released once unused
+	if err := Convert(io.Discard, utils.InputString("<p>Hello</p>"), fontconfig, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if L := len(fontLocks.m); L != 0 {
+		t.Fatalf("unexpected font locks %d", L)
+	}
+}
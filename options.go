@@ -0,0 +1,285 @@
+package goweasyprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	"github.com/benoitkugler/webrender/backend"
+	"github.com/benoitkugler/webrender/html/tree"
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// Options groups the optional settings used when converting an HTML document.
+// The zero value is valid and selects the defaults described for each field.
+//
+// Note that the conversions sharing a font configuration run one at a time,
+// whatever their options (see `Convert`).
+type Options struct {
+	// BaseUrl is used as reference for links (stylesheets, images, etc...). If empty, it is
+	// deduced from the html content.
+	BaseUrl string
+
+	// UrlFetcher is a function called when resolving resources. If nil, it defaults to `utils.DefaultUrlFetcher`.
+	UrlFetcher utils.UrlFetcher
+
+	// FetchCache, if not nil, is used instead of UrlFetcher, with its HTTP requests
+	// bound to the conversion, so that they are cancelled with it (see `ConvertContext`).
+	// Note that using `CachingFetcher.Fetch` as UrlFetcher does not cancel the requests.
+	FetchCache *CachingFetcher
+
+	// FetchPolicy, if not nil, restricts the resources fetched, wrapping UrlFetcher
+	// (see `FetchPolicy.Fetcher`). It should be used when converting untrusted documents.
+	FetchPolicy *FetchPolicy
+
+	// MediaType is the CSS media type used to query CSS rules. It defaults to "print".
+	MediaType string
+
+	// Stylesheets is an optional list of user stylesheets, applied after the document ones.
+	Stylesheets []tree.CSS
+
+	// PresentationalHints controls whether or not the additional presentation stylesheet is used.
+	PresentationalHints bool
+
+	// Zoom is a zoom factor. The zero value is interpreted as 1.
+	Zoom float64
+
+	// Attachments is an additional list of attachments to include into the PDF file.
+	Attachments []backend.Attachment
+
+	// Pages, if not empty, selects the pages written, like "1-3,7,last".
+	// See `pdf.ParsePageSelection` for the syntax.
+	Pages string
+
+	// PageLabels, if not empty, gives the labels displayed by the PDF viewers instead
+	// of the page indices, like "i", "ii" for the front matter and "1", "2" from the first chapter,
+	// so that they match the printed page numbers.
+	PageLabels []pdf.PageLabel
+
+	// ViewerPreferences controls how the PDF viewers open the document (page layout, panel shown,
+	// zoom of the first page, title bar) and print it. The page direction defaults
+	// to the one given by <html dir>.
+	ViewerPreferences pdf.ViewerPreferences
+
+	// Stream writes each page to the target as soon as it is drawn, so that
+	// the memory used by the output does not grow with the number of pages (see `pdf.StreamOutput`).
+	// This mode does not support Pages nor ConvertParts, and the target may hold a partial
+	// file if an error is returned (including in strict mode).
+	Stream bool
+
+	// Metadata, if not nil, overrides the metadata found in the HTML document,
+	// and may add custom entries to the document information dictionary.
+	Metadata *pdf.Metadata
+
+	// Reproducible makes the output byte-for-byte identical for identical inputs,
+	// so that it may be archived in content-addressed storage or compared.
+	// The creation and modification dates are then set to Timestamp or, if it is zero,
+	// to the SOURCE_DATE_EPOCH environment variable, if defined. The dates
+	// given in Metadata take precedence.
+	Reproducible bool
+	Timestamp    time.Time
+
+	// Compression controls the compression of the streams, which are compressed by default.
+	// See `pdf.Compression` for the available modes.
+	Compression pdf.Compression
+
+	// Conformance, if set, makes the output conform to the given PDF/A level, for long-term archiving.
+	// The features forbidden by the level are dropped or degraded (and reported as diagnostics), and
+	// a *ConformanceError is returned if the output still can't conform, like for text using bitmap fonts.
+	Conformance pdf.Conformance
+
+	// Encryption, if not nil, protects the PDF file with a user and an owner password,
+	// restricting the permissions of the user (see `pdf.Encryption`).
+	// It is not allowed with Conformance, with the OptimizeSize compression nor in Stream mode.
+	Encryption *pdf.Encryption
+
+	// Signature, if not nil, digitally signs the PDF file (see `pdf.Signature`).
+	// The signature is visible if an element is styled with `link: url(weasyprint:signature)`,
+	// which gives the box of the signature field.
+	// It is not supported in Stream mode.
+	Signature *pdf.Signature
+
+	// SharedCache, if not nil, stores the parsed images and the font files,
+	// so that they are reused by the other conversions using the same cache.
+	SharedCache *pdf.SharedCache
+
+	// Diagnostics, if not nil, collects the issues found during the conversion,
+	// like resources which can't be fetched or fonts which can't be embedded.
+	// Note that the warnings emitted by the layout engine are still logged by webrender.
+	Diagnostics *diagnostics.Collector
+
+	// Progress, if not nil, is called with the advancement of the conversion
+	// (parsing, layout, drawing of each page, font subsetting, image encoding and serialization).
+	Progress progress.Func
+
+	// Forms converts the HTML form elements (text inputs, text areas, check boxes, radio buttons
+	// and drop-down lists) to interactive form fields, named after their name attribute and
+	// filled with their value. The fields use the fonts embedded for the text of the document.
+	// It is not supported in Stream mode.
+	Forms bool
+
+	// Tagged writes an accessible PDF file, tagged with the logical structure of the HTML document
+	// (headings, paragraphs, lists, tables, links and images with an alternate text), as required by PDF/UA.
+	// The document language is given by <html lang>, and a title should be provided.
+	// See `pdf.Output.SetStructure` for the limitations.
+	Tagged bool
+
+	// Strict makes the conversion fail with a *diagnostics.StrictError if
+	// diagnostics with at least the Warning severity are emitted.
+	// In this case, nothing is written to the target.
+	Strict bool
+}
+
+func (opts Options) zoom() utils.Fl {
+	if opts.Zoom == 0 {
+		return 1
+	}
+	return utils.Fl(opts.Zoom)
+}
+
+// validate returns an error for the incompatible output settings,
+// before the document is laid out.
+func (opts Options) validate() error {
+	if opts.Encryption == nil {
+		return nil
+	}
+	if opts.Conformance != pdf.NoConformance {
+		return fmt.Errorf("encryption is not allowed in %s", opts.Conformance)
+	}
+	if opts.Compression == pdf.OptimizeSize {
+		return errors.New("encryption is not supported with object streams")
+	}
+	return nil
+}
+
+// prepare returns the options used for one conversion,
+// bound to `ctx` and reporting the failed fetches.
+func (opts Options) prepare(ctx context.Context) Options {
+	opts = opts.withCollector()
+	if opts.FetchCache != nil {
+		opts.UrlFetcher = opts.FetchCache.fetcher(ctx)
+	}
+	fetcher := contextFetcher(ctx, opts.UrlFetcher)
+	if opts.FetchPolicy != nil {
+		fetcher = opts.FetchPolicy.fetcher(ctx, opts.UrlFetcher)
+	}
+	opts.UrlFetcher = diagnosticFetcher(ctx, opts.Diagnostics, fetcher)
+	return opts
+}
+
+// withCollector makes sure a collector is available in strict mode,
+// and when checking the conformance
+func (opts Options) withCollector() Options {
+	if (opts.Strict || opts.Conformance != pdf.NoConformance) && opts.Diagnostics == nil {
+		opts.Diagnostics = new(diagnostics.Collector)
+	}
+	return opts
+}
+
+// newOutput returns the PDF backend used for one conversion.
+// `pageCount` is the number of pages to draw, or 0 if unknown.
+func (opts Options) newOutput(ctx context.Context, pageCount int) (*pdf.Output, error) {
+	output := pdf.NewOutputContext(ctx)
+	if opts.Diagnostics != nil {
+		output.SetDiagnostics(opts.Diagnostics)
+	}
+	if opts.Progress != nil {
+		output.SetProgress(opts.Progress, pageCount)
+	}
+	output.SetSharedCache(opts.SharedCache)
+	output.SetSignatureField(opts.Signature != nil)
+	output.SetCompression(opts.Compression)
+	output.SetConformance(opts.Conformance)
+	if md := opts.metadata(); md != nil {
+		output.SetMetadata(*md)
+	}
+	output.SetPageLabels(opts.PageLabels)
+	output.SetViewerPreferences(opts.ViewerPreferences)
+	if opts.Pages != "" {
+		selection, err := pdf.ParsePageSelection(opts.Pages)
+		if err != nil {
+			return nil, err
+		}
+		output.SetPageSelection(selection)
+	}
+	return output, nil
+}
+
+// writeOptions returns the settings used to serialize the PDF file.
+func (opts Options) writeOptions() pdf.WriteOptions {
+	out := pdf.WriteOptions{
+		Reproducible: opts.Reproducible, Compression: opts.Compression,
+		Conformance: opts.Conformance, Encryption: opts.Encryption,
+		Signature: opts.Signature,
+	}
+	if opts.Signature != nil && opts.Signature.Time.IsZero() && opts.Reproducible {
+		signature := *opts.Signature
+		signature.Time = opts.metadata().ModificationDate
+		out.Signature = &signature
+	}
+	if opts.Metadata != nil {
+		out.CustomInfo = opts.Metadata.Custom
+	}
+	return out
+}
+
+// metadata returns the metadata overrides, including the
+// dates used in reproducible mode, or nil.
+func (opts Options) metadata() *pdf.Metadata {
+	if !opts.Reproducible {
+		return opts.Metadata
+	}
+	timestamp := opts.Timestamp
+	if timestamp.IsZero() {
+		timestamp, _ = pdf.SourceDateEpoch()
+	}
+	var md pdf.Metadata
+	if opts.Metadata != nil {
+		md = *opts.Metadata
+	}
+	if md.CreationDate.IsZero() {
+		md.CreationDate = timestamp
+	}
+	if md.ModificationDate.IsZero() {
+		md.ModificationDate = timestamp
+	}
+	return &md
+}
+
+// strictErr returns an error if strict mode is enabled and warnings were emitted,
+// or if the output can't conform to the requested PDF/A level.
+func (opts Options) strictErr() error {
+	if opts.Strict {
+		return opts.Diagnostics.Err()
+	}
+	if opts.Conformance == pdf.NoConformance {
+		return nil
+	}
+	var out ConformanceError
+	for _, d := range opts.Diagnostics.Diagnostics() {
+		if d.Severity == diagnostics.Error && d.Code == diagnostics.NonConformant {
+			out.Diagnostics = append(out.Diagnostics, d)
+		}
+	}
+	if len(out.Diagnostics) == 0 {
+		return nil
+	}
+	return &out
+}
+
+// ConformanceError is returned when the output can't conform
+// to the PDF/A level requested by `Options.Conformance`.
+type ConformanceError struct {
+	Diagnostics []diagnostics.Diagnostic
+}
+
+func (e *ConformanceError) Error() string {
+	if len(e.Diagnostics) == 1 {
+		return e.Diagnostics[0].String()
+	}
+	return fmt.Sprintf("%s (and %d more)", e.Diagnostics[0], len(e.Diagnostics)-1)
+}
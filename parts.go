@@ -0,0 +1,104 @@
+package goweasyprint
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/html/tree"
+	"github.com/benoitkugler/webrender/text"
+)
+
+// Part is one of the HTML documents merged by `ConvertParts`.
+type Part struct {
+	// Content is the HTML document.
+	Content ContentInput
+
+	// Label, if not empty, is the outline entry grouping the bookmarks of the part.
+	Label string
+
+	// BaseUrl is used as reference for links (stylesheets, images, etc...). If empty,
+	// `Options.BaseUrl` is used, or, if also empty, it is deduced from the html content.
+	BaseUrl string
+
+	// Stylesheets is an optional list of user stylesheets, applied after `Options.Stylesheets`.
+	Stylesheets []tree.CSS
+}
+
+// ConvertParts renders each of the `parts` and writes them, one after the other,
+// as one PDF file in `target`. The parts share the settings of `opts`, and the fonts
+// and images they use are only embedded once.
+//
+// The bookmarks of each part are nested under its label (if any).
+// Links between parts, like <a href="chapter2.html#section">, are preserved
+// when the URL (without fragment) matches the base URL of another part.
+// Note that fragment only links (like <a href="#section">) always refer to their own part.
+//
+// The metadata of the first part are used for the PDF file, and `opts.Attachments` are only
+// added once. In tagged files, each part is a "Part" structure element, and the language
+// of the first part is used for the document.
+func ConvertParts(target io.Writer, parts []Part, fontConfig text.FontConfiguration, opts Options) error {
+	return ConvertPartsContext(context.Background(), target, parts, fontConfig, opts)
+}
+
+// ConvertPartsContext is the same as ConvertParts, but stops as soon as possible
+// once `ctx` is done, returning `ctx.Err()`. See `ConvertContext` for more details.
+func ConvertPartsContext(ctx context.Context, target io.Writer, parts []Part, fontConfig text.FontConfiguration, opts Options) (err error) {
+	if opts.Stream {
+		return errors.New("streaming mode is not supported when merging documents")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	opts = opts.prepare(ctx)
+
+	var output *pdf.Output
+	defer recoverPanic(ctx, currentPage(&output), opts.Diagnostics, &err)
+
+	output, err = opts.newOutput(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	var fields []pdf.FormField
+	for i, part := range parts {
+		partOpts := opts
+		if part.BaseUrl != "" {
+			partOpts.BaseUrl = part.BaseUrl
+		}
+		partOpts.Stylesheets = append(opts.Stylesheets[:len(opts.Stylesheets):len(opts.Stylesheets)], part.Stylesheets...)
+
+		doc, parsedHtml, partFields, err := renderContext(ctx, part.Content, fontConfig, partOpts, len(fields))
+		if err != nil {
+			return err
+		}
+		fields = append(fields, partFields...)
+		partOutput := output.NewPart(part.Label, parsedHtml.BaseUrl)
+		if i == 0 {
+			output.SetDirection(htmlDirection(parsedHtml.Root))
+		}
+		if opts.Tagged {
+			if i == 0 {
+				output.SetStructure(&pdf.StructElement{Type: "Document", Lang: parsedHtml.Root.Get("lang")})
+			}
+			partOutput.SetStructure(htmlStructure(parsedHtml.Root, parsedHtml.BaseUrl, "Part"))
+		}
+
+		attachments := opts.Attachments
+		if i != 0 {
+			attachments = nil
+		}
+		func() {
+			defer lockFontConfig(fontConfig)()
+			doc.Write(partOutput, opts.zoom(), attachments)
+		}()
+	}
+
+	output.SetFormFields(fields)
+	pdfDoc := output.Finalize()
+	if err := opts.strictErr(); err != nil {
+		return err
+	}
+	return opts.writeDocument(ctx, pdfDoc, output, target)
+}
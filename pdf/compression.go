@@ -0,0 +1,169 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/benoitkugler/pdf/model"
+)
+
+// Compression controls how the streams and the
+// cross-reference table of a file are written.
+type Compression uint8
+
+const (
+	// CompressStreams compresses the content streams, the font files
+	// and the ToUnicode CMaps with the Flate filter. It is the default.
+	CompressStreams Compression = iota
+	// Uncompressed writes readable streams, which is useful
+	// to troubleshoot the output.
+	Uncompressed
+	// OptimizeSize compresses the streams, and also packs the objects which are not
+	// streams into object streams, indexed by a cross-reference stream (PDF 1.5).
+	OptimizeSize
+)
+
+// SetCompression sets the compression of the streams, which defaults to `CompressStreams`.
+// Note that `OptimizeSize` also requires the `WriteOptions.Compression` field
+// to be set when writing the document.
+// It must be called before adding pages.
+func (c *Output) SetCompression(compression Compression) {
+	c.cache.compression = compression
+}
+
+// compressStreams returns true if the streams created
+// by the output are compressed.
+func (c cache) compressStreams() bool { return c.compression != Uncompressed }
+
+// newStream returns a stream with the given content,
+// compressed if needed.
+func (c cache) newStream(content []byte) model.Stream {
+	if c.compressStreams() {
+		return model.NewCompressedStream(content)
+	}
+	return model.Stream{Content: content}
+}
+
+// the number of objects stored in one object stream
+const objectsPerStream = 100
+
+// objectPacker stores the objects which are not
+// streams into object streams (see `OptimizeSize`).
+type objectPacker struct {
+	nums    []int // objects of the current stream
+	offsets []int // offsets of the objects in `content`
+	content bytes.Buffer
+
+	// object number -> (object stream number, index in the stream)
+	locations map[int][2]int
+}
+
+func newObjectPacker() *objectPacker {
+	return &objectPacker{locations: make(map[int][2]int)}
+}
+
+// pack adds the object `num` to the current object stream,
+// which is written once full.
+func (w *rawWriter) pack(num int, obj model.Object) {
+	p := w.packer
+	w.offsets[num] = 0 // mark the object as used
+	p.nums = append(p.nums, num)
+	p.offsets = append(p.offsets, p.content.Len())
+	p.content.WriteString(rawString(obj))
+	p.content.WriteByte('\n')
+	if len(p.nums) == objectsPerStream {
+		w.flushPacked()
+	}
+}
+
+// flushPacked writes the pending packed objects as an object stream.
+func (w *rawWriter) flushPacked() {
+	p := w.packer
+	if len(p.nums) == 0 {
+		return
+	}
+	num := w.reserve()
+	var header bytes.Buffer
+	for i, objNum := range p.nums {
+		fmt.Fprintf(&header, "%d %d ", objNum, p.offsets[i])
+		p.locations[objNum] = [2]int{num, i}
+	}
+	first := header.Len()
+	header.Write(p.content.Bytes())
+	w.writeObject(num, model.ObjStream{
+		Args: model.ObjDict{
+			"Type":   model.Name("ObjStm"),
+			"N":      model.ObjInt(len(p.nums)),
+			"First":  model.ObjInt(first),
+			"Filter": model.Name("FlateDecode"),
+		},
+		Content: deflate(header.Bytes()),
+	})
+
+	p.nums, p.offsets = p.nums[:0], p.offsets[:0]
+	p.content.Reset()
+}
+
+// writeXrefStream writes the pending packed objects, and a cross-reference
+// stream in place of the cross-reference table and the trailer.
+func (w *rawWriter) writeXrefStream(root, info, encrypt int) error {
+	w.flushPacked()
+	num := w.reserve()
+	start := w.written
+	w.offsets[num] = start
+
+	// each entry is made of a type (1 byte), an offset or an object number (4 bytes),
+	// and a generation number or an index (2 bytes)
+	nextFree := w.freeList()
+	var data bytes.Buffer
+	entry := func(kind byte, field2, field3 int) {
+		data.WriteByte(kind)
+		data.Write(binary.BigEndian.AppendUint32(nil, uint32(field2)))
+		data.Write(binary.BigEndian.AppendUint16(nil, uint16(field3)))
+	}
+	entry(0, nextFree[0], 65535)
+	for n := 1; n < len(w.offsets); n++ {
+		if loc, ok := w.packer.locations[n]; ok {
+			entry(2, loc[0], loc[1])
+		} else if w.offsets[n] == -1 {
+			entry(0, nextFree[n], 1)
+		} else {
+			entry(1, w.offsets[n], 0)
+		}
+	}
+
+	args := model.ObjDict{
+		"Type":   model.Name("XRef"),
+		"Size":   model.ObjInt(len(w.offsets)),
+		"W":      model.ObjArray{model.ObjInt(1), model.ObjInt(4), model.ObjInt(2)},
+		"Root":   model.ObjIndirectRef{ObjectNumber: root},
+		"Filter": model.Name("FlateDecode"),
+	}
+	if info != 0 {
+		args["Info"] = model.ObjIndirectRef{ObjectNumber: info}
+	}
+	if encrypt != 0 {
+		args["Encrypt"] = model.ObjIndirectRef{ObjectNumber: encrypt}
+	}
+	if id := w.fileID(); id != nil {
+		args["ID"] = model.ObjArray{model.ObjHexLiteral(id), model.ObjHexLiteral(id)}
+	}
+	stream := model.ObjStream{Args: args, Content: deflate(data.Bytes())}
+	w.bytes([]byte(fmt.Sprintf("%d 0 obj\n", num)))
+	w.bytes([]byte(rawStreamHeader(stream)))
+	w.bytes([]byte("\nstream\n"))
+	w.bytes(stream.Content)
+	w.bytes([]byte(fmt.Sprintf("\nendstream\nendobj\nstartxref\n%d\n%%%%EOF", start)))
+	return w.err
+}
+
+// deflate compresses `content` with the Flate filter.
+func deflate(content []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	return buf.Bytes()
+}
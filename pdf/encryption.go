@@ -0,0 +1,401 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/benoitkugler/pdf/model"
+)
+
+// EncryptionAlgorithm selects the standard security handler used to encrypt a file.
+type EncryptionAlgorithm uint8
+
+const (
+	// AES256 uses 256-bit AES keys (revision 6 of the standard
+	// security handler, defined by PDF 2.0). It is the default.
+	AES256 EncryptionAlgorithm = iota
+	// AES128 uses 128-bit AES keys (revision 4 of the standard
+	// security handler, defined by PDF 1.6), for older readers.
+	AES128
+)
+
+func (ea EncryptionAlgorithm) String() string {
+	switch ea {
+	case AES256:
+		return "AES-256"
+	case AES128:
+		return "AES-128"
+	default:
+		return fmt.Sprintf("<encryption algorithm %d>", ea)
+	}
+}
+
+// Permissions are the operations allowed on an encrypted file
+// opened with the user password.
+type Permissions uint8
+
+const (
+	// PermitPrint allows printing, in high quality.
+	PermitPrint Permissions = 1 << iota
+	// PermitCopy allows copying or extracting text and graphics.
+	PermitCopy
+	// PermitModify allows modifying the content, and assembling the document
+	// (inserting, rotating or deleting pages, and creating bookmarks).
+	PermitModify
+	// PermitAnnotate allows adding or modifying annotations, and filling form fields.
+	PermitAnnotate
+
+	PermitAll = PermitPrint | PermitCopy | PermitModify | PermitAnnotate
+)
+
+// Encryption protects a file with passwords, using AES.
+// Note that the readers are responsible for enforcing the permissions.
+type Encryption struct {
+	// UserPassword is required to open the file. It may be empty, so that
+	// the file opens without password, with the restricted permissions.
+	UserPassword string
+
+	// OwnerPassword gives full access to the file. If empty, a random
+	// password is used, so that the permissions can't be lifted.
+	OwnerPassword string
+
+	// Permissions are the operations allowed with the user password.
+	// The text extraction for accessibility is always allowed.
+	Permissions Permissions
+
+	// Algorithm defaults to AES256.
+	Algorithm EncryptionAlgorithm
+}
+
+// flags returns the P entry of the encryption dictionary
+func (p Permissions) flags() int32 {
+	// bits 7, 8 and 13 to 32 are reserved and must be set,
+	// bit 10 allows the extraction for accessibility
+	flags := uint32(0xFFFFF0C0 | 1<<9)
+	if p&PermitPrint != 0 {
+		flags |= 1<<2 | 1<<11
+	}
+	if p&PermitModify != 0 {
+		flags |= 1<<3 | 1<<10
+	}
+	if p&PermitCopy != 0 {
+		flags |= 1 << 4
+	}
+	if p&PermitAnnotate != 0 {
+		flags |= 1<<5 | 1<<8
+	}
+	return int32(flags)
+}
+
+// encryptor encrypts the strings and streams of a file,
+// as described by its encryption dictionary.
+type encryptor struct {
+	aes256 bool
+	key    []byte // file encryption key
+	id     []byte // first element of the file identifier
+	dict   model.ObjDict
+
+	random io.Reader // source of the salts and initialization vectors
+}
+
+// newEncryptor returns an encryptor for the file identified by `id`. If `seed` is not empty,
+// the random values are derived from it, so that the output is reproducible.
+func newEncryptor(enc Encryption, id []byte, seed []byte) (*encryptor, error) {
+	out := &encryptor{aes256: enc.Algorithm == AES256, id: id, random: rand.Reader}
+	if len(seed) != 0 {
+		out.random = &seededReader{seed: seed}
+	}
+	if enc.OwnerPassword == "" {
+		var random [16]byte
+		if _, err := io.ReadFull(out.random, random[:]); err != nil {
+			return nil, err
+		}
+		enc.OwnerPassword = fmt.Sprintf("%x", random)
+	}
+	p := enc.Permissions.flags()
+	var err error
+	switch enc.Algorithm {
+	case AES256:
+		err = out.setupAES256(enc.UserPassword, enc.OwnerPassword, p)
+	case AES128:
+		out.setupAES128(enc.UserPassword, enc.OwnerPassword, p)
+	default:
+		err = fmt.Errorf("unsupported encryption algorithm %s", enc.Algorithm)
+	}
+	return out, err
+}
+
+// cryptFilter returns the entries of the encryption dictionary
+// describing the crypt filter used for the strings and the streams
+func cryptFilter(method model.Name, length int) model.ObjDict {
+	return model.ObjDict{
+		"Filter": model.Name("Standard"),
+		"CF": model.ObjDict{"StdCF": model.ObjDict{
+			"CFM":       method,
+			"AuthEvent": model.Name("DocOpen"),
+			"Length":    model.ObjInt(length),
+		}},
+		"StmF":            model.Name("StdCF"),
+		"StrF":            model.Name("StdCF"),
+		"EncryptMetadata": model.ObjBool(true),
+	}
+}
+
+// passwordPadding is used to pad the passwords to 32 bytes
+var passwordPadding = [32]byte{
+	0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41, 0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08,
+	0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80, 0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A,
+}
+
+func padPassword(password string) []byte {
+	return append([]byte(password), passwordPadding[:]...)[:32]
+}
+
+// rc4Rounds encrypts `data` in place with RC4, using `key`, then 19 times
+// using `key` XORed with the round number (or the reverse, if `decrypt` is true)
+func rc4Rounds(data, key []byte, decrypt bool) {
+	roundKey := make([]byte, len(key))
+	for round := 0; round <= 19; round++ {
+		i := round
+		if decrypt {
+			i = 19 - round
+		}
+		for j, b := range key {
+			roundKey[j] = b ^ byte(i)
+		}
+		c, _ := rc4.NewCipher(roundKey)
+		c.XORKeyStream(data, data)
+	}
+}
+
+// setupAES128 implements the revision 4 of the standard security handler,
+// with 128-bit keys (algorithms 2, 3 and 5 of the specification).
+func (e *encryptor) setupAES128(userPassword, ownerPassword string, p int32) {
+	const keyLength = 16
+
+	// owner hash
+	ownerKey := md5.Sum(padPassword(ownerPassword))
+	for range 50 {
+		ownerKey = md5.Sum(ownerKey[:])
+	}
+	o := padPassword(userPassword)
+	rc4Rounds(o, ownerKey[:keyLength], false)
+
+	// file encryption key
+	var buf bytes.Buffer
+	buf.Write(padPassword(userPassword))
+	buf.Write(o)
+	binary.Write(&buf, binary.LittleEndian, p)
+	buf.Write(e.id)
+	key := md5.Sum(buf.Bytes())
+	for range 50 {
+		key = md5.Sum(key[:keyLength])
+	}
+	e.key = key[:keyLength]
+
+	// user hash
+	u := md5.Sum(append(passwordPadding[:], e.id...))
+	rc4Rounds(u[:], e.key, false)
+	uValue := make([]byte, 32)
+	copy(uValue, u[:]) // the last 16 bytes are arbitrary
+
+	e.dict = cryptFilter("AESV2", keyLength)
+	e.dict["V"] = model.ObjInt(4)
+	e.dict["R"] = model.ObjInt(4)
+	e.dict["Length"] = model.ObjInt(8 * keyLength)
+	e.dict["P"] = model.ObjInt(p)
+	e.dict["O"] = model.ObjHexLiteral(o)
+	e.dict["U"] = model.ObjHexLiteral(uValue)
+}
+
+// hash2B is the algorithm 2.B of the specification (PDF 2.0),
+// used to hash the passwords for the revision 6.
+func hash2B(password, salt, userKey []byte) []byte {
+	h := sha256.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(userKey)
+	k := h.Sum(nil)
+	var e []byte
+	for round := 0; round < 64 || int(e[len(e)-1]) > round-32; round++ {
+		chunk := append(append(append([]byte(nil), password...), k...), userKey...)
+		k1 := bytes.Repeat(chunk, 64)
+		block, _ := aes.NewCipher(k[:16])
+		e = make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+		// the first 16 bytes of E, as a big-endian number, modulo 3
+		var sum int
+		for _, b := range e[:16] {
+			sum += int(b)
+		}
+		switch sum % 3 {
+		case 0:
+			s := sha256.Sum256(e)
+			k = s[:]
+		case 1:
+			s := sha512.Sum384(e)
+			k = s[:]
+		case 2:
+			s := sha512.Sum512(e)
+			k = s[:]
+		}
+	}
+	return k[:32]
+}
+
+// aesNoPadding encrypts `data` (whose length is a multiple of the block size)
+// with AES-256 in CBC mode, using a zero initialization vector.
+func aesNoPadding(key, data []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, data)
+	return out
+}
+
+// setupAES256 implements the revision 6 of the standard security handler,
+// with 256-bit keys (algorithms 8, 9 and 10 of the specification).
+func (e *encryptor) setupAES256(userPassword, ownerPassword string, p int32) error {
+	// the passwords should be normalized with SASLprep : we only truncate them
+	truncate := func(password string) []byte {
+		if len(password) > 127 {
+			return []byte(password[:127])
+		}
+		return []byte(password)
+	}
+	user, owner := truncate(userPassword), truncate(ownerPassword)
+
+	// file key, followed by the salts and the end of Perms
+	random := make([]byte, 32+4*8+4)
+	if _, err := io.ReadFull(e.random, random); err != nil {
+		return err
+	}
+	e.key = random[:32]
+	salts := random[32:64]
+
+	u := append(hash2B(user, salts[0:8], nil), salts[0:16]...)
+	ue := aesNoPadding(hash2B(user, salts[8:16], nil), e.key)
+	o := append(hash2B(owner, salts[16:24], u), salts[16:32]...)
+	oe := aesNoPadding(hash2B(owner, salts[24:32], u), e.key)
+
+	perms := make([]byte, 16)
+	binary.LittleEndian.PutUint32(perms, uint32(p))
+	copy(perms[4:], []byte{0xFF, 0xFF, 0xFF, 0xFF, 'T', 'a', 'd', 'b'})
+	copy(perms[12:], random[64:])
+	block, _ := aes.NewCipher(e.key)
+	block.Encrypt(perms, perms) // one block : ECB mode
+
+	e.dict = cryptFilter("AESV3", 32)
+	e.dict["V"] = model.ObjInt(5)
+	e.dict["R"] = model.ObjInt(6)
+	e.dict["Length"] = model.ObjInt(256)
+	e.dict["P"] = model.ObjInt(p)
+	e.dict["O"] = model.ObjHexLiteral(o)
+	e.dict["U"] = model.ObjHexLiteral(u)
+	e.dict["OE"] = model.ObjHexLiteral(oe)
+	e.dict["UE"] = model.ObjHexLiteral(ue)
+	e.dict["Perms"] = model.ObjHexLiteral(perms)
+	return nil
+}
+
+// encrypt returns `data`, encrypted with AES in CBC mode, and
+// prefixed by its initialization vector, for the object `num`.
+func (e *encryptor) encrypt(num int, data []byte) ([]byte, error) {
+	key := e.key
+	if !e.aes256 {
+		// the key depends on the object
+		b := append(append([]byte(nil), e.key...), byte(num), byte(num>>8), byte(num>>16), 0, 0)
+		b = append(b, "sAlT"...)
+		objectKey := md5.Sum(b)
+		key = objectKey[:]
+	}
+
+	// PKCS#5 padding
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, aes.BlockSize+len(data)+padding)
+	if _, err := io.ReadFull(e.random, out[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(out[aes.BlockSize:], data)
+	for i := len(out) - padding; i < len(out); i++ {
+		out[i] = byte(padding)
+	}
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], out[aes.BlockSize:])
+	return out, nil
+}
+
+// encryptObject returns a copy of `obj`, the object `num`, with its
+// strings and stream content encrypted.
+func (e *encryptor) encryptObject(num int, obj model.Object) (model.Object, error) {
+	var err error
+	switch obj := obj.(type) {
+	case model.ObjStringLiteral:
+		out, err := e.encrypt(num, []byte(obj))
+		return model.ObjHexLiteral(out), err
+	case model.ObjHexLiteral:
+		out, err := e.encrypt(num, []byte(obj))
+		return model.ObjHexLiteral(out), err
+	case model.ObjDict:
+		out := make(model.ObjDict, len(obj))
+		// sorted, so that the random values are used in a deterministic order
+		for _, k := range slices.Sorted(maps.Keys(obj)) {
+			if out[k], err = e.encryptObject(num, obj[k]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case model.ObjArray:
+		out := make(model.ObjArray, len(obj))
+		for i, v := range obj {
+			if out[i], err = e.encryptObject(num, v); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case model.ObjStream:
+		args, err := e.encryptObject(num, obj.Args)
+		if err != nil {
+			return nil, err
+		}
+		content, err := e.encrypt(num, obj.Content)
+		return model.ObjStream{Args: args.(model.ObjDict), Content: content}, err
+	default:
+		return obj, nil
+	}
+}
+
+// seededReader is a deterministic source of random bytes,
+// used for reproducible outputs.
+type seededReader struct {
+	seed    []byte
+	counter uint64
+	pending []byte
+}
+
+func (sr *seededReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(sr.pending) == 0 {
+			h := sha256.New()
+			h.Write(sr.seed)
+			binary.Write(h, binary.BigEndian, sr.counter)
+			sr.counter++
+			sr.pending = h.Sum(nil)
+		}
+		c := copy(p[n:], sr.pending)
+		sr.pending = sr.pending[c:]
+		n += c
+	}
+	return n, nil
+}
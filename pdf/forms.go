@@ -0,0 +1,524 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	cs "github.com/benoitkugler/pdf/contentstream"
+	"github.com/benoitkugler/pdf/fonts/standardfonts"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+	"github.com/benoitkugler/webrender/backend"
+	"github.com/go-text/typesetting/font"
+)
+
+// FormFieldURLPrefix marks the boxes of the interactive form fields registered
+// with `Output.SetFormFields` : the first box whose (non standard) CSS link property
+// is `FormFieldURL(i)` is replaced by the widget of the i-th field.
+// The links not matching a registered field are ignored.
+// The form fields are not supported by `StreamOutput`.
+const FormFieldURLPrefix = "weasyprint:field:"
+
+// FormFieldURL returns the link marking the box of the field with the given index.
+func FormFieldURL(index int) string { return FormFieldURLPrefix + strconv.Itoa(index) }
+
+// isFieldURL returns true for the links marking the boxes of the
+// signature and form fields, which are not added as annotations.
+func isFieldURL(url string) bool {
+	return url == SignatureFieldURL || strings.HasPrefix(url, FormFieldURLPrefix)
+}
+
+// FormFieldKind is the type of an interactive form field.
+type FormFieldKind uint8
+
+const (
+	TextField          FormFieldKind = iota // a single line text input
+	MultilineTextField                      // a text area
+	CheckBox
+	RadioButton // the radio buttons sharing the same name are grouped
+	ComboBox    // a drop-down list
+)
+
+// FormOption is one of the choices of a combo box.
+type FormOption struct {
+	Value, Label string
+}
+
+// FormField is an interactive form field (AcroForm), usually
+// built from an HTML form element.
+type FormField struct {
+	Kind FormFieldKind
+
+	// Name is the name of the field. The fields sharing the same name
+	// share the same value, as the radio buttons of a group.
+	Name string
+
+	// Value is the text of the text fields, the export value of the check boxes
+	// and radio buttons, and the selected value of the combo boxes.
+	Value string
+
+	Checked bool         // for the check boxes and radio buttons
+	Options []FormOption // for the combo boxes
+
+	ReadOnly, Required bool
+}
+
+// flags returns the field flags
+func (f FormField) flags() model.FormFlag {
+	var out model.FormFlag
+	switch f.Kind {
+	case MultilineTextField:
+		out = model.Multiline
+	case RadioButton:
+		out = model.Radio | model.NoToggleToOff
+	case ComboBox:
+		out = model.Combo
+	}
+	if f.ReadOnly {
+		out |= model.ReadOnly
+	}
+	if f.Required {
+		out |= model.Required
+	}
+	return out
+}
+
+// text returns the text shown by the field
+func (f FormField) text() string {
+	switch f.Kind {
+	case TextField, MultilineTextField:
+		return f.Value
+	case ComboBox:
+		for _, option := range f.Options {
+			if option.Value == f.Value {
+				return option.Label
+			}
+		}
+	}
+	return ""
+}
+
+// SetFormFields registers the interactive form fields, whose widgets
+// cover the boxes marked with `FormFieldURL`. The fields without box are ignored.
+// It must be called before `Finalize`.
+func (c *Output) SetFormFields(fields []FormField) { c.formFields = fields }
+
+// fieldBox is a box marked with `FormFieldURL`
+type fieldBox struct {
+	index int
+	url   string
+	rect  model.Rectangle
+}
+
+// fieldWidget is the widget of a form field
+type fieldWidget struct {
+	fieldBox
+	page *outputPage
+}
+
+// fieldGroup is the form field shared by the widgets with the same name
+type fieldGroup struct {
+	field   *model.FormFieldDict
+	widgets []*model.AnnotationDict
+}
+
+// the name of the embedded font used by the appearance streams of the text fields
+const fieldFontName model.ObjName = "FT0"
+
+// the name of the font given in the form resources, used by the viewers
+// to draw the values typed in the text fields : since the embedded fonts are subsetted,
+// a standard font is used, supporting the characters of WinAnsiEncoding.
+const fieldDefaultFontName model.ObjName = "Helv"
+
+// addFormFields adds the fields registered by `SetFormFields`, whose widget covers the first box
+// marked with their URL. It must be called before finalizing the pages and writing the fonts.
+func (c *Output) addFormFields(pages []*outputPage) {
+	var widgets []fieldWidget
+	placed := make(map[int]bool)
+	for _, p := range pages {
+		for _, box := range p.fieldBoxes {
+			if box.index >= len(c.formFields) || placed[box.index] {
+				continue
+			}
+			placed[box.index] = true
+			widgets = append(widgets, fieldWidget{fieldBox: box, page: p})
+		}
+	}
+	if len(widgets) == 0 {
+		return
+	}
+
+	var texts []string
+	for _, w := range widgets {
+		texts = append(texts, c.formFields[w.index].text())
+	}
+	ff := c.fieldFont(texts)
+
+	if ff == nil { // the values are not drawn
+		c.reportMissingFieldFont(texts)
+	}
+
+	form := &c.document.Catalog.AcroForm
+	form.DR.Font = map[model.ObjName]*model.FontDict{
+		fieldDefaultFontName: {Subtype: standardfonts.Helvetica.WesternType1Font()},
+	}
+	form.DA = fmt.Sprintf("%s 0 Tf 0 g", fieldDefaultFontName)
+
+	var groups []*fieldGroup
+	byName := make(map[string]*fieldGroup)
+	for _, w := range widgets {
+		f := c.formFields[w.index]
+		group := byName[f.Name]
+		if group == nil {
+			group = &fieldGroup{field: &model.FormFieldDict{T: f.Name}}
+			group.field.Ff = f.flags()
+			switch f.Kind {
+			case TextField, MultilineTextField:
+				group.field.FT = model.FormFieldText{V: f.Value}
+			case CheckBox, RadioButton:
+				group.field.FT = model.FormFieldButton{V: "Off"}
+			case ComboBox:
+				choice := model.FormFieldChoice{}
+				for _, option := range f.Options {
+					opt := model.Option{Name: option.Label}
+					if option.Value != option.Label {
+						opt.Export = option.Value
+					}
+					choice.Opt = append(choice.Opt, opt)
+				}
+				if f.Value != "" {
+					choice.V = []string{f.Value}
+				}
+				group.field.FT = choice
+			}
+			byName[f.Name] = group
+			groups = append(groups, group)
+		}
+		group.widgets = append(group.widgets, c.newFieldWidget(w, group, ff))
+	}
+
+	for _, group := range groups {
+		if len(group.widgets) == 1 {
+			group.field.Widgets = []model.FormFieldWidget{{AnnotationDict: group.widgets[0]}}
+		} else {
+			// each widget is a kid, so that it refers to the field
+			for _, widget := range group.widgets {
+				group.field.Kids = append(group.field.Kids, &model.FormFieldDict{
+					Parent:  group.field,
+					Widgets: []model.FormFieldWidget{{AnnotationDict: widget}},
+				})
+			}
+		}
+		form.Fields = append(form.Fields, group.field)
+	}
+}
+
+// newFieldWidget returns the widget of the field `w`, with its appearance,
+// and adds it to its page. `ff` may be nil.
+func (c *Output) newFieldWidget(w fieldWidget, group *fieldGroup, ff *fieldFont) *model.AnnotationDict {
+	f := c.formFields[w.index]
+	rect := w.rect
+	widget := &model.AnnotationDict{
+		BaseAnnotation: model.BaseAnnotation{
+			Rect: rect,
+			F:    model.APrint,
+		},
+		Subtype: model.AnnotationWidget{},
+	}
+	bbox := model.Rectangle{Urx: rect.Width(), Ury: rect.Height()}
+	switch f.Kind {
+	case CheckBox, RadioButton:
+		state := stateName(f.Value, len(group.widgets))
+		widget.AP = &model.AppearanceDict{N: model.AppearanceEntry{
+			state: c.buttonAppearance(bbox, f.Kind == RadioButton),
+			"Off": c.newFieldAppearance(bbox, nil, []cs.Operation{cs.OpSave{}, cs.OpRestore{}}), // empty streams are not written
+		}}
+		widget.AS = "Off"
+		if button, ok := group.field.FT.(model.FormFieldButton); ok && f.Checked {
+			widget.AS = state
+			button.V = state
+			group.field.FT = button
+		}
+	default:
+		fontSize := fieldFontSize(bbox.Ury, f.Kind == MultilineTextField)
+		if group.field.DA == "" {
+			group.field.DA = fmt.Sprintf("%s %s Tf 0 g", fieldDefaultFontName, model.FmtFloat(fontSize))
+		}
+		widget.AP = &model.AppearanceDict{N: model.AppearanceEntry{
+			"": c.textAppearance(bbox, f.text(), f.Kind == MultilineTextField, fontSize, ff),
+		}}
+		if ff != nil {
+			pages := c.cache.fontPages[ff.font]
+			if pages == nil {
+				pages = make(map[int]bool)
+				c.cache.fontPages[ff.font] = pages
+			}
+			pages[w.page.group.page] = true
+		}
+	}
+	w.page.tagAnnotation(widget, w.url)
+	if widget.Contents == w.url { // not found in the structure
+		widget.Contents = f.Name
+	}
+	w.page.page.Annots = append(w.page.page.Annots, widget)
+	return widget
+}
+
+// stateName returns the appearance state of a check box or a radio button
+// exporting `value`, with the characters not allowed in names escaped.
+// The empty value and "Off" are replaced by the index `i` of the widget in its field.
+func stateName(value string, i int) model.Name {
+	if value == "" || value == "Off" {
+		return model.Name(strconv.Itoa(i))
+	}
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c <= ' ' || c >= 0x7f || c == '#' || strings.IndexByte("()<>[]{}/%", c) != -1 {
+			fmt.Fprintf(&b, "#%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return model.Name(b.String())
+}
+
+// hasFieldKids returns true if one of the fields of `form` has kids,
+// whose parent must be set by `fixFormFields`.
+func hasFieldKids(form model.AcroForm) bool {
+	for _, field := range form.Fields {
+		if len(field.Kids) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fixFormFields sets the parent of the kids of the form fields, which is not written
+// by model.Document.Write for the widgets merged with their field.
+func fixFormFields(raw *file.PDFFile) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	form, _ := raw.ResolveObject(root["AcroForm"]).(model.ObjDict)
+	fields, _ := raw.ResolveObject(form["Fields"]).(model.ObjArray)
+	var walk func(ref model.Object)
+	walk = func(ref model.Object) {
+		field, _ := raw.ResolveObject(ref).(model.ObjDict)
+		kids, _ := raw.ResolveObject(field["Kids"]).(model.ObjArray)
+		for _, kid := range kids {
+			if kidDict, _ := raw.ResolveObject(kid).(model.ObjDict); kidDict != nil {
+				kidDict["Parent"] = ref
+				walk(kid)
+			}
+		}
+	}
+	for _, ref := range fields {
+		walk(ref)
+	}
+}
+
+// fieldFontSize returns the font size used by the text fields of height `height`,
+// since the style of the elements is not known by the backend.
+func fieldFontSize(height fl, multiline bool) fl {
+	size := min(12, max(4, (height-4)*0.75))
+	if multiline {
+		size = min(size, 9)
+	}
+	return size
+}
+
+// newFieldAppearance returns the form XObject drawing `ops`, using `resources`.
+func (c *Output) newFieldAppearance(bbox model.Rectangle, resources *model.ResourcesDict, ops []cs.Operation) *model.XObjectForm {
+	out := &model.XObjectForm{
+		ContentStream: model.ContentStream{Stream: c.cache.newStream(cs.WriteOperations(ops...))},
+		BBox:          bbox,
+	}
+	if resources != nil {
+		out.Resources = *resources
+	}
+	return out
+}
+
+// buttonAppearance returns the appearance of a checked check box or radio button :
+// a check mark or a dot.
+func (c *Output) buttonAppearance(bbox model.Rectangle, radio bool) *model.XObjectForm {
+	w, h := bbox.Urx, bbox.Ury
+	ops := []cs.Operation{cs.OpSave{}, cs.OpSetFillGray{G: 0}, cs.OpSetStrokeGray{G: 0}}
+	if radio {
+		// a circle, approximated by four Bézier curves
+		r, x, y := min(w, h)/4, w/2, h/2
+		k := r * 0.5523
+		ops = append(ops,
+			cs.OpMoveTo{X: x + r, Y: y},
+			cs.OpCubicTo{X1: x + r, Y1: y + k, X2: x + k, Y2: y + r, X3: x, Y3: y + r},
+			cs.OpCubicTo{X1: x - k, Y1: y + r, X2: x - r, Y2: y + k, X3: x - r, Y3: y},
+			cs.OpCubicTo{X1: x - r, Y1: y - k, X2: x - k, Y2: y - r, X3: x, Y3: y - r},
+			cs.OpCubicTo{X1: x + k, Y1: y - r, X2: x + r, Y2: y - k, X3: x + r, Y3: y},
+			cs.OpFill{},
+		)
+	} else {
+		ops = append(ops,
+			cs.OpSetLineWidth{W: min(w, h) / 8},
+			cs.OpMoveTo{X: 0.2 * w, Y: 0.5 * h},
+			cs.OpLineTo{X: 0.4 * w, Y: 0.25 * h},
+			cs.OpLineTo{X: 0.8 * w, Y: 0.75 * h},
+			cs.OpStroke{},
+		)
+	}
+	ops = append(ops, cs.OpRestore{})
+	return c.newFieldAppearance(bbox, nil, ops)
+}
+
+// textAppearance returns the appearance of a text field or a combo box showing `text`,
+// which is omitted if `ff` is nil. The lines of multiline fields are wrapped.
+func (c *Output) textAppearance(bbox model.Rectangle, text string, multiline bool, fontSize fl, ff *fieldFont) *model.XObjectForm {
+	const padding = 2
+	ops := []cs.Operation{
+		cs.OpBeginMarkedContent{Tag: "Tx"},
+		cs.OpSave{},
+		cs.OpRectangle{X: 1, Y: 1, W: max(0, bbox.Urx-2), H: max(0, bbox.Ury-2)},
+		cs.OpClip{},
+		cs.OpEndPath{},
+	}
+	if ff == nil || text == "" {
+		ops = append(ops, cs.OpRestore{}, cs.OpEndMarkedContent{})
+		return c.newFieldAppearance(bbox, nil, ops)
+	}
+
+	var lines []string
+	if multiline {
+		lines = ff.wrap(text, (bbox.Urx-2*padding)/fontSize)
+	} else {
+		lines = []string{strings.Join(strings.Fields(text), " ")}
+	}
+	leading := 1.15 * fontSize
+	// vertically centered for single lines, starting at the top otherwise
+	y := (bbox.Ury-fontSize)/2 + 0.2*fontSize
+	if multiline {
+		y = bbox.Ury - padding - 0.9*fontSize
+	}
+	ops = append(ops,
+		cs.OpBeginText{},
+		cs.OpSetFont{Font: fieldFontName, Size: fontSize},
+		cs.OpSetFillGray{G: 0},
+		cs.OpTextMove{X: padding, Y: y},
+	)
+	for i, line := range lines {
+		if i != 0 {
+			ops = append(ops, cs.OpTextMove{X: 0, Y: -leading})
+		}
+		ops = append(ops, cs.OpShowSpaceGlyph{Glyphs: ff.glyphs(line)})
+	}
+	ops = append(ops, cs.OpEndText{}, cs.OpRestore{}, cs.OpEndMarkedContent{})
+	resources := model.ResourcesDict{Font: map[model.ObjName]*model.FontDict{fieldFontName: ff.FontDict}}
+	return c.newFieldAppearance(bbox, &resources, ops)
+}
+
+// fieldFont is the embedded font used by the appearance of the text fields.
+type fieldFont struct {
+	font backend.Font
+	face *font.Face
+	pdfFont
+}
+
+// fieldFont returns the first embedded font supporting all the `texts`, or nil.
+func (c *Output) fieldFont(texts []string) *fieldFont {
+	for _, bFont := range c.sortedFonts() {
+		content := c.cache.fontFiles[bFont.Origin()]
+		if !content.isSupported {
+			continue
+		}
+		face, err := font.ParseTTF(bytes.NewReader(content.content))
+		if err != nil {
+			continue
+		}
+		if supportsAll(face, texts) {
+			return &fieldFont{font: bFont, face: face, pdfFont: c.cache.fonts[bFont]}
+		}
+	}
+	return nil
+}
+
+// supportsAll returns true if `face` has a glyph for
+// all the (non space) characters of `texts`
+func supportsAll(face *font.Face, texts []string) bool {
+	for _, text := range texts {
+		for _, r := range text {
+			if r == '\n' || r == '\r' || r == '\t' {
+				continue
+			}
+			if _, ok := face.NominalGlyph(r); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reportMissingFieldFont warns that the values of the fields are not drawn
+func (c *Output) reportMissingFieldFont(texts []string) {
+	for _, text := range texts {
+		if text != "" {
+			c.cache.report(diagnostics.Diagnostic{
+				Severity: diagnostics.Warning,
+				Code:     diagnostics.FontUnsupported,
+				Message:  "no embedded font supports the values of the form fields: they are not drawn",
+				Page:     -1,
+			})
+			return
+		}
+	}
+}
+
+// advance returns the width of `text`, for a font size of 1
+func (ff *fieldFont) advance(text string) fl {
+	var width fl
+	upem := fl(ff.face.Upem())
+	for _, r := range text {
+		gid, _ := ff.face.NominalGlyph(r)
+		width += fl(ff.face.HorizontalAdvance(gid)) / upem
+	}
+	return width
+}
+
+// glyphs returns the glyphs showing `text`, and registers
+// them in the font, so that they are embedded.
+func (ff *fieldFont) glyphs(text string) []cs.SpacedGlyph {
+	var out []cs.SpacedGlyph
+	upem := fl(ff.face.Upem())
+	for _, r := range text {
+		gid, _ := ff.face.NominalGlyph(r)
+		g := backend.GID(gid)
+		if _, has := ff.Cmap[g]; !has {
+			ff.Cmap[g] = []rune{r}
+		}
+		if _, has := ff.Extents[g]; !has {
+			ff.Extents[g] = backend.GlyphExtents{Width: int(fl(ff.face.HorizontalAdvance(gid)) * 1000 / upem)}
+		}
+		out = append(out, cs.SpacedGlyph{GID: g})
+	}
+	return out
+}
+
+// wrap splits `text` in lines whose width is at most `width`,
+// for a font size of 1, breaking at the spaces.
+func (ff *fieldFont) wrap(text string, width fl) []string {
+	var lines []string
+	text = strings.NewReplacer("\r\n", "\n", "\t", " ").Replace(text)
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for i, word := range strings.Split(paragraph, " ") {
+			if i != 0 && ff.advance(line+" "+word) > width {
+				lines = append(lines, line)
+				line = word
+			} else if i != 0 {
+				line += " " + word
+			} else {
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,83 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// srgbProfile returns an ICC (version 2) profile describing the sRGB color space,
+// using the D50 adapted primaries and a sampled transfer curve.
+func srgbProfile() []byte {
+	type tag struct {
+		signature string
+		data      []byte
+	}
+
+	xyz := func(x, y, z float64) []byte {
+		out := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range [3]float64{x, y, z} {
+			out = binary.BigEndian.AppendUint32(out, uint32(int32(math.Round(v*65536))))
+		}
+		return out
+	}
+
+	// sRGB transfer function, sampled
+	const samples = 1024
+	curve := []byte("curv\x00\x00\x00\x00")
+	curve = binary.BigEndian.AppendUint32(curve, samples)
+	for i := 0; i < samples; i++ {
+		v := float64(i) / (samples - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		curve = binary.BigEndian.AppendUint16(curve, uint16(math.Round(v*65535)))
+	}
+
+	const description = "sRGB IEC61966-2.1"
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len(description)+1))
+	desc = append(desc, description...)
+	desc = append(desc, 0)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...) // empty Unicode and ScriptCode descriptions
+
+	tags := []tag{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4360747, 0.2225045, 0.0139322)},
+		{"gXYZ", xyz(0.3850649, 0.7168786, 0.0971045)},
+		{"bXYZ", xyz(0.1430804, 0.0606169, 0.7141733)},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// tag table, with 4-bytes aligned data
+	var table, data bytes.Buffer
+	table.Write(binary.BigEndian.AppendUint32(nil, uint32(len(tags))))
+	dataStart := 128 + 4 + 12*len(tags)
+	for _, t := range tags {
+		table.WriteString(t.signature)
+		table.Write(binary.BigEndian.AppendUint32(nil, uint32(dataStart+data.Len())))
+		table.Write(binary.BigEndian.AppendUint32(nil, uint32(len(t.data))))
+		data.Write(t.data)
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(dataStart+data.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000) // version 2.1
+	copy(header[12:], "mntrRGB XYZ ")
+	for i, v := range [6]uint16{2024, 1, 1, 0, 0, 0} { // creation date
+		binary.BigEndian.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:]) // D50 illuminant
+
+	return append(append(header, table.Bytes()...), data.Bytes()...)
+}
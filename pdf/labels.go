@@ -0,0 +1,164 @@
+package pdf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+)
+
+// PageLabelStyle is the numbering style of the page labels.
+type PageLabelStyle uint8
+
+const (
+	LabelDecimal    PageLabelStyle = iota // 1, 2, 3
+	LabelLowerRoman                       // i, ii, iii
+	LabelUpperRoman                       // I, II, III
+	LabelLowerAlpha                       // a, b, c, ..., aa, bb
+	LabelUpperAlpha                       // A, B, C, ..., AA, BB
+	LabelNone                             // only the prefix
+)
+
+// pageLabelStyles maps the CSS list style names to the label styles
+var pageLabelStyles = map[string]PageLabelStyle{
+	"decimal":     LabelDecimal,
+	"lower-roman": LabelLowerRoman,
+	"upper-roman": LabelUpperRoman,
+	"lower-alpha": LabelLowerAlpha,
+	"upper-alpha": LabelUpperAlpha,
+	"none":        LabelNone,
+}
+
+// name returns the PDF name of the style, which is empty for `LabelNone`.
+func (s PageLabelStyle) name() model.Name {
+	switch s {
+	case LabelLowerRoman:
+		return "r"
+	case LabelUpperRoman:
+		return "R"
+	case LabelLowerAlpha:
+		return "a"
+	case LabelUpperAlpha:
+		return "A"
+	case LabelNone:
+		return ""
+	default:
+		return "D"
+	}
+}
+
+// PageLabel starts a range of page labels, displayed by the PDF viewers
+// instead of the page indices, like "i", "ii", "iii" for the front matter,
+// or "A-1", "A-2" for an appendix.
+type PageLabel struct {
+	Page   int // index of the first page of the range, in the whole document
+	Style  PageLabelStyle
+	Prefix string // like "A-"
+	Start  int    // number of the first page of the range, 1 if zero
+}
+
+// ParsePageLabels parses a comma separated list of ranges, made of the 1-based
+// index of their first page, a CSS list style ("decimal", "lower-roman", "upper-roman",
+// "lower-alpha", "upper-alpha" or "none"), and an optional prefix, separated by
+// colons, like "1:lower-roman,5:decimal,20:decimal:A-".
+func ParsePageLabels(s string) ([]PageLabel, error) {
+	var out []PageLabel
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		fields := strings.SplitN(item, ":", 3)
+		page, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || page < 1 || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid page label %q", item)
+		}
+		style, ok := pageLabelStyles[strings.TrimSpace(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("invalid page label style %q", fields[1])
+		}
+		label := PageLabel{Page: page - 1, Style: style}
+		if len(fields) == 3 {
+			label.Prefix = fields[2]
+		}
+		out = append(out, label)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty page labels %q", s)
+	}
+	return out, nil
+}
+
+// SetPageLabels registers the labels of the pages, which, if not empty,
+// replace the page indices in the PDF viewers.
+// The pages before the first range are numbered with their index.
+// The labels follow the pages kept by `SetPageSelection`.
+func (c *Output) SetPageLabels(labels []PageLabel) { c.pageLabels = labels }
+
+// pageLabelsTree returns the page labels of the written pages, whose
+// indices in the whole document are `pages`, or nil if no labels are set.
+func (c *Output) pageLabelsTree(pages []int) *model.PageLabelsTree {
+	if len(c.pageLabels) == 0 {
+		return nil
+	}
+	labels := append([]PageLabel(nil), c.pageLabels...)
+	// the last range starting at a page wins
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Page < labels[j].Page })
+
+	var (
+		out          model.PageLabelsTree
+		defaultLabel PageLabel // numbering the pages with their index
+		current      *PageLabel
+		currentValue int
+	)
+	for i, page := range pages {
+		label := &defaultLabel
+		for j := range labels {
+			if labels[j].Page <= page {
+				label = &labels[j]
+			}
+		}
+		value := max(label.Start, 1) + page - label.Page
+		// a new range is also needed when pages are dropped
+		if label != current || value != currentValue+1 {
+			st := value
+			if label.Style == LabelNone {
+				st = 1
+			}
+			out.Nums = append(out.Nums, model.NumToPageLabel{
+				Num:       i,
+				PageLabel: model.PageLabel{S: label.Style.name(), P: label.Prefix, St: st},
+			})
+		}
+		current, currentValue = label, value
+	}
+	return &out
+}
+
+// hasUnnumberedLabels returns true if one of the page labels has
+// no numbering style, which is not supported by model.Document.Write.
+func hasUnnumberedLabels(labels *model.PageLabelsTree) bool {
+	if labels == nil {
+		return false
+	}
+	for _, num := range labels.Nums {
+		if num.PageLabel.S == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// fixPageLabels removes the empty numbering styles written by model.Document.Write.
+func fixPageLabels(raw *file.PDFFile) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	labels, _ := raw.ResolveObject(root["PageLabels"]).(model.ObjDict)
+	nums, _ := raw.ResolveObject(labels["Nums"]).(model.ObjArray)
+	for _, num := range nums {
+		if label, _ := raw.ResolveObject(num).(model.ObjDict); label != nil && label["S"] == model.Name("") {
+			delete(label, "S")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pdf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/benoitkugler/pdf/model"
+)
+
+// Metadata overrides the metadata of a document, which are otherwise
+// extracted from the HTML <title> and <meta> tags.
+// The zero value of each field keeps the value of the document.
+type Metadata struct {
+	Title       string
+	Description string
+	Creator     string
+	Producer    string
+
+	// Authors and Keywords replace the ones of the document or,
+	// if MergeLists is true, are added to them.
+	Authors    []string
+	Keywords   []string
+	MergeLists bool
+
+	CreationDate     time.Time
+	ModificationDate time.Time
+
+	// Custom stores additional entries of the document information
+	// dictionary, like "InvoiceNumber", which take precedence over the standard ones.
+	Custom map[string]string
+
+	// XMP stores custom schemas, added to the XMP metadata stream.
+	XMP []XMPNamespace
+}
+
+// SetMetadata registers metadata overriding the ones set by the
+// drawn document.
+func (c *Output) SetMetadata(metadata Metadata) { c.metadata = metadata }
+
+// applyMetadata updates the document information dictionary
+// with the metadata set by `SetMetadata`.
+func (c *Output) applyMetadata() {
+	md, info := c.metadata, &c.document.Trailer.Info
+	for _, field := range [...]struct {
+		value string
+		dst   *string
+	}{
+		{md.Title, &info.Title},
+		{md.Description, &info.Subject},
+		{md.Creator, &info.Creator},
+		{md.Producer, &info.Producer},
+	} {
+		if field.value != "" {
+			*field.dst = field.value
+		}
+	}
+	if md.Authors != nil {
+		info.Author = strings.Join(mergeLists(c.authors, md.Authors, md.MergeLists), ", ")
+	}
+	if md.Keywords != nil {
+		info.Keywords = strings.Join(mergeLists(c.keywords, md.Keywords, md.MergeLists), ", ")
+	}
+	if !md.CreationDate.IsZero() {
+		info.CreationDate = md.CreationDate
+	}
+	if !md.ModificationDate.IsZero() {
+		info.ModDate = md.ModificationDate
+	}
+}
+
+// xmpMetadata returns the XMP packet matching the document information
+// dictionary, once updated by `applyMetadata`.
+func (c *Output) xmpMetadata() []byte {
+	keywords := c.keywords
+	if c.metadata.Keywords != nil {
+		keywords = mergeLists(c.keywords, c.metadata.Keywords, c.metadata.MergeLists)
+	}
+	doc := xmpDocument{
+		info:       withCustomInfo(c.document.Trailer.Info, c.metadata.Custom),
+		keywords:   keywords,
+		namespaces: c.metadata.XMP,
+	}
+	return xmpPacket(doc, c.cache.conformance, c.cache.tags != nil)
+}
+
+// withCustomInfo returns `info`, with the standard entries
+// overridden by `custom`.
+func withCustomInfo(info model.Info, custom map[string]string) model.Info {
+	for key, value := range custom {
+		switch key {
+		case "Title":
+			info.Title = value
+		case "Author":
+			info.Author = value
+		case "Subject":
+			info.Subject = value
+		case "Keywords":
+			info.Keywords = value
+		case "Creator":
+			info.Creator = value
+		case "Producer":
+			info.Producer = value
+		}
+	}
+	return info
+}
+
+// SourceDateEpoch returns the date given by the SOURCE_DATE_EPOCH environment variable
+// (see https://reproducible-builds.org/specs/source-date-epoch/), in UTC, or false
+// if it is not set or invalid.
+func SourceDateEpoch() (time.Time, bool) {
+	seconds, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// mergeLists returns `override`, or, if `merge` is true, `base` followed by the
+// items of `override` not in `base`.
+func mergeLists(base, override []string, merge bool) []string {
+	if !merge {
+		return override
+	}
+	out := append([]string(nil), base...)
+	for _, item := range override {
+		isNew := true
+		for _, b := range base {
+			if b == item {
+				isNew = false
+				break
+			}
+		}
+		if isNew {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// addCustomInfo adds the `custom` entries to the raw information dictionary `info`.
+func addCustomInfo(info model.ObjDict, custom map[string]string) {
+	for key, value := range custom {
+		info[model.Name(escapeName(key))] = textString(value)
+	}
+}
+
+// textString returns a PDF text string, encoded in UTF-16 if needed.
+func textString(s string) model.ObjStringLiteral {
+	isASCII := true
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			isASCII = false
+			break
+		}
+	}
+	if isASCII {
+		return model.ObjStringLiteral(s)
+	}
+	out := []byte{0xFE, 0xFF}
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return model.ObjStringLiteral(out)
+}
+
+// escapeName returns the PDF representation of the name `s`, without the leading slash,
+// escaping the delimiters and the non printable characters.
+func escapeName(s string) string {
+	var out strings.Builder
+	for _, b := range []byte(s) {
+		if b < '!' || b > '~' || strings.IndexByte("#()<>[]{}/%", b) != -1 {
+			fmt.Fprintf(&out, "#%02X", b)
+			continue
+		}
+		out.WriteByte(b)
+	}
+	return out.String()
+}
@@ -1,9 +1,12 @@
 package pdf
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
 
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
 	cs "github.com/benoitkugler/pdf/contentstream"
 	"github.com/benoitkugler/pdf/model"
 	"github.com/benoitkugler/webrender/backend"
@@ -38,7 +41,7 @@ func (g *group) SetColorPattern(p backend.Canvas, contentWidth, contentHeight fl
 		TilingType: 1,
 	}
 
-	contentXObject := p.(*group).stream.ToXFormObject(compressStreams)
+	contentXObject := p.(*group).stream.ToXFormObject(g.compressStreams())
 	// wrap the content into a Do command
 	patternApp := cs.NewGraphicStream(model.Rectangle{Llx: 0, Lly: 0, Urx: contentWidth, Ury: contentHeight})
 	patternApp.AddXObject(contentXObject)
@@ -56,6 +59,10 @@ func (g *group) SetColorPattern(p backend.Canvas, contentWidth, contentHeight fl
 }
 
 func (g *group) SetBlendingMode(mode string) {
+	if !g.conformance.allowsTransparency() {
+		g.degrade("blend mode", g.page)
+		return
+	}
 	// PDF blend modes have TitleCase
 	chunks := strings.Split(mode, "-")
 	for i, s := range chunks {
@@ -74,6 +81,7 @@ func (g *group) Clip(evenOdd bool) {
 }
 
 func (g *group) SetAlpha(alpha fl, stroke bool) {
+	alpha = g.opaque(alpha)
 	if stroke {
 		g.stream.SetStrokeAlpha(alpha)
 	} else {
@@ -81,8 +89,17 @@ func (g *group) SetAlpha(alpha fl, stroke bool) {
 	}
 }
 
+// opaque returns `alpha`, or 1 if transparency is not allowed.
+func (g *group) opaque(alpha fl) fl {
+	if alpha < 1 && !g.conformance.allowsTransparency() {
+		g.degrade("transparency", g.page)
+		return 1
+	}
+	return alpha
+}
+
 func (g *group) SetColorRgba(color parser.RGBA, stroke bool) {
-	alpha := color.A
+	alpha := g.opaque(color.A)
 	color.A = 1 // do not take into account the opacity, it is handled by `setXXXAlpha`
 	if stroke {
 		g.stream.SetColorStroke(color)
@@ -128,14 +145,23 @@ type group struct {
 	cache
 
 	stream cs.GraphicStream
+
+	page int // index of the page the group belongs to, used in diagnostics
+
+	// only used in tagged outputs (see `Output.SetStructure`) :
+	// the sequence opened, for pages, or the text drawn, for groups
+	mark      *markState
+	matched   *StructElement
+	afterRoot bool // for groups, see `markState.afterRoot`
 }
 
-func newGroup(cache cache,
+func newGroup(cache cache, page int,
 	left, top, right, bottom fl,
 ) group {
 	return group{
 		cache:  cache,
 		stream: cs.NewGraphicStream(model.Rectangle{Llx: left, Lly: top, Urx: right, Ury: bottom}), // y grows downward
+		page:   page,
 	}
 }
 
@@ -148,61 +174,104 @@ type outputPage struct {
 	customMediaBox *model.Rectangle // overing bbox
 
 	embeddedFiles map[string]*model.FileSpec
+
+	// optional, the box of the signature field (see `SignatureFieldURL`)
+	signatureRect *model.Rectangle
+
+	// the boxes of the form fields (see `FormFieldURL`)
+	fieldBoxes []fieldBox
+
 	group
 }
 
 func newContextPage(left, top, right, bottom fl,
 	embeddedFiles map[string]*model.FileSpec,
-	cache cache,
+	cache cache, index int,
 ) *outputPage {
 	out := &outputPage{
 		embeddedFiles: embeddedFiles,
-		group:         newGroup(cache, left, top, right, bottom),
+		group:         newGroup(cache, index, left, top, right, bottom),
+	}
+	if cache.tags != nil {
+		out.mark = &markState{}
 	}
 	return out
 }
 
 // update the underlying PageObject with the content stream
 func (cp *outputPage) finalize() {
+	if cp.tags != nil {
+		cp.finalizeStructure()
+	}
 	// the MediaBox is the unsclaled BBox. TODO: why ?
-	cp.stream.ApplyToPageObject(&cp.page, compressStreams)
+	cp.stream.ApplyToPageObject(&cp.page, cp.compressStreams())
 	if cp.customMediaBox != nil {
 		cp.page.MediaBox = cp.customMediaBox
 	}
 }
 
+// top returns the top of the page, in PDF coordinates
+func (cp *outputPage) top() fl {
+	if cp.customMediaBox != nil {
+		return cp.customMediaBox.Ury
+	}
+	return cp.stream.BoundingBox.Ury
+}
+
 func (cp *outputPage) AddInternalLink(xMin, yMin, xMax, yMax fl, anchorName string) {
 	an := model.AnnotationDict{
 		BaseAnnotation: model.BaseAnnotation{
 			Rect: model.Rectangle{Llx: xMin, Lly: yMin, Urx: xMax, Ury: yMax},
+			F:    cp.annotationFlags(),
 		},
 		Subtype: model.AnnotationLink{
 			BS:   &model.BorderStyle{W: model.ObjFloat(0)},
 			Dest: model.DestinationString(anchorName),
 		},
 	}
+	cp.tagAnnotation(&an, "#"+anchorName)
 	cp.page.Annots = append(cp.page.Annots, &an)
 }
 
 func (cp *outputPage) AddExternalLink(xMin, yMin, xMax, yMax fl, url string) {
+	rect := model.Rectangle{Llx: min(xMin, xMax), Lly: min(yMin, yMax), Urx: max(xMin, xMax), Ury: max(yMin, yMax)}
+	if url == SignatureFieldURL {
+		if cp.signatureRect == nil && !cp.streaming {
+			cp.signatureRect = &rect
+		}
+		return
+	}
+	if index, ok := strings.CutPrefix(url, FormFieldURLPrefix); ok {
+		if i, err := strconv.Atoi(index); err == nil && i >= 0 && !cp.streaming {
+			cp.fieldBoxes = append(cp.fieldBoxes, fieldBox{index: i, url: url, rect: rect})
+		}
+		return
+	}
 	an := model.AnnotationDict{
 		BaseAnnotation: model.BaseAnnotation{
 			Rect: model.Rectangle{Llx: xMin, Lly: yMin, Urx: xMax, Ury: yMax},
+			F:    cp.annotationFlags(),
 		},
 		Subtype: model.AnnotationLink{
 			BS: &model.BorderStyle{W: model.ObjFloat(0)},
 			A:  model.Action{ActionType: model.ActionURI{URI: url}},
 		},
 	}
+	cp.tagAnnotation(&an, url)
 	cp.page.Annots = append(cp.page.Annots, &an)
 }
 
 // Add file annotation on the current page
 func (cp *outputPage) AddFileAnnotation(xMin, yMin, xMax, yMax fl, fileID string) {
+	fs := cp.embeddedFiles[fileID]
+	if fs == nil { // dropped, see `Output.EmbedFile`
+		return
+	}
 	rect := model.Rectangle{Llx: xMin, Lly: yMin, Urx: xMax, Ury: yMax}
 	an := model.AnnotationDict{
 		BaseAnnotation: model.BaseAnnotation{
 			Rect: rect,
+			F:    cp.annotationFlags(),
 			AP: &model.AppearanceDict{
 				N: model.AppearanceEntry{"": &model.XObjectForm{
 					BBox: rect,
@@ -210,9 +279,10 @@ func (cp *outputPage) AddFileAnnotation(xMin, yMin, xMax, yMax fl, fileID string
 			},
 		},
 		Subtype: model.AnnotationFileAttachment{
-			FS: cp.embeddedFiles[fileID],
+			FS: fs,
 		},
 	}
+	cp.tagAnnotation(&an, fileID)
 	cp.page.Annots = append(cp.page.Annots, &an)
 }
 
@@ -251,22 +321,38 @@ func (g *group) SetBoundingBox(left, top, right, bottom fl) {
 // If an error is encoutered, the stack is still restored
 // and the error is returned
 func (g *group) OnNewStack(task func()) {
+	// marked-content sequences must not overlap the stack
+	g.closeMark()
+	if g.mark != nil {
+		g.mark.pushStack()
+	}
 	g.stream.SaveState()
 	task()
+	g.closeMark()
 	_ = g.stream.RestoreState() // the calls are balanced
+	if g.mark != nil {
+		g.mark.depth--
+	}
 }
 
 // NewGroup creates a new drawing target with the given
 // bounding box.
 func (g *group) NewGroup(x fl, y fl, width fl, height fl) backend.Canvas {
-	out := newGroup(g.cache, x, y, x+width, y+height)
+	out := newGroup(g.cache, g.page, x, y, x+width, y+height)
+	out.afterRoot = g.isAfterRoot()
 	return &out
 }
 
 // DrawGroup add the `gr` content to the current target. It will panic
 // if `gr` was not created with `AddGroup`
 func (g *group) DrawWithOpacity(opacity fl, gr backend.Canvas) {
-	content := gr.(*group).stream.ToXFormObject(compressStreams)
+	g.markGroup(gr.(*group))
+	content := gr.(*group).stream.ToXFormObject(g.compressStreams())
+	if !g.conformance.allowsTransparency() {
+		g.opaque(opacity)
+		g.stream.AddXObject(content)
+		return
+	}
 	form := &model.XObjectTransparencyGroup{
 		XObjectForm: *content,
 		Group: model.TransparencyGroup{
@@ -280,7 +366,11 @@ func (g *group) DrawWithOpacity(opacity fl, gr backend.Canvas) {
 }
 
 func (g *group) drawMask(app *cs.GraphicStream) {
-	transparency := app.ToXFormObject(compressStreams)
+	if !g.conformance.allowsTransparency() {
+		g.degrade("soft mask", g.page)
+		return
+	}
+	transparency := app.ToXFormObject(g.compressStreams())
 	g.stream.SetAlphaMask(transparency)
 }
 
@@ -288,6 +378,7 @@ func (g *group) drawMask(app *cs.GraphicStream) {
 // at position “(x, y)“ in user-space coordinates.
 // (X,Y) coordinates are the top left corner of the rectangle.
 func (g *group) Rectangle(x fl, y fl, width fl, height fl) {
+	g.markArtifact()
 	g.stream.Ops(cs.OpRectangle{X: x, Y: y, W: width, H: height})
 }
 
@@ -321,6 +412,7 @@ func (g *group) Paint(op backend.PaintOp) {
 // Begin a new sub-path.
 // After this call the current point will be “(x, y)“.
 func (g *group) MoveTo(x fl, y fl) {
+	g.markArtifact()
 	g.stream.Ops(cs.OpMoveTo{X: x, Y: y})
 }
 
@@ -347,16 +439,33 @@ func (g *group) DrawRasterImage(img backend.RasterImage, width fl, height fl) {
 	// check the global cache
 	obj, has := g.images[img.ID]
 	if !has {
-		var err error
-		obj, _, err = cs.ParseImage(img.Content, img.MimeType)
+		// the content may be read several times (see StreamOutput)
+		if seeker, ok := img.Content.(io.Seeker); ok {
+			seeker.Seek(0, io.SeekStart)
+		}
+		shared, err := g.shared.image(img.Content, img.MimeType)
 		if err != nil {
-			log.Printf("failed to process image: %s", err)
+			g.report(diagnostics.Diagnostic{
+				Severity: diagnostics.Warning,
+				Code:     diagnostics.ImageInvalid,
+				Message:  fmt.Sprintf("failed to process image: %s", err),
+				Page:     g.page,
+			})
 			return
 		}
-		obj.Interpolate = img.Rendering == "auto"
+		// the shared image must not be modified
+		copy := *shared
+		copy.Interpolate = img.Rendering == "auto" && g.conformance == NoConformance
+		if copy.SMask != nil && !g.conformance.allowsTransparency() {
+			g.degrade("image transparency", g.page)
+			copy.SMask = nil
+		}
+		obj = &copy
 		g.images[img.ID] = obj
+		g.progress.imageEncoded()
 	}
 
+	g.markImage()
 	g.stream.AddXObjectDims(obj, 0, height, width, -height)
 }
 
@@ -381,6 +490,8 @@ func (g *group) DrawGradient(layout backend.GradientLayout, width fl, height fl)
 
 	sh, alphaSh := grad.BuildShadings()
 
+	g.markArtifact()
+
 	g.Transform(matrix.New(1, 0, 0, layout.ScaleY, 0, 0))
 
 	if alphaSh != nil {
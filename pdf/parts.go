@@ -0,0 +1,239 @@
+package pdf
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/webrender/backend"
+)
+
+var (
+	_ backend.Document = (*Part)(nil)
+	_ backend.Page     = partPage{}
+)
+
+// Part is a backend.Document adding its pages at the end of
+// an Output, so that several documents may be merged in one PDF file.
+// The parts of an Output share the fonts and images.
+//
+// The anchors of a part are namespaced, so that they don't clash with the
+// anchors of the other parts. Links to another part, that is, links whose URL
+// matches the base URL of another part, are resolved as internal links.
+//
+// The metadata (title, authors, etc...) of the first part are used for the output.
+type Part struct {
+	output *Output
+
+	label   string
+	baseUrl *url.URL // may be nil
+
+	index     int // index of the part in the output
+	firstPage int // index of the first page of the part in the output
+}
+
+// NewPart returns a new part, whose pages will follow the ones
+// already added to the output.
+// `label`, if not empty, is used as outline entry for the part, with the part
+// bookmarks as children. `baseUrl` is used to detect links to the part from the
+// other parts.
+func (c *Output) NewPart(label, baseUrl string) *Part {
+	part := &Part{
+		output:    c,
+		label:     label,
+		index:     len(c.parts),
+		firstPage: len(c.pages),
+	}
+	if u, err := url.Parse(baseUrl); err == nil && baseUrl != "" {
+		part.baseUrl = u
+	}
+	c.parts = append(c.parts, part)
+	return part
+}
+
+// anchorName returns the name used in the output for the
+// part anchor `name`
+func (p *Part) anchorName(name string) string {
+	return fmt.Sprintf("part%d/%s", p.index, name)
+}
+
+// matches returns true if `link` (with fragment removed)
+// points to the part.
+func (p *Part) matches(link *url.URL) bool {
+	if p.baseUrl == nil {
+		return false
+	}
+	return link.Scheme == p.baseUrl.Scheme && link.Host == p.baseUrl.Host &&
+		link.Path == p.baseUrl.Path && link.RawQuery == p.baseUrl.RawQuery
+}
+
+func (p *Part) AddPage(left, top, right, bottom fl) backend.Page {
+	page := p.output.AddPage(left, top, right, bottom).(*outputPage)
+	return partPage{outputPage: page, part: p}
+}
+
+func (p *Part) CreateAnchors(anchors [][]backend.Anchor) {
+	// anchors is indexed by the part pages
+	names := &p.output.document.Catalog.Names.Dests.Names
+	for i, l := range anchors {
+		page := p.output.pages[p.firstPage+i]
+		for _, anchor := range l {
+			anchor.Name = p.anchorName(anchor.Name)
+			*names = append(*names, anchorToName(anchor, page))
+		}
+	}
+}
+
+func (p *Part) SetAttachments(as []backend.Attachment) { p.output.addAttachments(as) }
+
+func (p *Part) EmbedFile(fileID string, a backend.Attachment) { p.output.EmbedFile(fileID, a) }
+
+// SetBookmarks shifts the bookmarks to the part pages, and
+// adds them to the output outline.
+func (p *Part) SetBookmarks(root []backend.BookmarkNode) {
+	root = shiftBookmarks(root, p.firstPage)
+	if p.label != "" && p.firstPage < len(p.output.pages) {
+		node := backend.BookmarkNode{
+			Label:     p.label,
+			Children:  root,
+			PageIndex: p.firstPage,
+			Y:         p.output.pages[p.firstPage].top(),
+		}
+		root = []backend.BookmarkNode{node}
+	}
+	p.output.SetBookmarks(append(p.output.bookmarks, root...))
+}
+
+func shiftBookmarks(nodes []backend.BookmarkNode, offset int) []backend.BookmarkNode {
+	out := make([]backend.BookmarkNode, len(nodes))
+	for i, node := range nodes {
+		node.PageIndex += offset
+		node.Children = shiftBookmarks(node.Children, offset)
+		out[i] = node
+	}
+	return out
+}
+
+// the metadata are only set for the first part
+
+func (p *Part) isFirst() bool { return p.index == 0 }
+
+func (p *Part) SetTitle(title string) {
+	if p.isFirst() {
+		p.output.SetTitle(title)
+	}
+}
+
+func (p *Part) SetDescription(description string) {
+	if p.isFirst() {
+		p.output.SetDescription(description)
+	}
+}
+
+func (p *Part) SetCreator(creator string) {
+	if p.isFirst() {
+		p.output.SetCreator(creator)
+	}
+}
+
+func (p *Part) SetAuthors(authors []string) {
+	if p.isFirst() {
+		p.output.SetAuthors(authors)
+	}
+}
+
+func (p *Part) SetKeywords(keywords []string) {
+	if p.isFirst() {
+		p.output.SetKeywords(keywords)
+	}
+}
+
+func (p *Part) SetProducer(producer string) {
+	if p.isFirst() {
+		p.output.SetProducer(producer)
+	}
+}
+
+func (p *Part) SetDateCreation(d time.Time) {
+	if p.isFirst() {
+		p.output.SetDateCreation(d)
+	}
+}
+
+func (p *Part) SetDateModification(d time.Time) {
+	if p.isFirst() {
+		p.output.SetDateModification(d)
+	}
+}
+
+// partPage namespaces the internal links, and
+// records the external links, which may point to another part.
+type partPage struct {
+	*outputPage
+	part *Part
+}
+
+func (pp partPage) AddInternalLink(xMin, yMin, xMax, yMax fl, anchorName string) {
+	pp.outputPage.AddInternalLink(xMin, yMin, xMax, yMax, pp.part.anchorName(anchorName))
+}
+
+func (pp partPage) AddExternalLink(xMin, yMin, xMax, yMax fl, url string) {
+	pp.outputPage.AddExternalLink(xMin, yMin, xMax, yMax, url)
+	if !isFieldURL(url) { // no annotation is added for the fields
+		annot := pp.page.Annots[len(pp.page.Annots)-1]
+		pp.part.output.externalLinks = append(pp.part.output.externalLinks, externalLink{annot, url})
+	}
+}
+
+// externalLink is a link annotation which may be
+// resolved to an internal destination when all the parts are known
+type externalLink struct {
+	annot *model.AnnotationDict
+	url   string
+}
+
+// resolvePartLinks replaces the external links pointing to a part
+// by internal links.
+func (c *Output) resolvePartLinks() {
+	anchors := make(map[string]bool)
+	for _, name := range c.document.Catalog.Names.Dests.Names {
+		anchors[string(name.Name)] = true
+	}
+
+	for _, link := range c.externalLinks {
+		u, err := url.Parse(link.url)
+		if err != nil {
+			continue
+		}
+		for _, part := range c.parts {
+			if !part.matches(u) {
+				continue
+			}
+			var dest model.Destination
+			if u.Fragment == "" { // start of the part
+				if part.firstPage >= len(c.pages) {
+					break
+				}
+				page := c.pages[part.firstPage]
+				dest = model.DestinationExplicitIntern{
+					Page:     &page.page,
+					Location: model.DestinationLocationXYZ{Left: model.ObjFloat(0), Top: model.ObjFloat(page.top())},
+				}
+			} else if name := part.anchorName(u.Fragment); anchors[name] {
+				dest = model.DestinationString(name)
+			} else {
+				break // keep the external link
+			}
+			link.annot.Subtype = model.AnnotationLink{
+				BS:   &model.BorderStyle{W: model.ObjFloat(0)},
+				Dest: dest,
+			}
+			break
+		}
+	}
+
+	names := c.document.Catalog.Names.Dests.Names
+	sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+}
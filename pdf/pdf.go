@@ -2,11 +2,15 @@
 package pdf
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/progress"
 	"github.com/benoitkugler/pdf/model"
 	"github.com/benoitkugler/webrender/backend"
 	"github.com/benoitkugler/webrender/text"
@@ -17,9 +21,6 @@ var (
 	_ backend.Page     = (*outputPage)(nil)
 )
 
-// may be set to false when debugging
-const compressStreams = false
-
 type fontContent struct {
 	content []byte
 	// bitmap fonts are not supported by PDF readers
@@ -37,6 +38,74 @@ type cache struct {
 	// The same face may be used at different sizes
 	// and we don't want to duplicate the font file
 	fontFiles map[text.FontOrigin]fontContent
+
+	// pages using each font, so that the fonts
+	// of the dropped pages are not embedded (see `Output.SetPageSelection`)
+	fontPages map[backend.Font]map[int]bool
+
+	// optional, see `Output.SetDiagnostics`
+	diagnostics *diagnostics.Collector
+
+	// optional, see `Output.SetSharedCache`
+	shared *SharedCache
+
+	// optional, see `Output.SetProgress`
+	progress *progressState
+
+	// see `Output.SetCompression`
+	compression Compression
+
+	// see `Output.SetConformance`
+	conformance       Conformance
+	conformanceIssues map[string]bool // already reported, see `degrade`
+
+	// optional, see `Output.SetStructure`
+	tags *tagger
+
+	// true for `StreamOutput`, which does not support the signature and form fields
+	streaming bool
+}
+
+// progressState is shared by the pages of an output.
+type progressState struct {
+	callback  progress.Func
+	pageCount int // 0 if unknown
+	images    int // number of images encoded so far
+}
+
+// report forwards to the callback, if any
+func (ps *progressState) report(phase progress.Phase, current, total int) {
+	if ps == nil {
+		return
+	}
+	ps.callback.Report(phase, current, total)
+}
+
+// drawing reports that `pages` pages have been drawn
+func (ps *progressState) drawing(pages int) {
+	if ps == nil {
+		return
+	}
+	ps.callback.Report(progress.Drawing, pages, ps.pageCount)
+}
+
+// imageEncoded reports a new image
+func (ps *progressState) imageEncoded() {
+	if ps == nil {
+		return
+	}
+	ps.images++
+	ps.callback.Report(progress.ImageEncoding, ps.images, 0)
+}
+
+// report adds `d` to the diagnostics, or, if no collector
+// is set, logs its message.
+func (c cache) report(d diagnostics.Diagnostic) {
+	if c.diagnostics == nil {
+		log.Print(d.Message)
+		return
+	}
+	c.diagnostics.Add(d)
 }
 
 func newCache() cache {
@@ -44,6 +113,9 @@ func newCache() cache {
 		images:    make(map[int]*model.XObjectImage),
 		fonts:     make(map[backend.Font]pdfFont),
 		fontFiles: make(map[text.FontOrigin]fontContent),
+		fontPages: make(map[backend.Font]map[int]bool),
+
+		conformanceIssues: make(map[string]bool),
 	}
 }
 
@@ -59,18 +131,119 @@ type Output struct {
 
 	// temporary content, will be copied in the document (see `finalize`)
 	pages []*outputPage
+
+	// optional, checked between pages
+	ctx context.Context
+
+	// index of the page being drawn or finalized, or -1
+	currentPage int
+
+	// optional, see `SetPageSelection`
+	selection PageSelection
+
+	// as registered by `CreateAnchors` and `SetBookmarks`
+	anchors   [][]backend.Anchor
+	bookmarks []backend.BookmarkNode
+
+	// as registered by `SetAuthors` and `SetKeywords`,
+	// and overridden by `SetMetadata`
+	authors, keywords []string
+	metadata          Metadata
+
+	// the XMP packet, built by `Finalize`
+	xmp []byte
+
+	// used when merging several documents, see `NewPart`
+	parts         []*Part
+	externalLinks []externalLink
+
+	// see `SetFormFields`
+	formFields []FormField
+
+	// see `SetSignatureField`
+	signatureField bool
+
+	// see `SetPageLabels`
+	pageLabels []PageLabel
+
+	// see `SetViewerPreferences` and `SetDirection`
+	viewerPreferences ViewerPreferences
+	direction         Direction
 }
 
 func NewOutput() *Output {
 	out := Output{
 		embeddedFiles: make(map[string]*model.FileSpec),
 		cache:         newCache(),
+		currentPage:   -1,
 	}
 	return &out
 }
 
+// SetDiagnostics registers a collector for the issues found when drawing and
+// finalizing the document, which are otherwise logged.
+// It must be called before adding pages.
+func (c *Output) SetDiagnostics(collector *diagnostics.Collector) {
+	c.cache.diagnostics = collector
+}
+
+// SetSharedCache registers a cache for the images and fonts, shared
+// with other outputs.
+// It must be called before adding pages.
+func (c *Output) SetSharedCache(shared *SharedCache) {
+	c.cache.shared = shared
+}
+
+// SetProgress registers a callback reporting the drawing of the pages,
+// the encoding of the images and the subsetting of the fonts.
+// `pageCount` is the number of pages which will be drawn, or 0 if unknown.
+// It must be called before adding pages.
+func (c *Output) SetProgress(callback progress.Func, pageCount int) {
+	c.cache.progress = &progressState{callback: callback, pageCount: pageCount}
+}
+
+// CurrentPage returns the 0-based index of the page being drawn or finalized,
+// or -1 if the output is not currently processing a page.
+// It is meant to provide context when recovering from a panic.
+func (c *Output) CurrentPage() int { return c.currentPage }
+
+// NewOutputContext is the same as NewOutput, but the drawing is
+// aborted once `ctx` is done.
+//
+// Since the `backend.Document` interface does not return errors,
+// cancellation is reported by `AddPage` and `Finalize` (or `Close` for
+// a `StreamOutput`) panicking with the value returned by `ctx.Err()`.
+// Thus, the callers must recover this value, with a deferred function
+// registered before using the output, and compare it with `ctx.Err()`:
+//
+//	defer func() {
+//		if r := recover(); r != nil && r == any(ctx.Err()) {
+//			err = ctx.Err()
+//		} else if r != nil {
+//			panic(r)
+//		}
+//	}()
+func NewOutputContext(ctx context.Context) *Output {
+	out := NewOutput()
+	out.ctx = ctx
+	return out
+}
+
+// checkContext panics with ctx.Err() if the context is done.
+func (c *Output) checkContext() {
+	if c.ctx == nil {
+		return
+	}
+	if err := c.ctx.Err(); err != nil {
+		panic(err)
+	}
+}
+
 func (c *Output) AddPage(left, top, right, bottom fl) backend.Page {
-	out := newContextPage(left, top, right, bottom, c.embeddedFiles, c.cache)
+	c.checkContext()
+	c.currentPage = len(c.pages)
+	c.cache.progress.drawing(c.currentPage)
+	out := newContextPage(left, top, right, bottom, c.embeddedFiles, c.cache, c.currentPage)
 	c.pages = append(c.pages, out)
 	return out
 }
@@ -88,10 +261,12 @@ func (s *Output) SetCreator(creator string) {
 }
 
 func (s *Output) SetAuthors(authors []string) {
+	s.authors = authors
 	s.document.Trailer.Info.Author = strings.Join(authors, ", ")
 }
 
 func (s *Output) SetKeywords(keywords []string) {
+	s.keywords = keywords
 	s.document.Trailer.Info.Keywords = strings.Join(keywords, ", ")
 }
 
@@ -109,21 +284,13 @@ func (s *Output) SetDateModification(d time.Time) {
 
 func (c *Output) CreateAnchors(anchors [][]backend.Anchor) {
 	// pages have been processed, meaning that len(anchors) == len(c.pages)
+	c.anchors = anchors
 
 	var names []model.NameToDest
 	for i, l := range anchors {
 		page := c.pages[i]
 		for _, anchor := range l {
-			names = append(names, model.NameToDest{
-				Name: model.DestinationString(anchor.Name),
-				Destination: model.DestinationExplicitIntern{
-					Page: &page.page,
-					Location: model.DestinationLocationXYZ{
-						Left: model.ObjFloat(anchor.X),
-						Top:  model.ObjFloat(anchor.Y),
-					},
-				},
-			})
+			names = append(names, anchorToName(anchor, page))
 		}
 	}
 
@@ -132,6 +299,23 @@ func (c *Output) CreateAnchors(anchors [][]backend.Anchor) {
 	c.document.Catalog.Names.Dests.Names = names
 }
 
+// Anchors returns the anchors registered by the last call to `CreateAnchors`,
+// indexed by page.
+func (c *Output) Anchors() [][]backend.Anchor { return c.anchors }
+
+func anchorToName(anchor backend.Anchor, page *outputPage) model.NameToDest {
+	return model.NameToDest{
+		Name: model.DestinationString(anchor.Name),
+		Destination: model.DestinationExplicitIntern{
+			Page: &page.page,
+			Location: model.DestinationLocationXYZ{
+				Left: model.ObjFloat(anchor.X),
+				Top:  model.ObjFloat(anchor.Y),
+			},
+		},
+	}
+}
+
 // embedded files
 
 func newFileSpec(a backend.Attachment) *model.FileSpec {
@@ -149,11 +333,21 @@ func newFileSpec(a backend.Attachment) *model.FileSpec {
 
 // Add global attachments to the file, which are compressed using FlateDecode filter
 func (c *Output) SetAttachments(as []backend.Attachment) {
-	var files model.EmbeddedFileTree
-	for i, a := range as {
+	c.document.Catalog.Names.EmbeddedFiles = nil
+	c.addAttachments(as)
+}
+
+// addAttachments appends to the current global attachments
+func (c *Output) addAttachments(as []backend.Attachment) {
+	if len(as) != 0 && !c.cache.conformance.allowsAttachments() {
+		c.cache.degrade("attachment", -1)
+		return
+	}
+	files := c.document.Catalog.Names.EmbeddedFiles
+	for _, a := range as {
 		fs := newFileSpec(a)
 		files = append(files, model.NameToFile{
-			Name:     fmt.Sprintf("attachement_%d", i),
+			Name:     fmt.Sprintf("attachement_%d", len(files)),
 			FileSpec: fs,
 		})
 	}
@@ -170,6 +364,10 @@ func (c *Output) EmbedFile(fileID string, a backend.Attachment) {
 	if ptr != nil {
 		return
 	}
+	if !c.cache.conformance.allowsAttachments() {
+		c.cache.degrade("attachment", c.currentPage)
+		return
+	}
 
 	c.embeddedFiles[fileID] = newFileSpec(a)
 }
@@ -214,22 +412,74 @@ func bookmarksToOutline(root []backend.BookmarkNode, pages []*outputPage) *model
 }
 
 func (c *Output) SetBookmarks(root []backend.BookmarkNode) {
+	c.bookmarks = root
 	c.document.Catalog.Outlines = bookmarksToOutline(root, c.pages)
 }
 
-// Finalize setup and returns the final document
+// Finalize setup and returns the final document.
+// It also builds the XMP metadata packet, in sync with the document information dictionary
+// (see `XMPMetadata`). Since model.Catalog has no Metadata entry, the packet is attached
+// to the catalog by `Write`, which must be used to serialize the document.
 func (c *Output) Finalize() model.Document {
-	pages := make([]model.PageNode, len(c.pages))
-	for i, p := range c.pages {
+	c.cache.progress.drawing(len(c.pages))
+	kept, newIndices := c.keptPages()
+	pages := make([]model.PageNode, len(kept))
+	c.addSignatureField(kept)
+	c.addFormFields(kept)
+	for i, p := range kept {
+		c.checkContext()
+		c.currentPage = p.group.page
 		p.finalize()
 		pages[i] = &p.page
 	}
+	c.currentPage = -1
 	c.document.Catalog.Pages = model.PageTree{
 		Kids: pages,
 	}
+	indices := make([]int, len(kept))
+	for i, p := range kept {
+		indices[i] = p.group.page
+	}
+	c.document.Catalog.PageLabels = c.pageLabelsTree(indices)
+	var first *model.PageObject
+	if len(kept) != 0 {
+		first = &kept[0].page
+	}
+	c.setCatalogPreferences(first)
+
+	if len(c.parts) != 0 {
+		c.resolvePartLinks()
+	}
+
+	if !c.selection.IsAll() {
+		c.pruneDestinations(kept)
+		if c.document.Catalog.Outlines != nil {
+			c.document.Catalog.Outlines = bookmarksToOutline(pruneBookmarks(c.bookmarks, newIndices), kept)
+		}
+	}
 
 	// fonts
-	c.writeFonts()
+	c.writeFonts(newIndices)
+
+	if c.cache.conformance == PDFA1B && c.cache.compression == OptimizeSize {
+		c.cache.degrade("object stream", -1)
+	}
+
+	c.applyMetadata()
+
+	if c.cache.tags != nil {
+		pages := make(map[int]*model.PageObject, len(kept))
+		for _, p := range kept {
+			pages[p.group.page] = &p.page
+		}
+		c.setStructure(pages)
+	}
+
+	c.xmp = c.xmpMetadata()
 
 	return c.document
 }
+
+// XMPMetadata returns the XMP metadata packet built by `Finalize`, in sync with the
+// document information dictionary, to be given to `WriteOptions.Metadata`.
+func (c *Output) XMPMetadata() []byte { return c.xmp }
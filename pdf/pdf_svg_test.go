@@ -10,7 +10,7 @@ import (
 )
 
 func drawStandaloneSVG(t *testing.T, input string, outFile string) {
-	dst := newGroup(newCache(), 0, 0, 600, 600)
+	dst := newGroup(newCache(), 0, 0, 0, 600, 600)
 	dst.Transform(matrix.New(1, 0, 0, -1, 0, 600)) // SVG use "mathematical conventions"
 	img, err := svg.Parse(strings.NewReader(input), "", nil, nil)
 	if err != nil {
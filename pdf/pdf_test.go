@@ -2,27 +2,49 @@ package pdf
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
 	"github.com/benoitkugler/go-weasyprint/pdf/test"
 	"github.com/benoitkugler/pdf/model"
 	"github.com/benoitkugler/pdf/reader"
 	pdfParser "github.com/benoitkugler/pdf/reader/parser"
 	"github.com/benoitkugler/webrender/backend"
 	"github.com/benoitkugler/webrender/css/parser"
+	"github.com/benoitkugler/webrender/html/document"
+	"github.com/benoitkugler/webrender/html/tree"
 	"github.com/benoitkugler/webrender/logger"
 	"github.com/benoitkugler/webrender/matrix"
+	"github.com/benoitkugler/webrender/text"
 	"github.com/benoitkugler/webrender/utils"
 	"github.com/benoitkugler/webrender/utils/testutils"
 )
@@ -61,6 +83,20 @@ func TestPaint(t *testing.T) {
 	}
 }
 
+func TestOutputContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewOutputContext(ctx)
+	c.AddPage(0, 200, 100, 0)
+	cancel()
+
+	defer func() {
+		if r := recover(); r != context.Canceled {
+			t.Fatalf("expected context.Canceled panic, got %v", r)
+		}
+	}()
+	c.AddPage(0, 200, 100, 0)
+}
+
 func TestGradientOp(t *testing.T) {
 	c := NewOutput()
 	page := c.AddPage(0, 200, 100, 0)
@@ -1078,3 +1114,716 @@ func TestBleed(t *testing.T) {
 		}
 	}
 }
+
+func TestParts(t *testing.T) {
+	capt := testutils.CaptureLogs()
+	defer capt.AssertNoLogs(t)
+
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := NewOutput()
+	for _, part := range [...]struct {
+		label, html, baseUrl string
+	}{
+		{"Part 1", `<h1>A</h1><img src="../resources_test/blue.jpg">
+			<a style="display: block" href="part2.html#target">link</a>
+			<a style="display: block" href="part2.html">link</a>
+			<a style="display: block" href="#local">link</a>
+			<p id="local">local</p>`, "part1.html"},
+		{"Part 2", `<h1>B</h1><img src="../resources_test/blue.jpg">
+			<p id="local">local</p><p id="target">target</p>`, "part2.html"},
+	} {
+		parsedHtml, err := tree.NewHTML(utils.InputString(part.html), "file://"+filepath.ToSlash(dir)+"/"+part.baseUrl, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsedHtml.UAStyleSheet = tree.TestUAStylesheet
+		doc := document.Render(parsedHtml, nil, false, fontconfig)
+		doc.Write(output.NewPart(part.label, parsedHtml.BaseUrl), 1, nil)
+	}
+	pdf := output.Finalize()
+
+	pages := pdf.Catalog.Pages.Flatten()
+	if len(pages) != 2 {
+		t.Fatalf("expected 2 pages, got %d", len(pages))
+	}
+
+	// anchors are namespaced
+	names := pdf.Catalog.Names.Dests.LookupTable()
+	if len(names) != 3 {
+		t.Fatalf("unexpected destinations %v", names)
+	}
+	for _, name := range [...]string{"part0/local", "part1/local", "part1/target"} {
+		if _, has := names[model.DestinationString(name)]; !has {
+			t.Fatalf("missing destination %s", name)
+		}
+	}
+
+	// links to the other part are internal
+	annots := pages[0].Annots
+	if len(annots) != 3 {
+		t.Fatalf("expected 3 annotations, got %d", len(annots))
+	}
+	if dest := annots[0].Subtype.(model.AnnotationLink).Dest; dest != model.DestinationString("part1/target") {
+		t.Fatalf("unexpected destination %v", dest)
+	}
+	if dest := annots[1].Subtype.(model.AnnotationLink).Dest.(model.DestinationExplicitIntern); dest.Page != pages[1] {
+		t.Fatalf("unexpected destination %v", dest)
+	}
+	if dest := annots[2].Subtype.(model.AnnotationLink).Dest; dest != model.DestinationString("part0/local") {
+		t.Fatalf("unexpected destination %v", dest)
+	}
+
+	// bookmarks are nested
+	outline := pdf.Catalog.Outlines
+	if outline.First.Title != "Part 1" || outline.First.First.Title != "A" ||
+		outline.First.Next.Title != "Part 2" || outline.First.Next.First.Title != "B" {
+		t.Fatal("unexpected outline")
+	}
+
+	// the image is shared
+	if bytes.Count(modelToBytes(t, pdf), []byte("/Filter [/DCTDecode]")) != 1 {
+		t.Fatal("image embedded twice")
+	}
+}
+
+type invalidFont struct{}
+
+func (invalidFont) Origin() text.FontOrigin { return text.FontOrigin{File: "invalid.ttf"} }
+
+func (invalidFont) Description() backend.FontDescription { return backend.FontDescription{} }
+
+func TestDiagnostics(t *testing.T) {
+	var diags diagnostics.Collector
+	output := NewOutput()
+	output.SetDiagnostics(&diags)
+	output.AddPage(0, 0, 10, 10)
+	page := output.AddPage(0, 0, 10, 10)
+
+	page.AddFont(invalidFont{}, []byte("invalid font"))
+	page.DrawRasterImage(backend.RasterImage{Content: strings.NewReader("invalid image"), MimeType: "image/png", ID: 1}, 10, 10)
+	output.Finalize()
+
+	ds := diags.Diagnostics()
+	if len(ds) != 2 {
+		t.Fatalf("unexpected diagnostics %v", ds)
+	}
+	if d := ds[0]; d.Code != diagnostics.FontUnsupported || d.Page != 1 || d.URL != "invalid.ttf" {
+		t.Fatalf("unexpected diagnostic %v", d)
+	}
+	if d := ds[1]; d.Code != diagnostics.ImageInvalid || d.Page != 1 {
+		t.Fatalf("unexpected diagnostic %v", d)
+	}
+}
+
+func TestParsePageSelection(t *testing.T) {
+	for _, test := range [...]struct {
+		input    string
+		count    int
+		expected []bool
+	}{
+		{"1", 3, []bool{true, false, false}},
+		{"1-2, last", 4, []bool{true, true, false, true}},
+		{"2-last", 3, []bool{false, true, true}},
+		{"last", 1, []bool{true}},
+		{"1-3,7", 4, []bool{true, true, true, false}},
+		{"3,1", 3, []bool{true, false, true}},
+	} {
+		sel, err := ParsePageSelection(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.selected(test.count); !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.input, test.expected, got)
+		}
+	}
+
+	for _, input := range [...]string{"", "0", "a", "3-1", "last-2", "1-2-3", "1,,-2"} {
+		if _, err := ParsePageSelection(input); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestPageSelection(t *testing.T) {
+	capt := testutils.CaptureLogs()
+	defer capt.AssertNoLogs(t)
+
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedHtml, err := tree.NewHTML(utils.InputString(`
+		<style>
+			@font-face {src: url(../resources_test/weasyprint.otf); font-family: weasyprint}
+			h1, h2 { break-before: page }
+		</style>
+		<p>A</p>
+		<a style="display: block" href="#b">link</a>
+		<a style="display: block" href="#c">link</a>
+		<h1 id="b" style="font-family: weasyprint">B</h1>
+		<h2 id="c">C</h2>
+		<h1 id="d">D</h1>
+	`), "file://"+filepath.ToSlash(dir)+"/", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedHtml.UAStyleSheet = tree.TestUAStylesheet
+	doc := document.Render(parsedHtml, nil, false, fontconfig)
+
+	output := NewOutput()
+	sel, err := ParsePageSelection("1,3-last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.SetPageSelection(sel)
+	doc.Write(output, 1, nil)
+	pdf := output.Finalize()
+
+	pages := pdf.Catalog.Pages.Flatten()
+	if len(pages) != 3 {
+		t.Fatalf("expected 3 pages, got %d", len(pages))
+	}
+
+	names := pdf.Catalog.Names.Dests.LookupTable()
+	if len(names) != 2 || names["c"] == nil || names["d"] == nil {
+		t.Fatalf("unexpected destinations %v", names)
+	}
+	if annots := pages[0].Annots; len(annots) != 1 || annots[0].Subtype.(model.AnnotationLink).Dest != model.DestinationString("c") {
+		t.Fatalf("unexpected annotations %v", annots)
+	}
+
+	// B is redirected to its child C
+	outline := pdf.Catalog.Outlines
+	if b := outline.First; b.Title != "B" || b.Dest.(model.DestinationExplicitIntern).Page != pages[1] ||
+		b.First.Title != "C" || b.Next.Title != "D" || b.Next.Dest.(model.DestinationExplicitIntern).Page != pages[2] {
+		t.Fatalf("unexpected outline %v", outline.First)
+	}
+
+	// the font of the dropped page is not embedded
+	for font, pf := range output.cache.fonts {
+		if font.Description().Family == "weasyprint" && pf.FontDict.Subtype != nil {
+			t.Fatal("unexpected embedded font")
+		}
+	}
+
+	if err := pdf.Write(io.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamOutput(t *testing.T) {
+	capt := testutils.CaptureLogs()
+	defer capt.AssertNoLogs(t)
+
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var html strings.Builder
+	html.WriteString(`<style>
+		@font-face {src: url(../resources_test/weasyprint.otf); font-family: weasyprint}
+		h1 { break-before: page }
+	</style>
+	<a href="#h3">link</a>`)
+	for i := range 5 {
+		fmt.Fprintf(&html, `<h1 id="h%d">Chapter %d</h1><p><img src="../resources_test/pattern.png"></p><p style="font-family: weasyprint">text</p>`, i, i)
+	}
+	parsedHtml, err := tree.NewHTML(utils.InputString(html.String()), "file://"+filepath.ToSlash(dir)+"/", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedHtml.UAStyleSheet = tree.TestUAStylesheet
+	doc := document.Render(parsedHtml, nil, false, fontconfig)
+
+	var buf bytes.Buffer
+	output := NewStreamOutput(&buf)
+	doc.Write(output, 1, []backend.Attachment{{Title: "data.txt", Content: []byte("some data")}})
+	if err = output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the pages content is released
+	for _, page := range output.output.pages {
+		if len(page.page.Contents) != 0 {
+			t.Fatal("page content should be released")
+		}
+	}
+	if len(output.output.cache.images) != 0 {
+		t.Fatal("images should be released")
+	}
+
+	pdf, _, err := reader.ParsePDFReader(bytes.NewReader(buf.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := pdf.Catalog.Pages.Flatten()
+	if len(pages) != 6 {
+		t.Fatalf("expected 6 pages, got %d", len(pages))
+	}
+	names := pdf.Catalog.Names.Dests.LookupTable()
+	if len(names) != 5 || names["h3"].(model.DestinationExplicitIntern).Page != pages[4] {
+		t.Fatalf("unexpected destinations %v", names)
+	}
+	if link := pages[0].Annots[0].Subtype.(model.AnnotationLink); link.Dest != model.DestinationString("h3") {
+		t.Fatalf("unexpected link %v", link)
+	}
+	var titles []string
+	for item := pdf.Catalog.Outlines.First; item != nil; item = item.Next {
+		titles = append(titles, item.Title)
+	}
+	if len(titles) != 5 || pdf.Catalog.Outlines.First.Next.Dest.(model.DestinationExplicitIntern).Page != pages[2] {
+		t.Fatalf("unexpected outline %v", titles)
+	}
+	if len(pdf.Catalog.Names.EmbeddedFiles) != 1 {
+		t.Fatal("missing attachment")
+	}
+
+	// shared resources are only written once
+	fonts, images := map[*model.FontDict]bool{}, map[*model.XObjectImage]bool{}
+	for _, page := range pages[1:] {
+		for _, font := range page.Resources.Font {
+			fonts[font] = true
+			if font.Subtype.(model.FontType0).DescendantFonts.FontDescriptor.FontFile == nil {
+				t.Fatal("missing font file")
+			}
+		}
+		hasImage := false
+		for _, xobject := range page.Resources.XObject {
+			if img, ok := xobject.(*model.XObjectImage); ok {
+				images[img] = true
+				hasImage = true
+			}
+		}
+		if !hasImage {
+			t.Fatal("missing image")
+		}
+	}
+	if len(fonts) != 2 || len(images) != 1 {
+		t.Fatalf("expected 2 fonts and 1 image, got %d and %d", len(fonts), len(images))
+	}
+}
+
+func TestSharedCacheEviction(t *testing.T) {
+	sc := NewSharedCache(10)
+	sc.add([32]byte{1}, 1, 4)
+	sc.add([32]byte{2}, 2, 4)
+	sc.get([32]byte{1}) // 2 is now the least recently used
+	sc.add([32]byte{3}, 3, 4)
+	if sc.Len() != 2 || sc.Size() != 8 {
+		t.Fatalf("unexpected cache content: %d entries, %d bytes", sc.Len(), sc.Size())
+	}
+	if _, ok := sc.get([32]byte{2}); ok {
+		t.Fatal("entry should have been evicted")
+	}
+	sc.add([32]byte{4}, 4, 11) // too large
+	if _, ok := sc.get([32]byte{4}); ok {
+		t.Fatal("entry should not be stored")
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	capt := testutils.CaptureLogs()
+	defer capt.AssertNoLogs(t)
+
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(text string) document.Document {
+		parsedHtml, err := tree.NewHTML(utils.InputString(`
+		<style>@font-face {src: url(../resources_test/weasyprint.otf); font-family: weasyprint}</style>
+		<img src="../resources_test/pattern.png"><p style="font-family: weasyprint">`+text+`</p>`),
+			"file://"+filepath.ToSlash(dir)+"/", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsedHtml.UAStyleSheet = tree.TestUAStylesheet
+		return document.Render(parsedHtml, nil, false, fontconfig)
+	}
+	sc := NewSharedCache(0)
+	draw := func(doc document.Document) map[backend.GID][]rune {
+		output := NewOutput()
+		output.SetSharedCache(sc)
+		doc.Write(output, 1, nil)
+		pdf := output.Finalize()
+		if err := pdf.Write(io.Discard, nil); err != nil {
+			t.Error(err)
+		}
+		for font, pf := range output.cache.fonts {
+			if font.Description().Family == "weasyprint" {
+				return pf.Cmap
+			}
+		}
+		return nil
+	}
+
+	draw(render("abc"))
+	L := sc.Len()
+	if L == 0 {
+		t.Fatal("expected cached image and fonts")
+	}
+	fontFile, err := os.ReadFile("../resources_test/weasyprint.otf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sc.get(contentKey("font", fontFile)); !ok {
+		t.Fatal("expected cached font file")
+	}
+
+	// the layout is not safe for concurrent use, but the drawing is
+	texts := []string{"a", "ab", "abc", "abcd"}
+	docs := make([]document.Document, len(texts))
+	for i, text := range texts {
+		docs[i] = render(text)
+	}
+	cmaps := make([]map[backend.GID][]rune, len(texts))
+	var wg sync.WaitGroup
+	for i, doc := range docs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmaps[i] = draw(doc)
+		}()
+	}
+	wg.Wait()
+
+	if sc.Len() != L {
+		t.Fatalf("expected %d cache entries, got %d", L, sc.Len())
+	}
+	// each document only embeds its glyphs
+	for i, text := range texts {
+		if len(cmaps[i]) != len(text) {
+			t.Fatalf("unexpected glyphs for %s: %v", text, cmaps[i])
+		}
+	}
+}
+
+func TestEncryptionAES256(t *testing.T) {
+	decrypt := func(key, data []byte) []byte {
+		block, _ := aes.NewCipher(key)
+		out := make([]byte, len(data)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(out, data[aes.BlockSize:])
+		return out[:len(out)-int(out[len(out)-1])] // remove the padding
+	}
+
+	enc := Encryption{UserPassword: "user", OwnerPassword: "owner", Permissions: PermitPrint}
+	e, err := newEncryptor(enc, []byte("0123456789abcdef"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, o := []byte(e.dict["U"].(model.ObjHexLiteral)), []byte(e.dict["O"].(model.ObjHexLiteral))
+	ue, oe := []byte(e.dict["UE"].(model.ObjHexLiteral)), []byte(e.dict["OE"].(model.ObjHexLiteral))
+
+	// validate the passwords and retrieve the file key (algorithms 2.A, 11 and 12)
+	if !bytes.Equal(hash2B([]byte("user"), u[32:40], nil), u[:32]) {
+		t.Fatal("invalid user hash")
+	}
+	if !bytes.Equal(hash2B([]byte("owner"), o[32:40], u[:48]), o[:32]) {
+		t.Fatal("invalid owner hash")
+	}
+	decryptKey := func(key, data []byte) []byte {
+		block, _ := aes.NewCipher(key)
+		out := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, data)
+		return out
+	}
+	userKey := decryptKey(hash2B([]byte("user"), u[40:48], nil), ue)
+	ownerKey := decryptKey(hash2B([]byte("owner"), o[40:48], u[:48]), oe)
+	if !bytes.Equal(userKey, e.key) || !bytes.Equal(ownerKey, e.key) {
+		t.Fatal("invalid file key")
+	}
+
+	block, _ := aes.NewCipher(e.key)
+	perms := []byte(e.dict["Perms"].(model.ObjHexLiteral))
+	block.Decrypt(perms, perms)
+	if string(perms[9:12]) != "adb" || int32(binary.LittleEndian.Uint32(perms)) != int32(e.dict["P"].(model.ObjInt)) {
+		t.Fatalf("invalid Perms %v", perms)
+	}
+
+	obj, err := e.encryptObject(4, model.ObjStream{
+		Args:    model.ObjDict{"Title": model.ObjStringLiteral("title")},
+		Content: []byte("BT (Hello) Tj ET"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := obj.(model.ObjStream)
+	if s := decrypt(e.key, []byte(stream.Content)); string(s) != "BT (Hello) Tj ET" {
+		t.Fatalf("unexpected content %q", s)
+	}
+	if s := decrypt(e.key, []byte(stream.Args["Title"].(model.ObjHexLiteral))); string(s) != "title" {
+		t.Fatalf("unexpected string %q", s)
+	}
+
+	output := NewOutput()
+	output.AddPage(0, 0, 200, 200)
+	doc := output.Finalize()
+	if err := Write(doc, io.Discard, WriteOptions{Encryption: &Encryption{UserPassword: "user"}, Compression: OptimizeSize}); err == nil {
+		t.Fatal("expected error for encrypted object streams")
+	}
+}
+
+// parseSignedData parses a CMS ContentInfo of type SignedData
+func parseSignedData(t *testing.T, der []byte) signedDataContent {
+	var (
+		info contentInfo
+		sd   signedDataContent
+	)
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	return sd
+}
+
+func TestSignatureTimestamp(t *testing.T) {
+	newCertificate := func(name string) (*ecdsa.PrivateKey, *x509.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, cert
+	}
+	key, cert := newCertificate("Signer")
+	tsaKey, tsaCert := newCertificate("TSA")
+
+	// a minimal time stamping authority
+	status, tamper := 0, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(body, &req); err != nil || r.Header.Get("Content-Type") != "application/timestamp-query" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		info := tstInfo{
+			Version: 1, Policy: asn1.ObjectIdentifier{1, 2, 3}, MessageImprint: req.MessageImprint,
+			SerialNumber: big.NewInt(1), GenTime: time.Now().UTC().Truncate(time.Second), Nonce: req.Nonce,
+			Accuracy: accuracy{Seconds: 1},
+		}
+		switch tamper {
+		case "nonce": // replayed token
+			info.Nonce = new(big.Int).Add(req.Nonce, big.NewInt(1))
+		case "imprint":
+			info.MessageImprint.HashedMessage = make([]byte, len(req.MessageImprint.HashedMessage))
+		}
+		content, _ := asn1.Marshal(info)
+		digest := sha256.Sum256(content)
+		token, err := signedData(oidTSTInfo, content, digest[:], tsaKey, []*x509.Certificate{tsaCert}, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, _ := asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: status}, TimeStampToken: asn1.RawValue{FullBytes: token}})
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	output := NewOutput()
+	page := output.AddPage(0, 0, 200, 200)
+	output.SetSignatureField(true)
+	page.AddExternalLink(10, 10, 100, 50, SignatureFieldURL)
+	doc := output.Finalize()
+
+	signature := &Signature{
+		Signer: key, Certificates: []*x509.Certificate{cert},
+		Timestamper: TSAClient{URL: server.URL},
+	}
+	var buf bytes.Buffer
+	if err := Write(doc, &buf, WriteOptions{Signature: signature}); err != nil {
+		t.Fatal(err)
+	}
+
+	file := buf.Bytes()
+	start := bytes.Index(file, []byte("/Contents <")) + len("/Contents <")
+	end := start + bytes.IndexByte(file[start:], '>')
+	contents, err := hex.DecodeString(string(file[start:end]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := parseSignedData(t, contents).SignerInfos[0]
+	signedAttrs := append([]byte{0x31}, signer.SignedAttrs.FullBytes[1:]...)
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, signedAttrs, signer.Signature); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token timestamps the signature value
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(append([]byte{0x31}, signer.UnsignedAttrs.FullBytes[1:]...), &attrs, "set"); err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 1 || !attrs[0].Type.Equal(oidTimeStampToken) {
+		t.Fatalf("unexpected unsigned attributes %v", attrs)
+	}
+	token := parseSignedData(t, attrs[0].Values[0].FullBytes)
+	var info tstInfo
+	if _, err := asn1.Unmarshal(token.EncapContentInfo.EContent, &info); err != nil {
+		t.Fatal(err)
+	}
+	if digest := sha256.Sum256(signer.Signature); !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		t.Fatal("the timestamp does not match the signature")
+	}
+
+	for _, tamper = range []string{"nonce", "imprint"} {
+		if err := Write(doc, io.Discard, WriteOptions{Signature: signature}); err == nil {
+			t.Fatalf("expected error for invalid %s", tamper)
+		}
+	}
+
+	tamper = ""
+	status = 2 // rejection
+	if err := Write(doc, io.Discard, WriteOptions{Signature: signature}); err == nil {
+		t.Fatal("expected error for rejected timestamp request")
+	}
+}
+
+func TestEscapeWinAnsi(t *testing.T) {
+	for input, expected := range map[string]string{
+		"Jane (Doe)": `Jane \(Doe\)`,
+		"Café":       `Caf\351`,
+		"“10 €”":     `\22310 \200\224`,
+		"Zoë – 日本":   `Zo\353 \226 ??`,
+	} {
+		if got := escapeWinAnsi(input); got != expected {
+			t.Fatalf("for %s, expected %s, got %s", input, expected, got)
+		}
+	}
+}
+
+func TestXMPPacket(t *testing.T) {
+	doc := xmpDocument{
+		info:     model.Info{Title: "A & B", Keywords: "one, two"},
+		keywords: []string{"one", "two"},
+		namespaces: []XMPNamespace{
+			{Prefix: "inv", URI: "http://example.com/invoice/", Properties: map[string]string{"Total": "12 < 13", "Number": "42"}},
+			{Prefix: "bad", URI: "http://example.com/bad/", Properties: map[string]string{"not a name": ""}},
+		},
+	}
+	packet := xmpPacket(doc, PDFA2B, true)
+
+	// the packet is well formed
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, item := range []string{
+		"<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">A &amp; B</rdf:li></rdf:Alt></dc:title>",
+		"<dc:subject><rdf:Bag><rdf:li>one</rdf:li><rdf:li>two</rdf:li></rdf:Bag></dc:subject>",
+		"<inv:Number>42</inv:Number>\n<inv:Total>12 &lt; 13</inv:Total>",
+		"<pdfaSchema:prefix>pdfuaid</pdfaSchema:prefix>",
+		"<pdfaSchema:prefix>inv</pdfaSchema:prefix>",
+	} {
+		if !bytes.Contains(packet, []byte(item)) {
+			t.Fatalf("missing %s in\n%s", item, packet)
+		}
+	}
+	if bytes.Contains(packet, []byte("http://example.com/bad/")) {
+		t.Fatal("unexpected invalid namespace")
+	}
+	if bytes.Count(packet, []byte("<pdfaExtension:schemas>")) != 1 {
+		t.Fatal("expected one extension container")
+	}
+
+	// the keywords not matching the information dictionary are not split
+	doc = xmpDocument{info: model.Info{Keywords: "one, two"}, keywords: []string{"one"}}
+	if packet := xmpPacket(doc, NoConformance, false); !bytes.Contains(packet, []byte("<rdf:Bag><rdf:li>one, two</rdf:li></rdf:Bag>")) ||
+		bytes.Contains(packet, []byte("pdfaExtension")) {
+		t.Fatalf("unexpected packet\n%s", packet)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	output := NewOutput()
+	output.AddPage(0, 0, 200, 200)
+	output.SetTitle("Report")
+	output.SetMetadata(Metadata{XMP: []XMPNamespace{{Prefix: "inv", URI: "http://example.com/invoice/", Properties: map[string]string{"Number": "42"}}}})
+	doc := output.Finalize()
+
+	for _, test := range []struct {
+		metadata []byte
+		expected []string
+	}{
+		{nil, []string{"Report</rdf:li>"}}, // generated from the information dictionary
+		{output.XMPMetadata(), []string{"Report</rdf:li>", "<inv:Number>42</inv:Number>"}},
+	} {
+		var buf bytes.Buffer
+		if err := Write(doc, &buf, WriteOptions{Metadata: test.metadata}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("/Metadata ")) {
+			t.Fatal("missing metadata in the catalog")
+		}
+		for _, item := range test.expected {
+			if !bytes.Contains(buf.Bytes(), []byte(item)) {
+				t.Fatalf("missing XMP %s", item)
+			}
+		}
+	}
+}
+
+func TestPageLabels(t *testing.T) {
+	labels, err := ParsePageLabels("1:none:Cover, 2:lower-roman,4:decimal,6:upper-alpha:A-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PageLabel{
+		{Page: 0, Style: LabelNone, Prefix: "Cover"},
+		{Page: 1, Style: LabelLowerRoman},
+		{Page: 3, Style: LabelDecimal},
+		{Page: 5, Style: LabelUpperAlpha, Prefix: "A-"},
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	for _, input := range [...]string{"", "0:decimal", "1", "1:disc", "a:decimal"} {
+		if _, err := ParsePageLabels(input); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+
+	c := NewOutput()
+	c.SetPageLabels(labels)
+	tree := c.pageLabelsTree([]int{0, 1, 2, 3, 4, 5, 6})
+	if !reflect.DeepEqual(tree.Nums, []model.NumToPageLabel{
+		{Num: 0, PageLabel: model.PageLabel{P: "Cover", St: 1}},
+		{Num: 1, PageLabel: model.PageLabel{S: "r", St: 1}},
+		{Num: 3, PageLabel: model.PageLabel{S: "D", St: 1}},
+		{Num: 5, PageLabel: model.PageLabel{S: "A", P: "A-", St: 1}},
+	}) {
+		t.Fatalf("unexpected labels %v", tree.Nums)
+	}
+
+	// the dropped pages start new ranges, and the
+	// pages before the first range keep their number
+	c.SetPageLabels([]PageLabel{{Page: 2, Start: 10}})
+	tree = c.pageLabelsTree([]int{0, 1, 3, 4})
+	if !reflect.DeepEqual(tree.Nums, []model.NumToPageLabel{
+		{Num: 0, PageLabel: model.PageLabel{S: "D", St: 1}},
+		{Num: 2, PageLabel: model.PageLabel{S: "D", St: 11}},
+	}) {
+		t.Fatalf("unexpected labels %v", tree.Nums)
+	}
+
+	if c.SetPageLabels(nil); c.pageLabelsTree([]int{0}) != nil {
+		t.Fatal("unexpected page labels")
+	}
+}
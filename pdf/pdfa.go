@@ -0,0 +1,222 @@
+package pdf
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+)
+
+// Conformance is a PDF/A conformance level, used for
+// long-term archiving.
+type Conformance uint8
+
+const (
+	// NoConformance is the default : no standard is enforced.
+	NoConformance Conformance = iota
+	// PDFA1B is the PDF/A-1b level (ISO 19005-1), based on PDF 1.4,
+	// which forbids transparency and attachments.
+	PDFA1B
+	// PDFA2B is the PDF/A-2b level (ISO 19005-2), based on PDF 1.7,
+	// which only allows PDF/A attachments.
+	PDFA2B
+	// PDFA3B is the PDF/A-3b level (ISO 19005-3), which allows
+	// any attachment.
+	PDFA3B
+)
+
+func (c Conformance) String() string {
+	switch c {
+	case NoConformance:
+		return "none"
+	case PDFA1B, PDFA2B, PDFA3B:
+		return fmt.Sprintf("PDF/A-%db", c.part())
+	default:
+		return fmt.Sprintf("<conformance %d>", c)
+	}
+}
+
+// part returns the part of the ISO 19005 standard
+func (c Conformance) part() int { return int(c) }
+
+// ParseConformance parses a PDF/A level, like "pdf/a-3b", case insensitive.
+// The empty string is parsed as `NoConformance`.
+func ParseConformance(s string) (Conformance, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return NoConformance, nil
+	case "pdf/a-1b":
+		return PDFA1B, nil
+	case "pdf/a-2b":
+		return PDFA2B, nil
+	case "pdf/a-3b":
+		return PDFA3B, nil
+	default:
+		return 0, fmt.Errorf("unsupported PDF/A level %q (expected pdf/a-1b, pdf/a-2b or pdf/a-3b)", s)
+	}
+}
+
+// allowsTransparency returns false for PDF/A-1.
+func (c Conformance) allowsTransparency() bool { return c != PDFA1B }
+
+// allowsAttachments returns true if any file may be embedded.
+// PDF/A-2 only allows PDF/A files, which we can't check.
+func (c Conformance) allowsAttachments() bool { return c == NoConformance || c == PDFA3B }
+
+// SetConformance makes the output conform to the given PDF/A level : the features
+// forbidden by the level are dropped or degraded, and reported as diagnostics with
+// the `diagnostics.NonConformant` code. The `diagnostics.Error` severity is used
+// when the content can't be kept, like text using bitmap fonts.
+//
+// The XMP metadata and the output intent required by PDF/A are added when writing
+// the document, which requires the `WriteOptions.Conformance` field to be set.
+// It must be called before adding pages.
+func (c *Output) SetConformance(conformance Conformance) {
+	c.cache.conformance = conformance
+}
+
+// degrade reports that `feature`, forbidden by the conformance level,
+// has been dropped or altered. It is only reported once per output.
+func (c cache) degrade(feature string, page int) {
+	if c.conformanceIssues[feature] {
+		return
+	}
+	c.conformanceIssues[feature] = true
+	c.report(diagnostics.Diagnostic{
+		Severity: diagnostics.Warning,
+		Code:     diagnostics.NonConformant,
+		Message:  fmt.Sprintf("%s is not allowed in %s", feature, c.conformance),
+		Page:     page,
+	})
+}
+
+// annotationFlags returns the flags of the annotations, which
+// must be printed in PDF/A files.
+func (c cache) annotationFlags() model.AnnotationFlag {
+	if c.conformance != NoConformance {
+		return model.APrint
+	}
+	return 0
+}
+
+// addMetadata adds the XMP metadata stream `packet`
+// to the raw file `raw`.
+func addMetadata(raw *file.PDFFile, packet []byte) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	if root == nil { // should not happen
+		return
+	}
+	// the stream must not be compressed in PDF/A-1
+	root["Metadata"] = addRawObject(raw, model.ObjStream{
+		Args:    model.ObjDict{"Type": model.Name("Metadata"), "Subtype": model.Name("XML")},
+		Content: packet,
+	})
+}
+
+// addConformance adds the entries required by `conformance`, except
+// the metadata (see `addMetadata`), to the raw file `raw`, whose
+// information dictionary is `info`.
+func addConformance(raw *file.PDFFile, info model.Info, conformance Conformance) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	if root == nil { // should not happen
+		return
+	}
+
+	profile := srgbProfile()
+	profileRef := addRawObject(raw, model.ObjStream{
+		Args: model.ObjDict{
+			"N":         model.ObjInt(3),
+			"Alternate": model.Name("DeviceRGB"),
+			"Filter":    model.Name("FlateDecode"),
+		},
+		Content: deflate(profile),
+	})
+	root["OutputIntents"] = model.ObjArray{model.ObjDict{
+		"Type":                      model.Name("OutputIntent"),
+		"S":                         model.Name("GTS_PDFA1"),
+		"OutputConditionIdentifier": model.ObjStringLiteral("sRGB IEC61966-2.1"),
+		"Info":                      model.ObjStringLiteral("sRGB IEC61966-2.1"),
+		"DestOutputProfile":         profileRef,
+	}}
+
+	if conformance == PDFA3B {
+		if af := associateFiles(raw, firstDate(info.ModDate, info.CreationDate)); len(af) != 0 {
+			previous, _ := root["AF"].(model.ObjArray) // files already written, in stream mode
+			root["AF"] = append(previous, af...)
+		}
+	}
+}
+
+// firstDate returns the first non zero date, or the current time.
+func firstDate(dates ...time.Time) time.Time {
+	for _, d := range dates {
+		if !d.IsZero() {
+			return d
+		}
+	}
+	return time.Now()
+}
+
+// associateFiles updates the embedded files as required by PDF/A-3,
+// and returns the references to their file specifications.
+func associateFiles(raw *file.PDFFile, modDate time.Time) model.ObjArray {
+	nums := make([]int, 0, len(raw.XrefTable))
+	for num := range raw.XrefTable {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	var out model.ObjArray
+	for _, num := range nums {
+		spec, ok := raw.XrefTable[num].(model.ObjDict)
+		if !ok || spec["Type"] != model.Name("Filespec") {
+			continue
+		}
+		if _, has := spec["AFRelationship"]; !has {
+			spec["AFRelationship"] = model.Name("Unspecified")
+		}
+		out = append(out, model.ObjIndirectRef{ObjectNumber: num})
+
+		ef, _ := raw.ResolveObject(spec["EF"]).(model.ObjDict)
+		ref, _ := ef["F"].(model.ObjIndirectRef)
+		stream, ok := raw.XrefTable[ref.ObjectNumber].(model.ObjStream)
+		if !ok {
+			continue
+		}
+		if _, has := stream.Args["Subtype"]; !has {
+			filename, _ := spec["F"].(model.ObjStringLiteral)
+			mimeType, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(string(filename))), ";")
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			stream.Args["Subtype"] = model.Name(escapeName(mimeType))
+		}
+		params, _ := raw.ResolveObject(stream.Args["Params"]).(model.ObjDict)
+		if params == nil {
+			params = model.ObjDict{}
+			stream.Args["Params"] = params
+		}
+		if _, has := params["ModDate"]; !has {
+			params["ModDate"] = model.ObjStringLiteral(model.DateTimeString(modDate))
+		}
+	}
+	return out
+}
+
+// addRawObject adds `obj` to the file, returning its reference
+func addRawObject(raw *file.PDFFile, obj model.Object) model.ObjIndirectRef {
+	num := 1
+	for n := range raw.XrefTable {
+		if n >= num {
+			num = n + 1
+		}
+	}
+	raw.XrefTable[num] = obj
+	return model.ObjIndirectRef{ObjectNumber: num}
+}
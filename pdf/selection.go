@@ -0,0 +1,172 @@
+package pdf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/webrender/backend"
+)
+
+// lastPage is used in page ranges for the last page of the document
+const lastPage = -1
+
+// pageRange is an inclusive range of 1-based page numbers
+type pageRange struct {
+	start, end int // may be lastPage
+}
+
+// PageSelection selects the pages kept in the output.
+// The zero value selects all the pages.
+type PageSelection struct {
+	ranges []pageRange
+}
+
+// ParsePageSelection parses a comma separated list of 1-based page numbers
+// or ranges, where "last" is the last page of the document, like "1-3,7,last" or "2-last".
+// Pages out of the document are ignored, and the selected pages are
+// written in the document order.
+func ParsePageSelection(s string) (PageSelection, error) {
+	var out PageSelection
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		startS, endS, isRange := strings.Cut(item, "-")
+		start, err := parsePageNumber(startS)
+		if err != nil {
+			return PageSelection{}, err
+		}
+		end := start
+		if isRange {
+			end, err = parsePageNumber(endS)
+			if err != nil {
+				return PageSelection{}, err
+			}
+		}
+		if start == lastPage && end != lastPage || end != lastPage && start > end {
+			return PageSelection{}, fmt.Errorf("invalid page range %q", item)
+		}
+		out.ranges = append(out.ranges, pageRange{start, end})
+	}
+	if len(out.ranges) == 0 {
+		return PageSelection{}, fmt.Errorf("empty page selection %q", s)
+	}
+	return out, nil
+}
+
+func parsePageNumber(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "last" {
+		return lastPage, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid page number %q", s)
+	}
+	return n, nil
+}
+
+// IsAll returns true if all the pages are selected.
+func (ps PageSelection) IsAll() bool { return len(ps.ranges) == 0 }
+
+// selected returns, for each of the `count` pages, whether it is selected
+func (ps PageSelection) selected(count int) []bool {
+	out := make([]bool, count)
+	for _, r := range ps.ranges {
+		start, end := r.start, r.end
+		if start == lastPage {
+			start = count
+		}
+		if end == lastPage {
+			end = count
+		}
+		for i := start; i <= end && i <= count; i++ {
+			out[i-1] = true
+		}
+	}
+	return out
+}
+
+// SetPageSelection restricts the pages written by `Finalize`.
+// The bookmarks pointing to dropped pages are redirected to their first
+// kept descendant, or removed, as are the named destinations and the links to dropped pages.
+// The fonts only used by dropped pages are not embedded.
+func (c *Output) SetPageSelection(selection PageSelection) { c.selection = selection }
+
+// keptPages returns the pages kept in the output, and
+// the new index of each page (-1 for dropped pages)
+func (c *Output) keptPages() (kept []*outputPage, newIndices []int) {
+	selected := c.selection.selected(len(c.pages))
+	if c.selection.IsAll() {
+		for i := range selected {
+			selected[i] = true
+		}
+	}
+	newIndices = make([]int, len(c.pages))
+	for i, page := range c.pages {
+		newIndices[i] = -1
+		if selected[i] {
+			newIndices[i] = len(kept)
+			kept = append(kept, page)
+		}
+	}
+	return kept, newIndices
+}
+
+// pruneBookmarks updates the page indices of the bookmarks,
+// removing or redirecting the ones pointing to dropped pages.
+func pruneBookmarks(nodes []backend.BookmarkNode, newIndices []int) []backend.BookmarkNode {
+	var out []backend.BookmarkNode
+	for _, node := range nodes {
+		node.Children = pruneBookmarks(node.Children, newIndices)
+		if index := newIndices[node.PageIndex]; index != -1 {
+			node.PageIndex = index
+		} else if len(node.Children) != 0 { // redirect to the first child
+			first := node.Children[0]
+			node.PageIndex, node.X, node.Y = first.PageIndex, first.X, first.Y
+		} else {
+			continue
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// pruneDestinations removes the named destinations and the links
+// pointing to dropped pages. It must be called after the pages are finalized.
+func (c *Output) pruneDestinations(kept []*outputPage) {
+	isKept := make(map[*model.PageObject]bool, len(kept))
+	for _, page := range kept {
+		isKept[&page.page] = true
+	}
+	pointsToKept := func(dest model.Destination) bool {
+		explicit, ok := dest.(model.DestinationExplicitIntern)
+		return !ok || isKept[explicit.Page]
+	}
+
+	names := make(map[model.DestinationString]bool)
+	var keptNames []model.NameToDest
+	for _, name := range c.document.Catalog.Names.Dests.Names {
+		if pointsToKept(name.Destination) {
+			keptNames = append(keptNames, name)
+			names[name.Name] = true
+		}
+	}
+	c.document.Catalog.Names.Dests.Names = keptNames
+
+	for _, page := range kept {
+		annots := page.page.Annots[:0]
+		for _, annot := range page.page.Annots {
+			if link, ok := annot.Subtype.(model.AnnotationLink); ok && link.Dest != nil {
+				if name, isName := link.Dest.(model.DestinationString); isName && !names[name] || !pointsToKept(link.Dest) {
+					continue
+				}
+			}
+			annots = append(annots, annot)
+		}
+		page.page.Annots = annots
+	}
+}
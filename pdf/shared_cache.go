@@ -0,0 +1,140 @@
+package pdf
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	cs "github.com/benoitkugler/pdf/contentstream"
+	"github.com/benoitkugler/pdf/model"
+)
+
+// SharedCache stores the parsed images and the font files, indexed by content,
+// so that they are reused across conversions.
+// It is safe for concurrent use, and may be shared by many outputs (see `Output.SetSharedCache`).
+//
+// For the fonts, only the files are shared : the subsets embedded in each
+// document, with the glyphs it uses, are still built per output.
+type SharedCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *sharedEntry, most recently used first
+	entries map[[32]byte]*list.Element
+}
+
+type sharedEntry struct {
+	key   [32]byte
+	value any // *model.XObjectImage or fontContent
+	size  int
+}
+
+// NewSharedCache returns an empty cache, storing at most `maxSize` bytes
+// of images and fonts, the least recently used entries being evicted first.
+// A zero or negative `maxSize` means no limit.
+func NewSharedCache(maxSize int) *SharedCache {
+	return &SharedCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (sc *SharedCache) Len() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.lru.Len()
+}
+
+// Size returns the approximate size in bytes of the cache entries.
+func (sc *SharedCache) Size() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.size
+}
+
+func (sc *SharedCache) get(key [32]byte) (any, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	elem, ok := sc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	sc.lru.MoveToFront(elem)
+	return elem.Value.(*sharedEntry).value, true
+}
+
+func (sc *SharedCache) add(key [32]byte, value any, size int) {
+	if sc.maxSize > 0 && size > sc.maxSize {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.entries[key]; ok { // added concurrently
+		return
+	}
+	sc.entries[key] = sc.lru.PushFront(&sharedEntry{key: key, value: value, size: size})
+	sc.size += size
+	for sc.maxSize > 0 && sc.size > sc.maxSize {
+		entry := sc.lru.Remove(sc.lru.Back()).(*sharedEntry)
+		delete(sc.entries, entry.key)
+		sc.size -= entry.size
+	}
+}
+
+func contentKey(kind string, content []byte) (out [32]byte) {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write(content)
+	h.Sum(out[:0])
+	return out
+}
+
+// image returns the parsed image, which must not be modified.
+// `sc` may be nil.
+func (sc *SharedCache) image(content io.Reader, mimeType string) (*model.XObjectImage, error) {
+	if sc == nil {
+		obj, _, err := cs.ParseImage(content, mimeType)
+		return obj, err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	key := contentKey("image/"+mimeType, data)
+	if obj, ok := sc.get(key); ok {
+		return obj.(*model.XObjectImage), nil
+	}
+	obj, _, err := cs.ParseImage(bytes.NewReader(data), mimeType)
+	if err != nil {
+		return nil, err
+	}
+	size := len(obj.Content)
+	if obj.SMask != nil {
+		size += len(obj.SMask.Content)
+	}
+	sc.add(key, obj, size)
+	return obj, nil
+}
+
+// fontContent returns the font file, checking if it is supported.
+// The returned content is shared by all the outputs using the same font file,
+// and must not be modified.
+// `sc` may be nil.
+func (sc *SharedCache) fontContent(content []byte) fontContent {
+	if sc == nil {
+		return fontContent{content: content, isSupported: isSupportedFont(content)}
+	}
+	key := contentKey("font", content)
+	if fc, ok := sc.get(key); ok {
+		return fc.(fontContent)
+	}
+	fc := fontContent{content: content, isSupported: isSupportedFont(content)}
+	sc.add(key, fc, len(content))
+	return fc
+}
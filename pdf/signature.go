@@ -0,0 +1,652 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benoitkugler/pdf/fonts/simpleencodings"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+)
+
+// SignatureFieldURL marks the box of the visible signature : if enabled by
+// `Output.SetSignatureField`, the first box whose (non standard) CSS link property
+// is `link: url(weasyprint:signature)` is replaced by an empty signature field,
+// which is filled by `WriteOptions.Signature`. Otherwise, the link is ignored.
+// The signature fields are not supported by `StreamOutput`.
+const SignatureFieldURL = "weasyprint:signature"
+
+// Timestamper obtains RFC 3161 timestamp tokens, which prove that
+// a signature existed at a given time.
+type Timestamper interface {
+	// Timestamp returns the DER encoded TimeStampToken for `digest`,
+	// the SHA-256 hash of the signature value.
+	Timestamp(digest []byte) ([]byte, error)
+}
+
+// Signature signs a PDF file, following the PAdES baseline profile
+// (ETSI.CAdES.detached signatures).
+type Signature struct {
+	// Signer computes the signature, and must use a RSA or ECDSA key.
+	Signer crypto.Signer
+
+	// Certificates is the certificate chain, starting with the certificate of Signer.
+	Certificates []*x509.Certificate
+
+	// Name is the name of the signer, which defaults to the common name of
+	// its certificate.
+	Name string
+
+	// Reason, Location and ContactInfo are optional, and shown by PDF viewers.
+	Reason, Location, ContactInfo string
+
+	// Time is the signing time, which defaults to the current time.
+	// Note that it is only trusted when a Timestamper is provided.
+	Time time.Time
+
+	// Timestamper, if not nil, adds a timestamp to the signature.
+	Timestamper Timestamper
+}
+
+// name returns the name of the signer
+func (sig *Signature) name() string {
+	if sig.Name == "" && len(sig.Certificates) != 0 {
+		return sig.Certificates[0].Subject.CommonName
+	}
+	return sig.Name
+}
+
+// placeholderSize returns the number of bytes reserved for the signature
+func (sig *Signature) placeholderSize() int {
+	size := 4096
+	for _, cert := range sig.Certificates {
+		size += len(cert.Raw)
+	}
+	if sig.Timestamper != nil {
+		// the token includes the certificates of the authority
+		size += 16384
+	}
+	return size
+}
+
+// byteRangePlaceholder is the ByteRange entry of the signature dictionary,
+// replaced once the file is written.
+type byteRangePlaceholder struct{}
+
+const byteRangePattern = "[0 0000000000 0000000000 0000000000]"
+
+func (byteRangePlaceholder) Write(model.PDFWritter, model.Reference) string { return byteRangePattern }
+
+func (p byteRangePlaceholder) Clone() model.Object { return p }
+
+// contentsPlaceholder is the Contents entry of the signature dictionary,
+// replaced by the signature once the file is written.
+// It is not encrypted.
+type contentsPlaceholder int
+
+func (p contentsPlaceholder) Write(model.PDFWritter, model.Reference) string {
+	return "<" + strings.Repeat("0", 2*int(p)) + ">"
+}
+
+func (p contentsPlaceholder) Clone() model.Object { return p }
+
+// isSignatureDict returns true for the signature dictionary, which must
+// be written directly, so that the signature can be inserted.
+func isSignatureDict(obj model.Object) bool {
+	dict, _ := obj.(model.ObjDict)
+	_, ok := dict["Contents"].(contentsPlaceholder)
+	return ok
+}
+
+// SetSignatureField enables the signature field marked by `SignatureFieldURL`,
+// which should only be added when the document is signed.
+// It must be called before `Finalize`.
+func (c *Output) SetSignatureField(enabled bool) { c.signatureField = enabled }
+
+// addSignatureField adds the signature field whose widget covers the first box marked
+// with `SignatureFieldURL`, if any and if enabled. It must be called before finalizing the pages.
+func (c *Output) addSignatureField(pages []*outputPage) {
+	if !c.signatureField {
+		return
+	}
+	for _, p := range pages {
+		if p.signatureRect == nil {
+			continue
+		}
+		rect := *p.signatureRect
+		widget := &model.AnnotationDict{
+			BaseAnnotation: model.BaseAnnotation{
+				Rect: rect,
+				F:    model.APrint | model.ALocked,
+				AP: &model.AppearanceDict{
+					N: model.AppearanceEntry{"": &model.XObjectForm{BBox: rect}},
+				},
+			},
+			Subtype: model.AnnotationWidget{},
+		}
+		p.tagAnnotation(widget, "Signature")
+		p.page.Annots = append(p.page.Annots, widget)
+		field := &model.FormFieldDict{
+			FormFieldInheritable: model.FormFieldInheritable{FT: model.FormFieldSignature{}},
+			T:                    "Signature1",
+			Widgets:              []model.FormFieldWidget{{AnnotationDict: widget}},
+		}
+		form := &c.document.Catalog.AcroForm
+		form.Fields = append(form.Fields, field)
+		form.SigFlags |= model.SignaturesExist
+		return
+	}
+}
+
+// addSignature fills the signature field of `raw`, creating an invisible one if needed,
+// with a signature dictionary whose ByteRange and Contents are placeholders.
+// If `conformance` is set, the appearance of the signature is a frame, without text.
+func addSignature(raw *file.PDFFile, sig *Signature, conformance Conformance) error {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	if root == nil { // should not happen
+		return errors.New("missing document catalog")
+	}
+	form, _ := raw.ResolveObject(root["AcroForm"]).(model.ObjDict)
+	if form == nil {
+		form = model.ObjDict{}
+		root["AcroForm"] = form
+	}
+	fields, _ := raw.ResolveObject(form["Fields"]).(model.ObjArray)
+
+	var field model.ObjDict
+	for _, ref := range fields {
+		f, _ := raw.ResolveObject(ref).(model.ObjDict)
+		if _, signed := f["V"]; f["FT"] == model.Name("Sig") && !signed {
+			field = f
+			break
+		}
+	}
+	if field == nil { // add an invisible field on the first page
+		pageRef, page := firstPage(raw)
+		if page == nil {
+			return errors.New("signing requires at least one page")
+		}
+		field = model.ObjDict{
+			"Type":    model.Name("Annot"),
+			"Subtype": model.Name("Widget"),
+			"FT":      model.Name("Sig"),
+			"T":       model.ObjStringLiteral("Signature1"),
+			"Rect":    model.ObjArray{model.ObjInt(0), model.ObjInt(0), model.ObjInt(0), model.ObjInt(0)},
+			"P":       pageRef,
+		}
+		fieldRef := addRawObject(raw, field)
+		annots, _ := raw.ResolveObject(page["Annots"]).(model.ObjArray)
+		page["Annots"] = append(annots, fieldRef)
+		fields = append(fields, fieldRef)
+	} else if rect := rawRectangle(raw, field["Rect"]); rect.Width() > 0 && rect.Height() > 0 {
+		field["AP"] = model.ObjDict{"N": addRawObject(raw, signatureAppearance(sig, rect, conformance))}
+	}
+	form["Fields"] = fields
+	form["SigFlags"] = model.ObjInt(model.SignaturesExist | model.AppendOnly)
+	field["F"] = model.ObjInt(model.APrint | model.ALocked)
+
+	signingTime := sig.Time
+	if signingTime.IsZero() {
+		signingTime = time.Now()
+	}
+	dict := model.ObjDict{
+		"Type":      model.Name("Sig"),
+		"Filter":    model.Name("Adobe.PPKLite"),
+		"SubFilter": model.Name("ETSI.CAdES.detached"),
+		"ByteRange": byteRangePlaceholder{},
+		"Contents":  contentsPlaceholder(sig.placeholderSize()),
+		"M":         model.ObjStringLiteral(model.DateTimeString(signingTime)),
+	}
+	for key, value := range map[model.Name]string{
+		"Name": sig.name(), "Reason": sig.Reason, "Location": sig.Location, "ContactInfo": sig.ContactInfo,
+	} {
+		if value != "" {
+			dict[key] = textString(value)
+		}
+	}
+	field["V"] = addRawObject(raw, dict)
+	return nil
+}
+
+// firstPage returns the first page of `raw`.
+func firstPage(raw *file.PDFFile) (model.ObjIndirectRef, model.ObjDict) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	ref, _ := root["Pages"].(model.ObjIndirectRef)
+	for {
+		node, _ := raw.ResolveObject(ref).(model.ObjDict)
+		if node == nil || node["Type"] == model.Name("Page") {
+			return ref, node
+		}
+		kids, _ := raw.ResolveObject(node["Kids"]).(model.ObjArray)
+		if len(kids) == 0 {
+			return ref, nil
+		}
+		ref, _ = kids[0].(model.ObjIndirectRef)
+	}
+}
+
+// rawRectangle returns the rectangle stored in `obj`, or an empty one.
+func rawRectangle(raw *file.PDFFile, obj model.Object) model.Rectangle {
+	arr, _ := raw.ResolveObject(obj).(model.ObjArray)
+	if len(arr) != 4 {
+		return model.Rectangle{}
+	}
+	var coords [4]model.Fl
+	for i, o := range arr {
+		switch v := raw.ResolveObject(o).(type) {
+		case model.ObjInt:
+			coords[i] = model.Fl(v)
+		case model.ObjFloat:
+			coords[i] = model.Fl(v)
+		}
+	}
+	return model.Rectangle{
+		Llx: min(coords[0], coords[2]), Lly: min(coords[1], coords[3]),
+		Urx: max(coords[0], coords[2]), Ury: max(coords[1], coords[3]),
+	}
+}
+
+// signatureAppearance returns the form XObject drawn in the signature box `rect` :
+// a frame with the name of the signer, the date and the reason.
+// The text uses a standard font, which is not allowed by PDF/A, and is
+// then omitted.
+func signatureAppearance(sig *Signature, rect model.Rectangle, conformance Conformance) model.ObjStream {
+	width, height := rect.Width(), rect.Height()
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "q 0.5 G 1 w 0.5 0.5 %.2f %.2f re S Q\n", width-1, height-1)
+	args := model.ObjDict{
+		"Type":    model.Name("XObject"),
+		"Subtype": model.Name("Form"),
+		"BBox":    model.ObjArray{model.ObjInt(0), model.ObjInt(0), model.ObjFloat(width), model.ObjFloat(height)},
+	}
+	if conformance == NoConformance {
+		lines := []string{"Digitally signed by " + sig.name()}
+		if !sig.Time.IsZero() {
+			lines = append(lines, "Date: "+sig.Time.Format("2006-01-02 15:04:05 -07:00"))
+		}
+		if sig.Reason != "" {
+			lines = append(lines, "Reason: "+sig.Reason)
+		}
+		// shrink the text to fit the height of the box
+		fontSize := min(9, (height-4)/model.Fl(len(lines))/1.2)
+		fmt.Fprintf(&content, "BT /Helv %.2f Tf %.2f TL 4 %.2f Td", fontSize, 1.2*fontSize, height-2-fontSize)
+		for _, line := range lines {
+			fmt.Fprintf(&content, " (%s) Tj T*", escapeWinAnsi(line))
+		}
+		content.WriteString(" ET\n")
+		args["Resources"] = model.ObjDict{"Font": model.ObjDict{"Helv": model.ObjDict{
+			"Type":     model.Name("Font"),
+			"Subtype":  model.Name("Type1"),
+			"BaseFont": model.Name("Helvetica"),
+			"Encoding": model.Name("WinAnsiEncoding"),
+		}}}
+	}
+	return model.ObjStream{Args: args, Content: content.Bytes()}
+}
+
+// winAnsiBytes maps the characters supported by WinAnsiEncoding to their code.
+var winAnsiBytes = simpleencodings.WinAnsi.RuneToByte()
+
+// escapeWinAnsi returns `s` as the content of a PDF literal string,
+// encoded with WinAnsiEncoding, replacing the unsupported characters by '?'.
+func escapeWinAnsi(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case 32 <= r && r <= 126:
+			b.WriteRune(r)
+		default:
+			if code, ok := winAnsiBytes[r]; ok && code > 126 {
+				fmt.Fprintf(&b, "\\%03o", code)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// signFile fills the ByteRange and Contents placeholders of the file `data`,
+// written with the signature dictionary returned by `addSignature`.
+func signFile(data []byte, sig *Signature) error {
+	placeholder := []byte(contentsPlaceholder(sig.placeholderSize()).Write(nil, 0))
+	start := bytes.Index(data, placeholder)
+	rangeStart := bytes.LastIndex(data[:max(start, 0)], []byte(byteRangePattern))
+	if start == -1 || rangeStart == -1 {
+		return errors.New("missing signature placeholder")
+	}
+	end := start + len(placeholder)
+
+	byteRange := fmt.Sprintf("[0 %d %d %d]", start, end, len(data)-end)
+	copy(data[rangeStart:], byteRange+strings.Repeat(" ", len(byteRangePattern)-len(byteRange)))
+
+	h := sha256.New()
+	h.Write(data[:start])
+	h.Write(data[end:])
+	cms, err := signedData(oidData, nil, h.Sum(nil), sig.Signer, sig.Certificates, sig.Timestamper)
+	if err != nil {
+		return err
+	}
+	if 2*len(cms) > len(placeholder)-2 {
+		return fmt.Errorf("signature too large (%d bytes)", len(cms))
+	}
+	hex.Encode(data[start+1:], cms)
+	return nil
+}
+
+// CMS structures, see RFC 5652
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidTimeStampToken       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+	oidTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"optional,explicit,tag:0"`
+}
+
+type signedDataContent struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// essCertIDv2 uses the default SHA-256 hash algorithm (RFC 5035)
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// newAttribute returns the attribute `typ` with the single value `value`.
+func newAttribute(typ asn1.ObjectIdentifier, value any) (attribute, error) {
+	der, err := asn1.Marshal(value)
+	return attribute{Type: typ, Values: []asn1.RawValue{{FullBytes: der}}}, err
+}
+
+// implicitSet returns the DER encoded SET OF `values`, tagged with
+// the context specific `tag`, as used by the optional fields.
+func implicitSet(tag int, values any) (set []byte, tagged asn1.RawValue, err error) {
+	set, err = asn1.MarshalWithParams(values, "set")
+	if err != nil {
+		return nil, tagged, err
+	}
+	var raw asn1.RawValue
+	if _, err = asn1.Unmarshal(set, &raw); err != nil {
+		return nil, tagged, err
+	}
+	return set, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: raw.Bytes}, nil
+}
+
+// signedData returns a CMS ContentInfo of type SignedData, signing `digest`, the SHA-256
+// hash of the content of type `contentType`. The content is only included if not nil.
+// If `timestamper` is not nil, a timestamp of the signature is added.
+func signedData(contentType asn1.ObjectIdentifier, content, digest []byte, signer crypto.Signer,
+	chain []*x509.Certificate, timestamper Timestamper,
+) ([]byte, error) {
+	if signer == nil || len(chain) == 0 {
+		return nil, errors.New("a signer and its certificate are required")
+	}
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported signing key %T", signer.Public())
+	}
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+
+	// the signed attributes, required by PAdES
+	certHash := sha256.Sum256(chain[0].Raw)
+	var attrs [3]attribute
+	var err error
+	if attrs[0], err = newAttribute(oidContentType, contentType); err != nil {
+		return nil, err
+	}
+	if attrs[1], err = newAttribute(oidMessageDigest, digest); err != nil {
+		return nil, err
+	}
+	if attrs[2], err = newAttribute(oidSigningCertificateV2, signingCertificateV2{
+		Certs: []essCertIDv2{{CertHash: certHash[:]}},
+	}); err != nil {
+		return nil, err
+	}
+	signedAttrs, taggedAttrs, err := implicitSet(0, attrs[:])
+	if err != nil {
+		return nil, err
+	}
+
+	attrsDigest := sha256.Sum256(signedAttrs)
+	signature, err := signer.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	info := signerInfo{
+		Version: 1,
+		SID: issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: chain[0].RawIssuer},
+			SerialNumber: chain[0].SerialNumber,
+		},
+		DigestAlgorithm:    digestAlgorithm,
+		SignedAttrs:        taggedAttrs,
+		SignatureAlgorithm: signatureAlgorithm,
+		Signature:          signature,
+	}
+	if timestamper != nil {
+		signatureDigest := sha256.Sum256(signature)
+		token, err := timestamper.Timestamp(signatureDigest[:])
+		if err != nil {
+			return nil, fmt.Errorf("timestamping signature: %s", err)
+		}
+		attr := attribute{Type: oidTimeStampToken, Values: []asn1.RawValue{{FullBytes: token}}}
+		if _, info.UnsignedAttrs, err = implicitSet(1, []attribute{attr}); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs []byte
+	for _, cert := range chain {
+		certs = append(certs, cert.Raw...)
+	}
+	sd := signedDataContent{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: contentType, EContent: content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      []signerInfo{info},
+	}
+	if content != nil {
+		sd.Version = 3 // content other than data
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	// RawValue ignores the explicit tag
+	wrapped := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: wrapped})
+}
+
+// RFC 3161 structures
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       accuracy  `asn1:"optional"`
+	Ordering       bool      `asn1:"optional"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status int
+	Rest   asn1.RawValue `asn1:"optional"` // statusString and failInfo, ignored
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// TSAClient is a Timestamper using a time stamping authority,
+// with the HTTP protocol of RFC 3161.
+type TSAClient struct {
+	// URL is the endpoint of the authority.
+	URL string
+
+	// HTTPClient defaults to `http.DefaultClient`.
+	HTTPClient *http.Client
+}
+
+// Timestamp implements Timestamper.
+func (tc TSAClient) Timestamp(digest []byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := tc.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Post(tc.URL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid timestamp response: %s", err)
+	}
+	// granted, or granted with modifications
+	if resp.Status.Status > 1 || len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("timestamp request rejected with status %d", resp.Status.Status)
+	}
+	if err := checkTimestampToken(resp.TimeStampToken.FullBytes, digest, nonce); err != nil {
+		return nil, err
+	}
+	return resp.TimeStampToken.FullBytes, nil
+}
+
+// checkTimestampToken returns an error if `token` does not timestamp `digest`
+// with the given `nonce`, so that wrong or replayed tokens are rejected.
+// The signature of the token is not verified.
+func checkTimestampToken(token, digest []byte, nonce *big.Int) error {
+	var (
+		info contentInfo
+		sd   signedDataContent
+		tst  tstInfo
+	)
+	if _, err := asn1.Unmarshal(token, &info); err != nil || !info.ContentType.Equal(oidSignedData) {
+		return errors.New("invalid timestamp token")
+	}
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil || !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return errors.New("invalid timestamp token")
+	}
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &tst); err != nil {
+		return fmt.Errorf("invalid timestamp token: %s", err)
+	}
+	if !tst.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(tst.MessageImprint.HashedMessage, digest) {
+		return errors.New("the timestamp token does not match the signature")
+	}
+	if tst.Nonce == nil || tst.Nonce.Cmp(nonce) != 0 {
+		return errors.New("the nonce of the timestamp token does not match the request")
+	}
+	return nil
+}
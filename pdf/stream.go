@@ -0,0 +1,466 @@
+package pdf
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	cs "github.com/benoitkugler/pdf/contentstream"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+	"github.com/benoitkugler/webrender/backend"
+)
+
+var _ backend.Document = (*StreamOutput)(nil)
+
+// StreamOutput is a backend.Document writing each page to its target
+// as soon as the page is drawn, and releasing its content, so that the memory used
+// does not grow with the number of pages.
+// The objects referencing several pages (fonts, outline, destinations, attachments)
+// are written by `Close`.
+//
+// The images shared by several pages are written once, but are parsed again for each page,
+// unless a `SharedCache` is used.
+//
+// Since a page is written when the next one is added, page selection and parts
+// are not supported.
+type StreamOutput struct {
+	output *Output
+	w      *rawWriter
+
+	pages    int   // reserved number of the page tree
+	pageNums []int // numbers of the pages already written
+
+	// the fonts are written at the end, but referenced by the pages
+	fonts     map[*model.FontDict]int // reserved numbers
+	fontMarks map[*model.FontDict]int // see `markFonts`
+	marked    []*model.FontDict       // indexed by mark
+
+	streams map[[32]byte]int // see rawCopier.streams
+
+	// numbers of the files embedded by the pages already written,
+	// which must be referenced by the catalog in PDF/A-3
+	associatedFiles []int
+
+	// numbers of the annotations of the pages already written,
+	// which are referenced by the structure tree of tagged outputs
+	annots [][]int
+
+	err error // first error encountered
+}
+
+// NewStreamOutput returns an output writing to `target`.
+// `Close` must be called once the document has been drawn.
+func NewStreamOutput(target io.Writer) *StreamOutput {
+	return NewStreamOutputContext(context.Background(), target)
+}
+
+// NewStreamOutputContext is the same as NewStreamOutput, but the drawing is
+// aborted once `ctx` is done. See `NewOutputContext` for details.
+func NewStreamOutputContext(ctx context.Context, target io.Writer) *StreamOutput {
+	out := &StreamOutput{
+		output:    NewOutputContext(ctx),
+		w:         newRawWriter(target),
+		fonts:     make(map[*model.FontDict]int),
+		fontMarks: make(map[*model.FontDict]int),
+		streams:   make(map[[32]byte]int),
+	}
+	out.output.cache.streaming = true
+	out.pages = out.w.reserve()
+	return out
+}
+
+// SetDiagnostics is the same as `Output.SetDiagnostics`.
+func (s *StreamOutput) SetDiagnostics(collector *diagnostics.Collector) {
+	s.output.SetDiagnostics(collector)
+}
+
+// SetSharedCache is the same as `Output.SetSharedCache`.
+func (s *StreamOutput) SetSharedCache(shared *SharedCache) {
+	s.output.SetSharedCache(shared)
+}
+
+// SetReproducible makes the file only depend on the content of the document,
+// as `WriteOptions.Reproducible` does.
+// It must be called before adding pages.
+func (s *StreamOutput) SetReproducible() {
+	s.w.id = sha256.New()
+}
+
+// SetCompression is the same as `Output.SetCompression`, and
+// also packs the objects into object streams for `OptimizeSize`.
+// It must be called before adding pages.
+func (s *StreamOutput) SetCompression(compression Compression) {
+	s.output.SetCompression(compression)
+	s.setPacking()
+}
+
+// SetConformance is the same as `Output.SetConformance`, and also
+// adds the entries required by PDF/A when closing the output.
+// It must be called before adding pages.
+func (s *StreamOutput) SetConformance(conformance Conformance) {
+	s.output.SetConformance(conformance)
+	if conformance != NoConformance && s.w.id == nil {
+		s.w.id = sha256.New()
+	}
+	s.setPacking()
+}
+
+// SetStructure is the same as `Output.SetStructure`.
+func (s *StreamOutput) SetStructure(root *StructElement) { s.output.SetStructure(root) }
+
+// addConformance adds the entries required by PDF/A, except the metadata, to `raw`,
+// referencing the files embedded in the pages already written.
+func (s *StreamOutput) addConformance(raw *file.PDFFile, copier rawCopier) {
+	c := s.output
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	if root == nil { // should not happen
+		return
+	}
+	// placeholders mapped to the objects already written
+	var af model.ObjArray
+	for _, num := range s.associatedFiles {
+		ref := addRawObject(raw, model.ObjNull{})
+		copier.numbers[ref.ObjectNumber] = num
+		af = append(af, ref)
+	}
+	if len(af) != 0 {
+		root["AF"] = af
+	}
+	addConformance(raw, withCustomInfo(c.document.Trailer.Info, c.metadata.Custom), c.cache.conformance)
+}
+
+// mapAnnotations maps the annotations of the pages `rawKids`, referenced
+// by the structure tree, to the annotations already written.
+func (s *StreamOutput) mapAnnotations(raw *file.PDFFile, copier rawCopier, rawKids model.ObjArray) {
+	for i, annots := range s.annots {
+		page, _ := raw.ResolveObject(rawKids[i]).(model.ObjDict)
+		rawAnnots, _ := raw.ResolveObject(page["Annots"]).(model.ObjArray)
+		for j, ref := range rawAnnots {
+			ref, ok := ref.(model.ObjIndirectRef)
+			if !ok || j >= len(annots) {
+				continue
+			}
+			copier.numbers[ref.ObjectNumber] = annots[j]
+			// the attached files have also been written with the page,
+			// and must not be found by `associateFiles`
+			annot, _ := raw.XrefTable[ref.ObjectNumber].(model.ObjDict)
+			if fs, ok := annot["FS"].(model.ObjIndirectRef); ok {
+				delete(raw.XrefTable, fs.ObjectNumber)
+			}
+		}
+	}
+}
+
+// setPacking enables the object streams if needed
+func (s *StreamOutput) setPacking() {
+	s.w.packer = nil
+	if cache := s.output.cache; cache.compression == OptimizeSize && cache.conformance != PDFA1B {
+		s.w.packer = newObjectPacker()
+	}
+}
+
+// SetMetadata is the same as `Output.SetMetadata`.
+func (s *StreamOutput) SetMetadata(metadata Metadata) { s.output.SetMetadata(metadata) }
+
+// SetPageLabels is the same as `Output.SetPageLabels`.
+func (s *StreamOutput) SetPageLabels(labels []PageLabel) { s.output.SetPageLabels(labels) }
+
+// SetViewerPreferences is the same as `Output.SetViewerPreferences`,
+// all the preferences being written by `Close`.
+func (s *StreamOutput) SetViewerPreferences(prefs ViewerPreferences) {
+	s.output.SetViewerPreferences(prefs)
+}
+
+// SetDirection is the same as `Output.SetDirection`.
+func (s *StreamOutput) SetDirection(direction Direction) { s.output.SetDirection(direction) }
+
+// SetProgress is the same as `Output.SetProgress`.
+func (s *StreamOutput) SetProgress(callback progress.Func, pageCount int) {
+	s.output.SetProgress(callback, pageCount)
+}
+
+// CurrentPage is the same as `Output.CurrentPage`.
+func (s *StreamOutput) CurrentPage() int { return s.output.CurrentPage() }
+
+// flush writes the pages which have not been written yet.
+func (s *StreamOutput) flush() {
+	for i := len(s.pageNums); i < len(s.output.pages); i++ {
+		s.output.checkContext()
+		s.output.currentPage = i
+		s.writePage(i)
+	}
+	s.output.currentPage = -1
+}
+
+// writePage writes the page `index` and releases its content
+func (s *StreamOutput) writePage(index int) {
+	page := s.output.pages[index]
+	page.finalize()
+
+	restore := s.markFonts()
+	raw, err := toRaw(&model.Document{Catalog: model.Catalog{Pages: model.PageTree{Kids: []model.PageNode{&page.page}}}})
+	restore()
+	if err != nil {
+		s.setErr(err)
+		s.pageNums = append(s.pageNums, 0)
+		return
+	}
+
+	copier := rawCopier{src: raw, dst: s.w, numbers: make(map[int]int), streams: s.streams}
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	pagesRef, _ := root["Pages"].(model.ObjIndirectRef)
+	pages, _ := raw.ResolveObject(pagesRef).(model.ObjDict)
+	kids, _ := pages["Kids"].(model.ObjArray)
+	if len(kids) != 1 {
+		s.setErr(fmt.Errorf("internal error: invalid page %d", index+1))
+		s.pageNums = append(s.pageNums, 0)
+		return
+	}
+	// the parent of the page is the final page tree
+	copier.numbers[pagesRef.ObjectNumber] = s.pages
+	s.mapFonts(copier)
+	var files model.ObjArray // see `StreamOutput.associatedFiles`
+	if s.output.cache.conformance == PDFA3B {
+		o := s.output
+		files = associateFiles(&raw, firstDate(o.metadata.ModificationDate, o.document.Trailer.Info.ModDate,
+			o.metadata.CreationDate, o.document.Trailer.Info.CreationDate))
+	}
+	s.pageNums = append(s.pageNums, copier.copyRef(kids[0].(model.ObjIndirectRef)))
+	for _, ref := range files {
+		s.associatedFiles = append(s.associatedFiles, copier.numbers[ref.(model.ObjIndirectRef).ObjectNumber])
+	}
+
+	// only keep what is needed by the anchors and bookmarks
+	stub := &outputPage{
+		customMediaBox: page.customMediaBox,
+		group:          group{stream: cs.GraphicStream{BoundingBox: page.stream.BoundingBox}, page: index},
+	}
+	if s.output.cache.tags != nil {
+		// and by the structure tree
+		stub.page = model.PageObject{StructParents: page.page.StructParents, Annots: page.page.Annots}
+		rawPage, _ := raw.ResolveObject(kids[0]).(model.ObjDict)
+		rawAnnots, _ := raw.ResolveObject(rawPage["Annots"]).(model.ObjArray)
+		annots := make([]int, len(rawAnnots))
+		for i, ref := range rawAnnots {
+			ref, _ := ref.(model.ObjIndirectRef)
+			annots[i] = copier.numbers[ref.ObjectNumber]
+		}
+		s.annots = append(s.annots, annots)
+	}
+	s.output.pages[index] = stub
+	// the images will be parsed again if needed
+	clear(s.output.cache.images)
+}
+
+func (s *StreamOutput) setErr(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// markFonts gives the fonts, which are only written at the end,
+// a placeholder content, so that they may be identified in the
+// pages. It returns a function removing the placeholders.
+func (s *StreamOutput) markFonts() (restore func()) {
+	var fonts []*model.FontDict
+	for _, bFont := range s.output.sortedFonts() {
+		font := s.output.cache.fonts[bFont]
+		if font.FontDict.Subtype != nil {
+			continue
+		}
+		font.FontDict.Subtype = model.FontType1{BaseFont: s.fontMark(font.FontDict)}
+		fonts = append(fonts, font.FontDict)
+	}
+	return func() {
+		for _, font := range fonts {
+			font.Subtype = nil
+		}
+	}
+}
+
+func (s *StreamOutput) fontMark(font *model.FontDict) model.Name {
+	mark, ok := s.fontMarks[font]
+	if !ok {
+		mark = len(s.marked)
+		s.fontMarks[font] = mark
+		s.marked = append(s.marked, font)
+	}
+	return model.Name(fmt.Sprintf("WeasyprintFont%d", mark))
+}
+
+// mapFonts maps the placeholder fonts to their final object
+func (s *StreamOutput) mapFonts(copier rawCopier) {
+	numbers := make(map[int]int) // mark -> number in the source
+	for num, obj := range copier.src.XrefTable {
+		dict, ok := obj.(model.ObjDict)
+		if !ok || dict["Type"] != model.Name("Font") {
+			continue
+		}
+		var mark int
+		name, _ := dict["BaseFont"].(model.Name)
+		if _, err := fmt.Sscanf(string(name), "WeasyprintFont%d", &mark); err != nil || mark >= len(s.marked) {
+			continue
+		}
+		numbers[mark] = num
+	}
+	// reserve the numbers in a stable order
+	for mark, font := range s.marked {
+		num, ok := numbers[mark]
+		if !ok {
+			continue
+		}
+		if _, has := s.fonts[font]; !has {
+			s.fonts[font] = s.w.reserve()
+		}
+		copier.numbers[num] = s.fonts[font]
+	}
+}
+
+// AddPage writes the previous pages, and starts a new one.
+func (s *StreamOutput) AddPage(left, top, right, bottom fl) backend.Page {
+	s.flush()
+	return s.output.AddPage(left, top, right, bottom)
+}
+
+// CreateAnchors writes the last page, and registers the anchors.
+func (s *StreamOutput) CreateAnchors(anchors [][]backend.Anchor) {
+	s.flush()
+	s.output.CreateAnchors(anchors)
+}
+
+func (s *StreamOutput) SetAttachments(as []backend.Attachment) { s.output.SetAttachments(as) }
+
+func (s *StreamOutput) EmbedFile(fileID string, a backend.Attachment) { s.output.EmbedFile(fileID, a) }
+
+func (s *StreamOutput) SetBookmarks(root []backend.BookmarkNode) { s.output.SetBookmarks(root) }
+
+func (s *StreamOutput) SetTitle(title string) { s.output.SetTitle(title) }
+
+func (s *StreamOutput) SetDescription(description string) { s.output.SetDescription(description) }
+
+func (s *StreamOutput) SetCreator(creator string) { s.output.SetCreator(creator) }
+
+func (s *StreamOutput) SetAuthors(authors []string) { s.output.SetAuthors(authors) }
+
+func (s *StreamOutput) SetKeywords(keywords []string) { s.output.SetKeywords(keywords) }
+
+func (s *StreamOutput) SetProducer(producer string) { s.output.SetProducer(producer) }
+
+func (s *StreamOutput) SetDateCreation(d time.Time) { s.output.SetDateCreation(d) }
+
+func (s *StreamOutput) SetDateModification(d time.Time) { s.output.SetDateModification(d) }
+
+// Close writes the remaining pages, the fonts, the catalog and the trailer,
+// and returns the first error encountered.
+// The target is not closed.
+func (s *StreamOutput) Close() error {
+	s.flush()
+	if s.err != nil {
+		return s.err
+	}
+
+	c := s.output
+	c.cache.progress.drawing(len(c.pages))
+	c.writeFonts(nil)
+	c.applyMetadata()
+	if c.cache.tags != nil {
+		pages := make(map[int]*model.PageObject, len(c.pages))
+		for i, page := range c.pages {
+			pages[i] = &page.page
+		}
+		c.setStructure(pages)
+	}
+
+	// the written pages are replaced by the page tree, and
+	// the fonts are added to an additional page, which is not written
+	fonts := model.ResourcesDict{Font: make(map[model.Name]*model.FontDict)}
+	for font := range s.fonts {
+		if font.Subtype != nil { // should always be true
+			fonts.Font[s.fontMark(font)] = font
+		}
+	}
+	kids := make([]model.PageNode, len(c.pages)+1)
+	for i, page := range c.pages {
+		kids[i] = &page.page
+	}
+	kids[len(c.pages)] = &model.PageObject{Resources: &fonts}
+	var first *model.PageObject
+	if len(c.pages) != 0 {
+		first = &c.pages[0].page
+	}
+	c.setCatalogPreferences(first)
+	doc := c.document
+	doc.Catalog.Pages = model.PageTree{Kids: kids}
+	indices := make([]int, len(c.pages))
+	for i := range indices {
+		indices[i] = i
+	}
+	doc.Catalog.PageLabels = c.pageLabelsTree(indices)
+
+	raw, err := toRaw(&doc)
+	if err != nil {
+		return err
+	}
+	copier := rawCopier{src: raw, dst: s.w, numbers: make(map[int]int)}
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	pagesRef, _ := root["Pages"].(model.ObjIndirectRef)
+	pages, _ := raw.ResolveObject(pagesRef).(model.ObjDict)
+	rawKids, _ := pages["Kids"].(model.ObjArray)
+	if len(rawKids) != len(kids) {
+		return fmt.Errorf("internal error: invalid page tree")
+	}
+	tagged := c.cache.tags != nil
+	if tagged {
+		s.mapAnnotations(&raw, copier, rawKids)
+	}
+	addMetadata(&raw, c.xmpMetadata())
+	if c.cache.conformance != NoConformance {
+		s.addConformance(&raw, copier)
+	}
+	if tagged {
+		fixStructure(&raw)
+	}
+	if hasUnnumberedLabels(doc.Catalog.PageLabels) {
+		fixPageLabels(&raw)
+	}
+	if prefs := c.ViewerPreferences(); prefs.rawPreferences() {
+		addViewerPreferences(&raw, prefs)
+	}
+	copier.numbers[pagesRef.ObjectNumber] = s.pages
+	for i, num := range s.pageNums {
+		copier.numbers[rawKids[i].(model.ObjIndirectRef).ObjectNumber] = num
+	}
+
+	// fonts
+	fontsPage, _ := raw.ResolveObject(rawKids[len(kids)-1]).(model.ObjDict)
+	resources, _ := raw.ResolveObject(fontsPage["Resources"]).(model.ObjDict)
+	rawFonts, _ := raw.ResolveObject(resources["Font"]).(model.ObjDict)
+	for _, font := range s.marked {
+		num, has := s.fonts[font]
+		if !has {
+			continue
+		}
+		if ref, ok := rawFonts[s.fontMark(font)].(model.ObjIndirectRef); ok {
+			copier.copyRefTo(ref, num)
+		}
+	}
+
+	// page tree
+	refs := make(model.ObjArray, len(s.pageNums))
+	for i, num := range s.pageNums {
+		refs[i] = model.ObjIndirectRef{ObjectNumber: num}
+	}
+	s.w.writeObject(s.pages, model.ObjDict{
+		"Type":  model.Name("Pages"),
+		"Kids":  refs,
+		"Count": model.ObjInt(len(refs)),
+	})
+
+	rootNum := copier.copyRef(raw.Root)
+	return s.w.writeFooter(rootNum, copier.copyInfo(c.metadata.Custom))
+}
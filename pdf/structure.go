@@ -0,0 +1,640 @@
+package pdf
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	cs "github.com/benoitkugler/pdf/contentstream"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+	"github.com/benoitkugler/webrender/backend"
+)
+
+// StructElement is an element of the logical structure of a document,
+// used to write tagged PDF files (see `Output.SetStructure`).
+type StructElement struct {
+	// Type is the standard structure type, like "Document", "P", "H1", "L", "LI",
+	// "LBody", "Table", "TH", "TD", "Link", "Figure" or "Form".
+	// It is empty for text chunks, and "Artifact" for decorative images, which
+	// are matched as figures but not included in the structure tree.
+	Type string
+
+	// Text is the content of a text chunk, which is
+	// matched with the text drawn on the pages.
+	Text string
+
+	Alt   string // alternate description, required for figures
+	Lang  string // language, if it differs from the one of the parent
+	Scope string // "Row", "Column" or "Both", for the table header cells
+	URL   string // target of a link : an URL, or '#' followed by an anchor name, or the `FormFieldURL` of a form field
+
+	Children []*StructElement
+}
+
+// SetStructure makes the output a tagged PDF file (as required by PDF/UA), whose
+// logical structure is given by `root`, usually a "Document" element built from the HTML
+// semantics. The language of `root` is used as the language of the document.
+//
+// Since the elements boundaries are not known when drawing, the text chunks and the
+// figures of the structure are matched with the text and the images drawn, in order.
+// The content which is not matched, like the backgrounds, the borders, and the generated
+// content (list markers, running headers and footers, etc...), is marked as artifact.
+// The content of the page margin boxes is only matched with the structure already drawn,
+// so that the running headers copying the following pages are marked as artifact.
+//
+// It must be called before adding pages.
+func (c *Output) SetStructure(root *StructElement) {
+	c.cache.tags = newTagger(root)
+}
+
+// SetStructure adds the logical structure of the part, usually a "Part" element,
+// at the end of the structure of the output, which must have been set with
+// `Output.SetStructure`. Fragment only links are resolved in the part.
+func (p *Part) SetStructure(root *StructElement) {
+	t := p.output.cache.tags
+	if t == nil {
+		return
+	}
+	var walk func(e *StructElement)
+	walk = func(e *StructElement) {
+		if strings.HasPrefix(e.URL, "#") {
+			e.URL = "#" + p.anchorName(e.URL[1:])
+		}
+		for _, child := range e.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+	t.root.Children = append(t.root.Children, root)
+	t.index(root, t.root)
+}
+
+// the number of text chunks searched around the last one matched
+const searchWindow = 100
+
+// tagger matches the content drawn with the logical
+// structure of the document (see `Output.SetStructure`).
+type tagger struct {
+	root    *StructElement
+	parents map[*StructElement]*StructElement
+
+	leaves []leaf // text chunks and figures, in document order
+	last   int    // index of the last leaf matched
+
+	// content of the text chunks and elements, in drawing order
+	items map[*StructElement][]structItem
+
+	// links with content on the page `linksPage`, used to
+	// tag the link annotations
+	links     []*StructElement
+	linksPage int
+
+	// elements created for the annotations not found in the structure
+	orphans []*StructElement
+
+	// "Form" elements, by URL, receiving the widgets of the form fields
+	forms map[string]*StructElement
+
+	nextKey int // next StructParent(s) key
+}
+
+type leaf struct {
+	elem *StructElement
+	text []rune // normalized, nil for figures
+	done int    // number of runes of `text` already drawn, or 1 for drawn figures
+}
+
+// structItem is a marked-content sequence of a page, or an annotation.
+type structItem struct {
+	page  int
+	mcid  int
+	annot *model.AnnotationDict // if not nil, mcid is ignored
+}
+
+func newTagger(root *StructElement) *tagger {
+	t := &tagger{
+		root:      root,
+		parents:   make(map[*StructElement]*StructElement),
+		items:     make(map[*StructElement][]structItem),
+		linksPage: -1,
+		forms:     make(map[string]*StructElement),
+	}
+	t.index(root, nil)
+	return t
+}
+
+// index registers `e` and its descendants
+func (t *tagger) index(e, parent *StructElement) {
+	t.parents[e] = parent
+	if e.Type == "" {
+		t.leaves = append(t.leaves, leaf{elem: e, text: normalizeText(e.Text)})
+	} else if (e.Type == "Figure" || e.Type == "Artifact") && len(e.Children) == 0 {
+		t.leaves = append(t.leaves, leaf{elem: e})
+	} else if e.Type == "Form" && e.URL != "" {
+		t.forms[e.URL] = e
+	}
+	for _, child := range e.Children {
+		t.index(child, e)
+	}
+}
+
+// normalizeText removes the spaces and the case of `s`,
+// which may be changed by the layout.
+func normalizeText(s string) []rune {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '\u00ad' || r == '\u200b' {
+			continue
+		}
+		out = append(out, unicode.ToLower(r))
+	}
+	return out
+}
+
+// matchText returns the text chunk containing `drawn`, which is then marked
+// as drawn, or nil. Since the drawing order may differ from the document order
+// (for floats or positioned elements), the chunks are searched around the last one matched,
+// or, if `before` is true, only up to the last one matched.
+func (t *tagger) matchText(drawn string, before bool) *StructElement {
+	text := normalizeText(drawn)
+	if len(text) == 0 {
+		return nil
+	}
+	candidates := [][]rune{text}
+	// a hyphen or an ellipsis may be added when breaking or truncating lines
+	if r := text[len(text)-1]; len(text) > 1 && (r == '-' || r == '‐' || r == '…') {
+		candidates = append(candidates, text[:len(text)-1])
+	}
+	match := func(i int) bool {
+		l := &t.leaves[i]
+		if l.text == nil {
+			return false
+		}
+		remaining := l.text[l.done:]
+		for _, c := range candidates {
+			if len(c) <= len(remaining) && slices.Equal(remaining[:len(c)], c) {
+				l.done += len(c)
+				t.last = i
+				return true
+			}
+		}
+		return false
+	}
+	if !before {
+		for i := t.last; i < len(t.leaves) && i <= t.last+searchWindow; i++ {
+			if match(i) {
+				return t.leaves[i].elem
+			}
+		}
+	}
+	start := t.last - 1 // t.last has already been tried
+	if before {
+		start = t.last
+	}
+	for i := start; i >= 0 && i >= t.last-searchWindow; i-- {
+		if match(i) {
+			return t.leaves[i].elem
+		}
+	}
+	return nil
+}
+
+// matchFigure returns the first figure (or decorative image) not drawn yet,
+// following the last text chunk matched, or, if `before` is true,
+// the last one preceding it, or nil.
+func (t *tagger) matchFigure(before bool) *StructElement {
+	take := func(i int) bool {
+		l := &t.leaves[i]
+		if l.text != nil || l.done != 0 {
+			return false
+		}
+		l.done = 1
+		return true
+	}
+	if before {
+		for i := t.last; i >= 0 && i >= t.last-searchWindow; i-- {
+			if take(i) {
+				return t.leaves[i].elem
+			}
+		}
+		return nil
+	}
+	for i := t.last; i < len(t.leaves) && i <= t.last+searchWindow; i++ {
+		if take(i) {
+			return t.leaves[i].elem
+		}
+	}
+	return nil
+}
+
+// structType returns the type of the element owning the content of `e`
+func (t *tagger) structType(e *StructElement) string {
+	if e.Type == "" {
+		return t.parents[e].Type
+	}
+	return e.Type
+}
+
+// add records that `item` is part of `e`
+func (t *tagger) add(e *StructElement, item structItem) {
+	t.items[e] = append(t.items[e], item)
+	for p := e; p != nil; p = t.parents[p] {
+		if p.Type != "Link" {
+			continue
+		}
+		if t.linksPage != item.page {
+			t.links, t.linksPage = t.links[:0], item.page
+		}
+		if !slices.Contains(t.links, p) {
+			t.links = append(t.links, p)
+		}
+		break
+	}
+}
+
+// text returns the text content of `e`
+func (t *tagger) text(e *StructElement) string {
+	var chunks []string
+	var walk func(e *StructElement)
+	walk = func(e *StructElement) {
+		if e.Text != "" {
+			chunks = append(chunks, strings.Join(strings.Fields(e.Text), " "))
+		}
+		for _, child := range e.Children {
+			walk(child)
+		}
+	}
+	walk(e)
+	return strings.Join(chunks, " ")
+}
+
+// tagAnnotation adds the annotation `annot`, pointing to `target`, to the link element
+// with the same target drawn on the page, or, if there is none, to a new element.
+func (cp *outputPage) tagAnnotation(annot *model.AnnotationDict, target string) {
+	t := cp.tags
+	if t == nil {
+		return
+	}
+	var elem *StructElement
+	if page := cp.group.page; t.linksPage == page {
+		// prefer the links which are not annotated yet
+		for _, link := range t.links {
+			if link.URL != target {
+				continue
+			}
+			if elem == nil || t.hasAnnotation(elem, page) && !t.hasAnnotation(link, page) {
+				elem = link
+			}
+		}
+	}
+	if elem == nil {
+		elem = t.forms[target]
+	}
+	if elem == nil {
+		typ := "Link"
+		switch annot.Subtype.(type) {
+		case model.AnnotationFileAttachment:
+			typ = "Annot"
+		case model.AnnotationWidget:
+			typ = "Form"
+		}
+		elem = &StructElement{Type: typ, URL: target, Alt: target}
+		t.orphans = append(t.orphans, elem)
+	}
+	// the alternate description of the annotation, required by PDF/UA
+	annot.Contents = t.text(elem)
+	if annot.Contents == "" {
+		annot.Contents = elem.Alt
+	}
+	if annot.Contents == "" {
+		annot.Contents = target
+	}
+	t.items[elem] = append(t.items[elem], structItem{page: cp.group.page, annot: annot})
+}
+
+func (t *tagger) hasAnnotation(e *StructElement, page int) bool {
+	for _, item := range t.items[e] {
+		if item.annot != nil && item.page == page {
+			return true
+		}
+	}
+	return false
+}
+
+// finalizeStructure closes the marked-content sequences of the page,
+// and gives the page and its annotations a key in the parent tree.
+func (cp *outputPage) finalizeStructure() {
+	t := cp.tags
+	cp.closeMark()
+	cp.page.Tabs = "S" // follow the structure order
+	if cp.mark.mcids != 0 {
+		cp.page.StructParents = model.ObjInt(t.nextKey)
+		t.nextKey++
+	}
+	for _, annot := range cp.page.Annots {
+		annot.StructParent = model.ObjInt(t.nextKey)
+		t.nextKey++
+	}
+}
+
+// structureTree returns the structure tree of the document, restricted to the content of `pages`,
+// indexed by page. The parent tree is not set : it is added by `fixStructure`.
+func (t *tagger) structureTree(pages map[int]*model.PageObject) *model.StructureTree {
+	var convert func(e *StructElement) *model.StructureElement
+	convert = func(e *StructElement) *model.StructureElement {
+		out := &model.StructureElement{S: model.Name(e.Type), Alt: e.Alt, Lang: e.Lang}
+		if e.Scope != "" {
+			out.A = []model.AttributeObject{{
+				O:          "Table",
+				Attributes: map[model.Name]model.Object{"Scope": model.Name(e.Scope)},
+			}}
+		}
+		addItems := func(items []structItem) {
+			for _, item := range items {
+				page := pages[item.page]
+				if page == nil { // dropped page
+					continue
+				}
+				if item.annot != nil {
+					if !slices.Contains(page.Annots, item.annot) { // dropped link
+						continue
+					}
+					out.K = append(out.K, model.ContentItemObjectReference{Pg: page, Obj: item.annot})
+				} else {
+					out.K = append(out.K, model.ContentItemMarkedReference{MCID: item.mcid, Container: page})
+				}
+			}
+		}
+		for _, child := range e.Children {
+			if child.Type == "Artifact" {
+				continue
+			} else if child.Type == "" {
+				addItems(t.items[child])
+			} else if kid := convert(child); kid != nil {
+				kid.P = out
+				out.K = append(out.K, kid)
+			}
+		}
+		addItems(t.items[e])
+		if len(out.K) == 0 {
+			return nil
+		}
+		return out
+	}
+
+	root := convert(t.root)
+	if root == nil {
+		root = &model.StructureElement{S: model.Name(t.root.Type), Lang: t.root.Lang}
+	}
+	for _, orphan := range t.orphans {
+		if kid := convert(orphan); kid != nil {
+			kid.P = root
+			root.K = append(root.K, kid)
+		}
+	}
+	return &model.StructureTree{K: []*model.StructureElement{root}}
+}
+
+// setStructure adds the structure tree to the document, restricted to `pages`.
+func (c *Output) setStructure(pages map[int]*model.PageObject) {
+	t := c.cache.tags
+	c.document.Catalog.StructTreeRoot = t.structureTree(pages)
+	c.document.Catalog.MarkInfo = &model.MarkDict{Marked: true}
+	c.document.Catalog.Lang = t.root.Lang
+	if c.document.Trailer.Info.Title == "" {
+		c.cache.report(diagnostics.Diagnostic{
+			Severity: diagnostics.Warning,
+			Code:     diagnostics.NonConformant,
+			Message:  "a document title is required by PDF/UA",
+			Page:     -1,
+		})
+	}
+}
+
+// the depth of the graphic stacks opened by webrender for the children of
+// the page box : the root element, the footnote area, and then the page margin boxes
+const pageBoxDepth = 4
+
+// markState is the marked-content sequence opened
+// in the content stream of a page of a tagged output.
+type markState struct {
+	open   bool
+	owner  *StructElement // text chunk or figure, nil for artifacts
+	mcids  int            // number of identifiers used in the page
+	inText bool           // between BT and ET, where sequences are not started
+
+	depth     int // number of graphic stacks opened
+	pageBoxes int // number of stacks opened at pageBoxDepth
+}
+
+// pushStack records a new graphic stack
+func (m *markState) pushStack() {
+	m.depth++
+	if m.depth == pageBoxDepth {
+		m.pageBoxes++
+	}
+}
+
+// afterRoot returns true when drawing the children of the page box following
+// the root element : the footnote area, if any, and the page margin boxes.
+func (m *markState) afterRoot() bool {
+	return m.depth >= pageBoxDepth && m.pageBoxes > 1
+}
+
+// isAfterRoot returns true if `g` is drawn after the root element of its page.
+// This content is only matched with the structure already drawn, since the page margin
+// boxes may copy the content of the following pages (running elements, etc...)
+func (g *group) isAfterRoot() bool {
+	return g.afterRoot || g.mark != nil && g.mark.afterRoot()
+}
+
+// closeMark ends the marked-content sequence, if any.
+// It must be called before saving or restoring the graphic state.
+func (g *group) closeMark() {
+	if g.mark == nil || !g.mark.open || g.mark.inText {
+		return
+	}
+	g.stream.Ops(cs.OpEndMarkedContent{})
+	g.mark.open, g.mark.owner = false, nil
+}
+
+// markArtifact starts an artifact sequence, if needed.
+func (g *group) markArtifact() {
+	if g.mark == nil || g.mark.inText || (g.mark.open && g.mark.owner == nil) {
+		return
+	}
+	g.closeMark()
+	g.stream.Ops(cs.OpBeginMarkedContent{Tag: "Artifact"})
+	g.mark.open = true
+}
+
+// markContent starts a sequence for the content of `owner`, a text chunk or
+// a figure, or, if `owner` is nil or decorative, an artifact sequence.
+func (g *group) markContent(owner *StructElement) {
+	if owner == nil || owner.Type == "Artifact" {
+		g.markArtifact()
+		return
+	}
+	if g.mark == nil || g.mark.inText || (g.mark.open && g.mark.owner == owner) {
+		return
+	}
+	g.closeMark()
+	mcid := g.mark.mcids
+	g.mark.mcids++
+	g.stream.Ops(cs.OpBeginMarkedContent{
+		Tag:        model.ObjName(escapeName(g.tags.structType(owner))),
+		Properties: cs.PropertyListDict{"MCID": model.ObjInt(mcid)},
+	})
+	g.mark.open, g.mark.owner = true, owner
+	g.tags.add(owner, structItem{page: g.page, mcid: mcid})
+}
+
+// markText matches the text to draw with the structure : on pages, a sequence is
+// started, and in groups, the text chunk is used when drawing the group.
+func (g *group) markText(texts []backend.TextDrawing) {
+	if g.tags == nil {
+		return
+	}
+	var text strings.Builder
+	for _, t := range texts {
+		text.WriteString(string(t.Text))
+	}
+	owner := g.tags.matchText(text.String(), g.isAfterRoot())
+	if g.mark == nil {
+		if g.matched == nil {
+			g.matched = owner
+		}
+		return
+	}
+	g.markContent(owner)
+	g.mark.inText = true
+}
+
+// endText ends a text object started after `markText`
+func (g *group) endText() {
+	g.stream.EndText()
+	if g.mark != nil {
+		g.mark.inText = false
+	}
+}
+
+// markImage matches an image drawn on a page with the figures of the structure.
+func (g *group) markImage() {
+	if g.mark == nil || g.mark.inText {
+		return
+	}
+	g.markContent(g.tags.matchFigure(g.isAfterRoot()))
+}
+
+// markGroup marks `gr`, drawn in `g`, as the text chunk it contains, if any.
+func (g *group) markGroup(gr *group) {
+	if g.tags == nil {
+		return
+	}
+	if g.mark == nil {
+		if g.matched == nil {
+			g.matched = gr.matched
+		}
+		return
+	}
+	g.markContent(gr.matched)
+}
+
+// fixStructure completes the structure tree written by model.Document.Write,
+// adding the parent of the elements and the parent tree.
+// It also asks the viewers to display the document title, as required by PDF/UA.
+func fixStructure(raw *file.PDFFile) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	treeRef, _ := root["StructTreeRoot"].(model.ObjIndirectRef)
+	tree, _ := raw.XrefTable[treeRef.ObjectNumber].(model.ObjDict)
+	if tree == nil {
+		return
+	}
+
+	marked := make(map[int]model.ObjArray) // page key -> elements, indexed by MCID
+	objects := make(map[int]model.Object)  // annotation key -> element
+	var walk func(ref, parent model.ObjIndirectRef)
+	walk = func(ref, parent model.ObjIndirectRef) {
+		elem, _ := raw.XrefTable[ref.ObjectNumber].(model.ObjDict)
+		if elem == nil {
+			return
+		}
+		elem["Type"] = model.Name("StructElem")
+		elem["P"] = parent
+		for _, empty := range []model.Name{"A", "C"} {
+			if a, _ := elem[empty].(model.ObjArray); len(a) == 0 {
+				delete(elem, empty)
+			}
+		}
+		kids, _ := elem["K"].(model.ObjArray)
+		for _, kid := range kids {
+			switch kid := kid.(type) {
+			case model.ObjIndirectRef:
+				walk(kid, ref)
+			case model.ObjDict:
+				switch kid["Type"] {
+				case model.Name("MCR"):
+					page, _ := raw.ResolveObject(kid["Pg"]).(model.ObjDict)
+					key, ok := page["StructParents"].(model.ObjInt)
+					mcid, _ := kid["MCID"].(model.ObjInt)
+					if !ok || mcid < 0 {
+						continue
+					}
+					parents := marked[int(key)]
+					for len(parents) <= int(mcid) {
+						parents = append(parents, model.ObjNull{})
+					}
+					parents[mcid] = ref
+					marked[int(key)] = parents
+				case model.Name("OBJR"):
+					annot, _ := raw.ResolveObject(kid["Obj"]).(model.ObjDict)
+					if key, ok := annot["StructParent"].(model.ObjInt); ok {
+						objects[int(key)] = ref
+					}
+				}
+			}
+		}
+	}
+	kids, _ := tree["K"].(model.ObjArray)
+	for _, kid := range kids {
+		if ref, ok := kid.(model.ObjIndirectRef); ok {
+			walk(ref, treeRef)
+		}
+	}
+
+	keys := make([]int, 0, len(marked)+len(objects))
+	for key := range marked {
+		keys = append(keys, key)
+	}
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	var nums model.ObjArray
+	for _, key := range keys {
+		if parents, ok := marked[key]; ok {
+			nums = append(nums, model.ObjInt(key), parents)
+		} else {
+			nums = append(nums, model.ObjInt(key), objects[key])
+		}
+	}
+	nextKey := 0
+	if len(keys) != 0 {
+		nextKey = keys[len(keys)-1] + 1
+	}
+	tree["ParentTree"] = addRawObject(raw, model.ObjDict{"Nums": nums})
+	tree["ParentTreeNextKey"] = model.ObjInt(nextKey)
+	// the elements have no ID, and no role or class is used
+	delete(tree, "IDTree")
+	delete(tree, "RoleMap")
+	delete(tree, "ClassMap")
+
+	if prefs, ok := raw.ResolveObject(root["ViewerPreferences"]).(model.ObjDict); ok {
+		prefs["DisplayDocTitle"] = model.ObjBool(true)
+	} else {
+		root["ViewerPreferences"] = model.ObjDict{"DisplayDocTitle": model.ObjBool(true)}
+	}
+}
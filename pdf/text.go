@@ -2,16 +2,17 @@ package pdf
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
-	"log"
 	"sort"
 	"strings"
+	"unicode/utf16"
 
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/progress"
 	"github.com/benoitkugler/pdf/contentstream"
 	pdfFonts "github.com/benoitkugler/pdf/fonts"
-	"github.com/benoitkugler/pdf/fonts/cmaps"
 	"github.com/benoitkugler/pdf/model"
 	"github.com/benoitkugler/webrender/backend"
 	"github.com/benoitkugler/webrender/text"
@@ -45,8 +46,9 @@ func (g *group) SetTextPaint(op backend.PaintOp) {
 
 // DrawText draws the given text using the current fill color.
 func (g *group) DrawText(texts []backend.TextDrawing) {
+	g.markText(texts)
 	g.stream.BeginText()
-	defer g.stream.EndText()
+	defer g.endText()
 
 	for _, text := range texts {
 		mat := text.Matrix()
@@ -58,6 +60,11 @@ func (g *group) DrawText(texts []backend.TextDrawing) {
 			// do not use bitmap fonts
 			useFont := g.cache.fontFiles[run.Font.Origin()].isSupported
 
+			if g.fontPages[run.Font] == nil {
+				g.fontPages[run.Font] = make(map[int]bool)
+			}
+			g.fontPages[run.Font][g.page] = true
+
 			if useFont {
 				g.stream.SetFontAndSize(pdfFonts.BuiltFont{Meta: pf.FontDict}, text.FontSize)
 			}
@@ -83,13 +90,9 @@ func (g *group) DrawText(texts []backend.TextDrawing) {
 	}
 }
 
-func (f pdfFont) newFontDescriptor(font backend.Font, content *model.FontFile) model.FontDescriptor {
+func (f pdfFont) newFontDescriptor(font backend.Font, content *model.FontFile, tag string) model.FontDescriptor {
 	desc := font.Description()
 
-	hash_ := md5.Sum([]byte(fmt.Sprint(desc.Family,
-		desc.Style, desc.Weight, desc.Size)))
-	hash := string(hex.EncodeToString(hash_[:]))
-
 	flags := model.Symbolic // since we use a custom char set
 	if desc.Style != text.FSyNormal {
 		flags |= model.Italic
@@ -103,7 +106,7 @@ func (f pdfFont) newFontDescriptor(font backend.Font, content *model.FontFile) m
 
 	bbox := f.FontChars.Bbox
 	return model.FontDescriptor{
-		FontName:    model.ObjName(hash + "+" + strings.ReplaceAll(desc.Family, " ", "")),
+		FontName:    model.ObjName(tag + "+" + strings.ReplaceAll(desc.Family, " ", "")),
 		FontFamily:  desc.Family,
 		Flags:       flags,
 		FontBBox:    model.Rectangle{Llx: fl(bbox[0]), Lly: fl(bbox[1]), Urx: fl(bbox[2]), Ury: fl(bbox[3])},
@@ -140,9 +143,25 @@ func (g *group) AddFont(font backend.Font, content []byte) *backend.FontChars {
 	origin := font.Origin()
 	// until then, we store the content
 	if _, ok := g.fontFiles[origin]; !ok {
-		g.fontFiles[origin] = fontContent{
-			content:     content,
-			isSupported: isSupportedFont(content),
+		fc := g.shared.fontContent(content)
+		g.fontFiles[origin] = fc
+		if !fc.isSupported {
+			g.report(diagnostics.Diagnostic{
+				Severity: diagnostics.Warning,
+				Code:     diagnostics.FontUnsupported,
+				Message:  fmt.Sprintf("unsupported font %s: the text using it is not drawn", font.Description().Family),
+				URL:      origin.File,
+				Page:     g.page,
+			})
+			if g.conformance != NoConformance {
+				g.report(diagnostics.Diagnostic{
+					Severity: diagnostics.Error,
+					Code:     diagnostics.NonConformant,
+					Message:  fmt.Sprintf("font %s can't be embedded, as required by %s", font.Description().Family, g.conformance),
+					URL:      origin.File,
+					Page:     g.page,
+				})
+			}
 		}
 	}
 
@@ -217,8 +236,10 @@ func isSupportedFont(content []byte) bool {
 	return hasValidGlyf || hasCff || hasBitmap
 }
 
-func newFontFile(fontDesc backend.FontDescription, font pdfFont, content []byte) *model.FontFile {
-	fs := &model.FontFile{}
+// newFontFile returns the font file to embed. If the subsetting fails,
+// the whole font is used and the error is returned.
+func (c cache) newFontFile(fontDesc backend.FontDescription, font pdfFont, content []byte) (fs *model.FontFile, subsetErr error) {
+	fs = &model.FontFile{}
 	if fontDesc.IsOpentype {
 		// subset the font
 		set := glyphSet{}
@@ -227,7 +248,7 @@ func newFontFile(fontDesc backend.FontDescription, font pdfFont, content []byte)
 		}
 		contentS, err := subset(bytes.NewReader(content), set)
 		if err != nil {
-			log.Printf("font subsetting failed: %s", err)
+			subsetErr = err
 		} else {
 			content = contentS
 		}
@@ -238,8 +259,8 @@ func newFontFile(fontDesc backend.FontDescription, font pdfFont, content []byte)
 			fs.Length1 = len(content)
 		}
 	}
-	fs.Stream = model.Stream{Content: content}
-	return fs
+	fs.Stream = c.newStream(content)
+	return fs, subsetErr
 }
 
 // TODO: see https://github.com/benoitkugler/webrender/issues/3
@@ -403,21 +424,136 @@ func newFontFile(fontDesc backend.FontDescription, font pdfFont, content []byte)
 //     font_dictionary['CharProcs'] = char_procs.reference
 // 		}
 
+// isFontUsed returns true if the font is used by one of the kept pages
+func (c *Output) isFontUsed(font backend.Font, newIndices []int) bool {
+	for page := range c.cache.fontPages[font] {
+		if newIndices[page] != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// subsetTag returns the six uppercase letters prefixing the name of a
+// font subset, derived from the font file and the glyphs used,
+// so that the same subset always gets the same name.
+func subsetTag(content []byte, glyphs map[backend.GID][]rune) string {
+	gids := make([]backend.GID, 0, len(glyphs))
+	for gid := range glyphs {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	h := sha256.New()
+	h.Write(content)
+	for _, gid := range gids {
+		binary.Write(h, binary.BigEndian, uint32(gid))
+	}
+	sum := h.Sum(nil)
+	var tag [6]byte
+	for i := range tag {
+		tag[i] = 'A' + sum[i]%26
+	}
+	return string(tag[:])
+}
+
+// fontKey identifies a font, so that fonts are embedded in a stable order
+func fontKey(font backend.Font) string {
+	return fmt.Sprint(font.Origin(), font.Description())
+}
+
+// sortedFonts returns the fonts used, in a stable order
+func (c *Output) sortedFonts() []backend.Font {
+	out := make([]backend.Font, 0, len(c.cache.fonts))
+	for bFont := range c.cache.fonts {
+		out = append(out, bFont)
+	}
+	sort.Slice(out, func(i, j int) bool { return fontKey(out[i]) < fontKey(out[j]) })
+	return out
+}
+
+// toUnicodeCMap returns the ToUnicode CMap of a font using the Identity-H encoding,
+// with the glyphs sorted, so that the output is deterministic.
+func toUnicodeCMap(glyphs map[backend.GID][]rune) []byte {
+	gids := make([]backend.GID, 0, len(glyphs))
+	for gid := range glyphs {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	var buf bytes.Buffer
+	buf.WriteString(`/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CIDSystemInfo
+<< /Registry (Adobe)
+/Ordering (UCS)
+/Supplement 0
+>> def
+/CMapName /Adobe-Identity-UCS def
+/CMapType 2 def
+1 begincodespacerange
+<0000> <ffff>
+endcodespacerange
+`)
+	// a bfchar section is limited to 100 entries
+	for start := 0; start < len(gids); start += 100 {
+		chunk := gids[start:min(start+100, len(gids))]
+		fmt.Fprintf(&buf, "%d beginbfchar\n", len(chunk))
+		for _, gid := range chunk {
+			fmt.Fprintf(&buf, "<%04x> <", gid)
+			for _, u := range utf16.Encode(glyphs[gid]) {
+				fmt.Fprintf(&buf, "%04x", u)
+			}
+			buf.WriteString(">\n")
+		}
+		buf.WriteString("endbfchar\n")
+	}
+	buf.WriteString(`endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`)
+	return buf.Bytes()
+}
+
 // post-process the font used
-func (c *Output) writeFonts() {
-	for bFont, font := range c.cache.fonts {
+func (c *Output) writeFonts(newIndices []int) {
+	var toEmbed []backend.Font
+	for _, bFont := range c.sortedFonts() {
+		font := c.cache.fonts[bFont]
 		if len(font.Cmap) == 0 {
 			continue
 		}
 
-		content := c.cache.fontFiles[bFont.Origin()]
+		if !c.selection.IsAll() && !c.isFontUsed(bFont, newIndices) {
+			continue
+		}
+
 		// PDF readers do not support bitmap fonts
-		if !content.isSupported {
+		if !c.cache.fontFiles[bFont.Origin()].isSupported {
 			continue
 		}
 
-		fs := newFontFile(bFont.Description(), font, content.content)
-		desc := font.newFontDescriptor(bFont, fs)
+		toEmbed = append(toEmbed, bFont)
+	}
+
+	c.cache.progress.report(progress.FontSubsetting, 0, len(toEmbed))
+	for i, bFont := range toEmbed {
+		c.checkContext()
+
+		font := c.cache.fonts[bFont]
+		content := c.cache.fontFiles[bFont.Origin()]
+		fs, err := c.cache.newFontFile(bFont.Description(), font, content.content)
+		if err != nil {
+			c.cache.report(diagnostics.Diagnostic{
+				Severity: diagnostics.Info,
+				Code:     diagnostics.FontSubsetFailed,
+				Message:  fmt.Sprintf("font subsetting failed: %s", err),
+				URL:      bFont.Origin().File,
+				Page:     -1,
+			})
+		}
+		desc := font.newFontDescriptor(bFont, fs, subsetTag(content.content, font.Cmap))
 		widths := cidWidths(font.Extents)
 
 		font.FontDict.Subtype = model.FontType0{
@@ -435,7 +571,13 @@ func (c *Output) writeFonts() {
 				FontDescriptor: desc,
 			},
 		}
-		cmap := cmaps.WriteAdobeIdentityUnicodeCMap(font.Cmap)
-		font.FontDict.ToUnicode = &model.UnicodeCMap{Stream: model.Stream{Content: cmap}}
+		if c.cache.conformance != NoConformance { // required by PDF/A
+			cid := font.FontDict.Subtype.(model.FontType0)
+			cid.DescendantFonts.CIDToGIDMap = model.CIDToGIDMapIdentity{}
+			font.FontDict.Subtype = cid
+		}
+		font.FontDict.ToUnicode = &model.UnicodeCMap{Stream: c.cache.newStream(toUnicodeCMap(font.Cmap))}
+
+		c.cache.progress.report(progress.FontSubsetting, i+1, len(toEmbed))
 	}
 }
@@ -0,0 +1,167 @@
+package pdf
+
+import (
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+)
+
+// PageLayout is the arrangement of the pages when the document is opened.
+type PageLayout uint8
+
+const (
+	DefaultLayout  PageLayout = iota // chosen by the viewer
+	SinglePage                       // one page at a time
+	OneColumn                        // the pages in one column
+	TwoColumnLeft                    // the pages in two columns, odd-numbered pages on the left
+	TwoColumnRight                   // the pages in two columns, odd-numbered pages on the right
+	TwoPageLeft                      // two pages at a time, odd-numbered pages on the left
+	TwoPageRight                     // two pages at a time, odd-numbered pages on the right
+)
+
+var pageLayoutNames = [...]model.Name{"", "SinglePage", "OneColumn", "TwoColumnLeft", "TwoColumnRight", "TwoPageLeft", "TwoPageRight"}
+
+// PageMode is the panel shown when the document is opened.
+type PageMode uint8
+
+const (
+	DefaultMode     PageMode = iota // chosen by the viewer
+	ShowNone                        // no panel
+	ShowBookmarks                   // the outline panel
+	ShowThumbnails                  // the page thumbnails
+	ShowAttachments                 // the attachments panel
+	FullScreen                      // no menu bar, no window controls
+)
+
+var pageModeNames = [...]model.Name{"", "UseNone", "UseOutlines", "UseThumbs", "UseAttachments", "FullScreen"}
+
+// OpenView is the zoom of the first page when the document is opened.
+type OpenView uint8
+
+const (
+	DefaultView OpenView = iota // chosen by the viewer
+	FitPage                     // the whole page
+	FitWidth                    // the width of the page
+)
+
+// Duplex is the paper handling hint of the print dialog.
+type Duplex uint8
+
+const (
+	DefaultDuplex       Duplex = iota // chosen by the printer
+	Simplex                           // one side
+	DuplexFlipShortEdge               // two sides, flipped on the short edge
+	DuplexFlipLongEdge                // two sides, flipped on the long edge
+)
+
+var duplexNames = [...]model.Name{"", "Simplex", "DuplexFlipShortEdge", "DuplexFlipLongEdge"}
+
+// Direction is the reading order of the pages, used by the viewers
+// to lay out the pages side by side.
+type Direction uint8
+
+const (
+	DefaultDirection Direction = iota // given by the document, see `Output.SetDirection`
+	LeftToRight
+	RightToLeft
+)
+
+// ViewerPreferences controls how the PDF viewers display the document,
+// and how they print it. The zero value keeps the viewer settings.
+type ViewerPreferences struct {
+	PageLayout PageLayout
+	PageMode   PageMode
+	OpenView   OpenView // applied to the first page
+	Direction  Direction
+
+	// DisplayDocTitle shows the title of the document in the window
+	// title bar, instead of the file name. It is always set for tagged documents.
+	DisplayDocTitle bool
+	// NoPrintScaling disables the scaling of the pages in the print dialog,
+	// so that the forms are printed at their actual size.
+	NoPrintScaling bool
+	Duplex         Duplex
+}
+
+// rawPreferences returns true if some preferences are not supported by model.Document.Write.
+func (prefs ViewerPreferences) rawPreferences() bool {
+	return prefs.DisplayDocTitle || prefs.NoPrintScaling || prefs.Duplex != DefaultDuplex
+}
+
+// SetViewerPreferences registers the viewer preferences
+// of the document, added to the catalog by `Finalize`.
+// Some of them must also be given to `WriteOptions.ViewerPreferences`
+// (see `Output.ViewerPreferences`).
+func (c *Output) SetViewerPreferences(prefs ViewerPreferences) { c.viewerPreferences = prefs }
+
+// SetDirection sets the reading order of the document, used when
+// the direction of the viewer preferences is `DefaultDirection`,
+// usually from the dir attribute of the <html> element.
+func (c *Output) SetDirection(direction Direction) { c.direction = direction }
+
+// ViewerPreferences returns the viewer preferences set by `SetViewerPreferences`,
+// with the default direction resolved.
+func (c *Output) ViewerPreferences() ViewerPreferences {
+	prefs := c.viewerPreferences
+	if prefs.Direction == DefaultDirection {
+		prefs.Direction = c.direction
+	}
+	return prefs
+}
+
+// setCatalogPreferences adds the viewer preferences supported by
+// model.Document to the catalog, `first` being the first written page.
+func (c *Output) setCatalogPreferences(first *model.PageObject) {
+	prefs, cat := c.ViewerPreferences(), &c.document.Catalog
+	cat.PageLayout = nameOf(pageLayoutNames[:], int(prefs.PageLayout))
+	cat.PageMode = nameOf(pageModeNames[:], int(prefs.PageMode))
+	cat.ViewerPreferences = nil
+	if prefs.Direction == RightToLeft {
+		cat.ViewerPreferences = &model.ViewerPreferences{DirectionRTL: true}
+	}
+	cat.OpenAction = model.Action{}
+	if first == nil || prefs.OpenView == DefaultView {
+		return
+	}
+	var location model.DestinationLocation = model.DestinationLocationFit("Fit")
+	if prefs.OpenView == FitWidth {
+		var top model.MaybeFloat
+		if first.MediaBox != nil {
+			top = model.ObjFloat(first.MediaBox.Ury)
+		}
+		location = model.DestinationLocationFitDim{Name: "FitH", Dim: top}
+	}
+	cat.OpenAction = model.Action{ActionType: model.ActionGoTo{
+		D: model.DestinationExplicitIntern{Page: first, Location: location},
+	}}
+}
+
+// addViewerPreferences adds the preferences not supported by
+// model.Document.Write to the raw file `raw`.
+func addViewerPreferences(raw *file.PDFFile, prefs ViewerPreferences) {
+	root, _ := raw.ResolveObject(raw.Root).(model.ObjDict)
+	if root == nil { // should not happen
+		return
+	}
+	dict, ok := raw.ResolveObject(root["ViewerPreferences"]).(model.ObjDict)
+	if !ok {
+		dict = model.ObjDict{}
+		root["ViewerPreferences"] = dict
+	}
+	if prefs.DisplayDocTitle {
+		dict["DisplayDocTitle"] = model.ObjBool(true)
+	}
+	if prefs.NoPrintScaling {
+		dict["PrintScaling"] = model.Name("None")
+	}
+	if duplex := nameOf(duplexNames[:], int(prefs.Duplex)); duplex != "" {
+		dict["Duplex"] = duplex
+	}
+}
+
+// nameOf returns names[i], or an empty name for invalid values.
+func nameOf(names []model.Name, i int) model.Name {
+	if i >= len(names) {
+		return ""
+	}
+	return names[i]
+}
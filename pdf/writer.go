@@ -0,0 +1,488 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader/file"
+)
+
+// rawWriter writes a PDF file made of raw objects (as found in a parsed file),
+// which may be written in any order.
+// It is used when the PDF file can't be written in one pass by `model.Document.Write`.
+type rawWriter struct {
+	dst     io.Writer
+	err     error // deferred error checking
+	written int   // number of bytes written to dst
+
+	// offsets of the objects, indexed by object number ([0] is unused),
+	// with -1 for the reserved but not (yet) written objects
+	offsets []int
+
+	// optional, hashes the content written to compute
+	// the document ID (see `WriteOptions.Reproducible`)
+	id hash.Hash
+
+	// optional, packs the objects into object streams (see `OptimizeSize`)
+	packer *objectPacker
+
+	// optional, encrypts the objects (see `WriteOptions.Encryption`)
+	crypt *encryptor
+}
+
+func newRawWriter(dst io.Writer) *rawWriter {
+	w := &rawWriter{dst: dst, offsets: []int{0}}
+	// same header as model.Document.Write
+	w.bytes([]byte("%PDF-1.7\n%\xc8\xc8\xc8\xc8\n"))
+	return w
+}
+
+func (w *rawWriter) bytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.dst.Write(b)
+	w.written += n
+	w.err = err
+	if w.id != nil {
+		w.id.Write(b[:n])
+	}
+}
+
+// reserve returns a new object number
+func (w *rawWriter) reserve() int {
+	w.offsets = append(w.offsets, -1)
+	return len(w.offsets) - 1
+}
+
+// writeObject writes the object `num`, which must have been reserved.
+func (w *rawWriter) writeObject(num int, obj model.Object) {
+	if _, isStream := obj.(model.ObjStream); !isStream && w.packer != nil && !isSignatureDict(obj) {
+		// the strings are encrypted with the object stream
+		w.pack(num, obj)
+		return
+	}
+	if w.crypt != nil {
+		var err error
+		if obj, err = w.crypt.encryptObject(num, obj); err != nil {
+			w.err = err
+			return
+		}
+	}
+	w.writeDirect(num, obj)
+}
+
+// writeDirect writes the object `num`, without packing nor encryption.
+func (w *rawWriter) writeDirect(num int, obj model.Object) {
+	w.offsets[num] = w.written
+	w.bytes([]byte(fmt.Sprintf("%d 0 obj\n", num)))
+	if stream, ok := obj.(model.ObjStream); ok {
+		w.bytes([]byte(rawStreamHeader(stream)))
+		w.bytes([]byte("\nstream\n"))
+		w.bytes(stream.Content)
+		w.bytes([]byte("\nendstream"))
+	} else {
+		w.bytes([]byte(rawString(obj)))
+	}
+	w.bytes([]byte("\nendobj\n"))
+}
+
+// freeList returns, for each object, the next free object
+// (or 0), since free objects are chained, starting from the object 0.
+func (w *rawWriter) freeList() []int {
+	nextFree := make([]int, len(w.offsets))
+	last := 0
+	for num := 1; num < len(w.offsets); num++ {
+		if w.offsets[num] == -1 {
+			nextFree[last] = num
+			last = num
+		}
+	}
+	return nextFree
+}
+
+// writeFooter writes the cross-reference table and the trailer,
+// and returns the first error encountered.
+// The reserved objects which have not been written are marked as free.
+func (w *rawWriter) writeFooter(root, info int) error {
+	var encrypt int
+	if w.crypt != nil {
+		encrypt = w.reserve()
+		w.writeDirect(encrypt, w.crypt.dict)
+	}
+	if w.packer != nil {
+		return w.writeXrefStream(root, info, encrypt)
+	}
+
+	var b bytes.Buffer
+	start := w.written
+	nextFree := w.freeList()
+
+	fmt.Fprintf(&b, "xref\n0 %d\n", len(w.offsets))
+	fmt.Fprintf(&b, "%010d 65535 f \n", nextFree[0])
+	for num := 1; num < len(w.offsets); num++ {
+		if w.offsets[num] == -1 {
+			fmt.Fprintf(&b, "%010d 00001 f \n", nextFree[num])
+		} else {
+			fmt.Fprintf(&b, "%010d 00000 n \n", w.offsets[num])
+		}
+	}
+	fmt.Fprintf(&b, "trailer\n<<\n/Size %d\n/Root %d 0 R\n", len(w.offsets), root)
+	if info != 0 {
+		fmt.Fprintf(&b, "/Info %d 0 R\n", info)
+	}
+	if encrypt != 0 {
+		fmt.Fprintf(&b, "/Encrypt %d 0 R\n", encrypt)
+	}
+	if id := w.fileID(); id != nil {
+		// the two identifiers are the same since the file is not updated
+		fmt.Fprintf(&b, "/ID [<%x> <%x>]\n", id, id)
+	}
+	fmt.Fprintf(&b, ">>\nstartxref\n%d\n%%%%EOF", start)
+	w.bytes(b.Bytes())
+	return w.err
+}
+
+// fileID returns the identifier of the file, which is required by
+// encryption, or derived from the content (see `WriteOptions.Reproducible`),
+// or nil.
+func (w *rawWriter) fileID() []byte {
+	if w.crypt != nil {
+		return w.crypt.id
+	}
+	if w.id != nil {
+		return w.id.Sum(nil)[:16]
+	}
+	return nil
+}
+
+// rawString returns the PDF representation of a raw object.
+// Dictionary keys are sorted, for deterministic output.
+func rawString(obj model.Object) string {
+	switch obj := obj.(type) {
+	case model.ObjDict:
+		return rawDictString(obj)
+	case model.ObjArray:
+		chunks := make([]string, len(obj))
+		for i, o := range obj {
+			chunks[i] = rawString(o)
+		}
+		return "[" + strings.Join(chunks, " ") + "]"
+	case model.ObjStream:
+		// streams are always indirect objects in parsed files
+		panic("unexpected direct stream object")
+	default:
+		// a nil writer disables encryption
+		return obj.Write(nil, 0)
+	}
+}
+
+// sortedKeys returns the keys of `dict`, in alphabetical order.
+func sortedKeys(dict model.ObjDict) []model.Name {
+	keys := make([]model.Name, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func rawDictString(dict model.ObjDict) string {
+	var b strings.Builder
+	b.WriteString("<<")
+	for _, k := range sortedKeys(dict) {
+		b.WriteString(k.String() + " " + rawString(dict[k]) + " ")
+	}
+	b.WriteString(">>")
+	return b.String()
+}
+
+// rawStreamHeader returns the dictionary of a stream, with
+// the Length adjusted to its content.
+func rawStreamHeader(stream model.ObjStream) string {
+	args := make(model.ObjDict, len(stream.Args)+1)
+	for k, v := range stream.Args {
+		args[k] = v
+	}
+	args["Length"] = model.ObjInt(len(stream.Content))
+	return rawDictString(args)
+}
+
+// WriteOptions are the output settings which are not supported
+// by model.Document.Write.
+type WriteOptions struct {
+	// CustomInfo stores additional entries of the document
+	// information dictionary (see `Metadata.Custom`).
+	CustomInfo map[string]string
+
+	// Reproducible makes the file only depend on the content of `doc` :
+	// the objects are numbered and written in a stable order, and the
+	// document ID is derived from the content.
+	// Note that the dates of the document information dictionary should
+	// also be fixed (see `Metadata` and `SourceDateEpoch`).
+	Reproducible bool
+
+	// Compression, if set to `OptimizeSize`, packs the objects into
+	// object streams, except for PDF/A-1.
+	// The compression of the streams is set by `Output.SetCompression`.
+	Compression Compression
+
+	// Conformance adds the XMP metadata, the output intent and the document ID
+	// required by PDF/A (see also `Output.SetConformance`).
+	Conformance Conformance
+
+	// Encryption, if not nil, protects the file with passwords.
+	// It is not allowed in PDF/A, nor with the OptimizeSize compression.
+	Encryption *Encryption
+
+	// Signature, if not nil, signs the file, filling the signature field
+	// marked by `SignatureFieldURL`, or an invisible one.
+	Signature *Signature
+
+	// Metadata is the XMP metadata packet attached to the catalog,
+	// as returned by `Output.XMPMetadata`.
+	// If empty, it is generated from the document information dictionary.
+	Metadata []byte
+
+	// ViewerPreferences adds the viewer preferences which are not supported by
+	// model.Document (DisplayDocTitle, NoPrintScaling and Duplex), as returned by `Output.ViewerPreferences`.
+	ViewerPreferences ViewerPreferences
+}
+
+// Write serializes `doc` into `target`, applying `opts`.
+// The structure tree of tagged documents (see `Output.SetStructure`) is completed,
+// and the XMP metadata is always attached to the catalog, which model.Document does not support.
+// Thus, the documents returned by `Output.Finalize` should be written with Write,
+// and not with model.Document.Write.
+func Write(doc model.Document, target io.Writer, opts WriteOptions) error {
+	tagged := doc.Catalog.StructTreeRoot != nil
+	forms := hasFieldKids(doc.Catalog.AcroForm)
+	labels := hasUnnumberedLabels(doc.Catalog.PageLabels)
+	if opts.Encryption != nil && opts.Conformance != NoConformance {
+		return fmt.Errorf("encryption is not allowed in %s", opts.Conformance)
+	}
+	if opts.Encryption != nil && opts.Compression == OptimizeSize {
+		return errors.New("encryption is not supported with object streams")
+	}
+
+	raw, err := toRaw(&doc)
+	if err != nil {
+		return err
+	}
+	info := withCustomInfo(doc.Trailer.Info, opts.CustomInfo)
+	packet := opts.Metadata
+	if len(packet) == 0 {
+		packet = xmpPacket(xmpDocument{info: info}, opts.Conformance, tagged)
+	}
+	addMetadata(&raw, packet)
+	if opts.Conformance != NoConformance {
+		addConformance(&raw, info, opts.Conformance)
+	}
+	if tagged {
+		fixStructure(&raw)
+	}
+	if forms {
+		fixFormFields(&raw)
+	}
+	if labels {
+		fixPageLabels(&raw)
+	}
+	if opts.ViewerPreferences.rawPreferences() {
+		addViewerPreferences(&raw, opts.ViewerPreferences)
+	}
+	if opts.Signature != nil {
+		if err := addSignature(&raw, opts.Signature, opts.Conformance); err != nil {
+			return err
+		}
+	}
+	newWriter := func(target io.Writer) *rawWriter {
+		w := newRawWriter(target)
+		if opts.Reproducible || opts.Conformance != NoConformance {
+			w.id = sha256.New()
+		}
+		if opts.Compression == OptimizeSize && opts.Conformance != PDFA1B {
+			w.packer = newObjectPacker()
+		}
+		return w
+	}
+
+	out := target
+	var signed bytes.Buffer
+	if opts.Signature != nil {
+		// the signature is computed on the whole file
+		out = &signed
+	}
+
+	w := newWriter(out)
+	if opts.Encryption != nil {
+		// the identifier is required before writing
+		id, seed := make([]byte, 16), []byte(nil)
+		if opts.Reproducible {
+			// use the identifier of the plain file, from which the random values are also derived
+			plain := newWriter(io.Discard)
+			if err := writeRaw(plain, raw, opts.CustomInfo); err != nil {
+				return err
+			}
+			id = plain.fileID()
+			seed = append(append(append(append([]byte(nil), id...), opts.Encryption.UserPassword...), 0), opts.Encryption.OwnerPassword...)
+		} else if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		if w.crypt, err = newEncryptor(*opts.Encryption, id, seed); err != nil {
+			return err
+		}
+	}
+	if err := writeRaw(w, raw, opts.CustomInfo); err != nil || opts.Signature == nil {
+		return err
+	}
+	if err := signFile(signed.Bytes(), opts.Signature); err != nil {
+		return err
+	}
+	_, err = target.Write(signed.Bytes())
+	return err
+}
+
+// writeRaw writes the objects of `raw` to `w`, with the `custom` information entries.
+func writeRaw(w *rawWriter, raw file.PDFFile, custom map[string]string) error {
+	copier := rawCopier{src: raw, dst: w, numbers: make(map[int]int)}
+	root := copier.copyRef(raw.Root)
+	return w.writeFooter(root, copier.copyInfo(custom))
+}
+
+// toRaw writes `doc` and parses it back,
+// returning the raw objects.
+func toRaw(doc *model.Document) (file.PDFFile, error) {
+	var buf bytes.Buffer
+	if err := doc.Write(&buf, nil); err != nil {
+		return file.PDFFile{}, err
+	}
+	return file.Read(bytes.NewReader(buf.Bytes()), file.NewDefaultConfiguration())
+}
+
+// rawCopier copies the objects of a parsed file
+// to a rawWriter, renumbering them.
+type rawCopier struct {
+	src file.PDFFile
+	dst *rawWriter
+
+	// object numbers in the output, for the objects of `src`
+	// already written, being written or mapped to an existing object
+	numbers map[int]int
+
+	// streams already written, indexed by content (see `streamKey`),
+	// so that resources shared by several pages are only written once.
+	// May be nil to disable deduplication.
+	streams map[[32]byte]int
+}
+
+// copyRef returns the number in the output of the object `ref`, copying it
+// (and its children) if needed.
+func (rc *rawCopier) copyRef(ref model.ObjIndirectRef) int {
+	if num, ok := rc.numbers[ref.ObjectNumber]; ok {
+		if num == -1 { // stream referenced by one of its children : no deduplication
+			num = rc.dst.reserve()
+			rc.numbers[ref.ObjectNumber] = num
+		}
+		return num
+	}
+	obj, ok := rc.src.XrefTable[ref.ObjectNumber]
+	if !ok { // invalid reference, should not happen
+		return 0
+	}
+
+	stream, isStream := obj.(model.ObjStream)
+	if !isStream || rc.streams == nil {
+		num := rc.dst.reserve()
+		rc.numbers[ref.ObjectNumber] = num // the object may reference itself
+		rc.dst.writeObject(num, rc.copy(obj))
+		return num
+	}
+
+	// streams are written after their children, to detect duplicates
+	rc.numbers[ref.ObjectNumber] = -1
+	stream.Args = rc.copy(stream.Args).(model.ObjDict)
+	if num := rc.numbers[ref.ObjectNumber]; num != -1 {
+		rc.dst.writeObject(num, stream)
+		return num
+	}
+	key := streamKey(stream)
+	num, ok := rc.streams[key]
+	if !ok {
+		num = rc.dst.reserve()
+		rc.dst.writeObject(num, stream)
+		rc.streams[key] = num
+	}
+	rc.numbers[ref.ObjectNumber] = num
+	return num
+}
+
+// copyRefTo copies the object `ref` (which must not be a stream), using the
+// reserved number `num` in the output.
+func (rc *rawCopier) copyRefTo(ref model.ObjIndirectRef, num int) {
+	rc.numbers[ref.ObjectNumber] = num
+	rc.dst.writeObject(num, rc.copy(rc.src.XrefTable[ref.ObjectNumber]))
+}
+
+// copyInfo copies the information dictionary of the source, adding the `custom` entries,
+// and returns its number in the output, or 0 if there is no information.
+func (rc *rawCopier) copyInfo(custom map[string]string) int {
+	var info model.ObjDict
+	if rc.src.Info != nil {
+		info, _ = rc.copy(rc.src.ResolveObject(*rc.src.Info)).(model.ObjDict)
+	}
+	if info == nil {
+		if len(custom) == 0 {
+			return 0
+		}
+		info = model.ObjDict{}
+	}
+	addCustomInfo(info, custom)
+	num := rc.dst.reserve()
+	rc.dst.writeObject(num, info)
+	return num
+}
+
+// copy returns a copy of `obj`, with the references updated.
+// Dictionaries are walked in alphabetical order, so that
+// the objects are numbered in a stable order.
+func (rc *rawCopier) copy(obj model.Object) model.Object {
+	switch obj := obj.(type) {
+	case model.ObjIndirectRef:
+		return model.ObjIndirectRef{ObjectNumber: rc.copyRef(obj)}
+	case model.ObjDict:
+		out := make(model.ObjDict, len(obj))
+		for _, k := range sortedKeys(obj) {
+			out[k] = rc.copy(obj[k])
+		}
+		return out
+	case model.ObjArray:
+		out := make(model.ObjArray, len(obj))
+		for i, v := range obj {
+			out[i] = rc.copy(v)
+		}
+		return out
+	case model.ObjStream:
+		// the references of the stream dictionary (like the
+		// resources of a form XObject) must also be updated
+		obj.Args = rc.copy(obj.Args).(model.ObjDict)
+		return obj
+	default:
+		return obj
+	}
+}
+
+func streamKey(stream model.ObjStream) (out [32]byte) {
+	h := sha256.New()
+	h.Write([]byte(rawStreamHeader(stream)))
+	h.Write(stream.Content)
+	h.Sum(out[:0])
+	return out
+}
@@ -0,0 +1,233 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benoitkugler/pdf/model"
+)
+
+// XMPNamespace is a custom schema of the XMP metadata (see `Metadata.XMP`),
+// like `XMPNamespace{Prefix: "inv", URI: "http://example.com/invoice/1.0/"}`.
+type XMPNamespace struct {
+	Prefix string // XML prefix, which must not be one of the standard ones, like "dc" or "pdf"
+	URI    string // namespace URI, usually ending with '/' or '#'
+
+	// Properties are the text properties of the schema, by local name
+	Properties map[string]string
+}
+
+// xmpReservedPrefixes are the prefixes used by the XMP packet
+var xmpReservedPrefixes = map[string]bool{
+	"x": true, "rdf": true, "dc": true, "xmp": true, "pdf": true, "pdfaid": true, "pdfuaid": true,
+	"pdfaExtension": true, "pdfaSchema": true, "pdfaProperty": true,
+}
+
+// isValid returns false if the prefix, the URI or one of the property names
+// of `ns` can't be used in the XMP packet.
+func (ns XMPNamespace) isValid() bool {
+	if !isXMLName(ns.Prefix) || xmpReservedPrefixes[ns.Prefix] || ns.URI == "" {
+		return false
+	}
+	for name := range ns.Properties {
+		if !isXMLName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// isXMLName returns true if `s` is an ASCII XML name without colon.
+func isXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+	for i, c := range []byte(s) {
+		isLetter := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+		if !isLetter && (i == 0 || !('0' <= c && c <= '9' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmpDocument stores the metadata written in the XMP packet.
+type xmpDocument struct {
+	info       model.Info
+	keywords   []string // items of info.Keywords, written as dc:subject
+	namespaces []XMPNamespace
+}
+
+// subject returns the items of `info.Keywords`, which are `keywords`
+// if they match, or the whole string otherwise.
+func (doc xmpDocument) subject() []string {
+	if doc.info.Keywords == "" {
+		return nil
+	}
+	if strings.Join(doc.keywords, ", ") == doc.info.Keywords {
+		return doc.keywords
+	}
+	return []string{doc.info.Keywords}
+}
+
+// xmpPacket returns an XMP metadata packet matching the document information
+// dictionary of `doc`, identifying the given PDF/A conformance level, if any,
+// and the PDF/UA conformance of `tagged` documents.
+// The invalid custom namespaces are ignored.
+func xmpPacket(doc xmpDocument, conformance Conformance, tagged bool) []byte {
+	info := doc.info
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">` + "\n")
+	b.WriteString("<dc:format>application/pdf</dc:format>\n")
+	if info.Title != "" {
+		fmt.Fprintf(&b, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", xmlEscape(info.Title))
+	}
+	if info.Author != "" {
+		fmt.Fprintf(&b, "<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", xmlEscape(info.Author))
+	}
+	if info.Subject != "" {
+		fmt.Fprintf(&b, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", xmlEscape(info.Subject))
+	}
+	if subject := doc.subject(); len(subject) != 0 {
+		b.WriteString("<dc:subject><rdf:Bag>")
+		for _, keyword := range subject {
+			fmt.Fprintf(&b, "<rdf:li>%s</rdf:li>", xmlEscape(keyword))
+		}
+		b.WriteString("</rdf:Bag></dc:subject>\n")
+	}
+	b.WriteString("</rdf:Description>\n")
+
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/">` + "\n")
+	if info.Creator != "" {
+		fmt.Fprintf(&b, "<xmp:CreatorTool>%s</xmp:CreatorTool>\n", xmlEscape(info.Creator))
+	}
+	if !info.CreationDate.IsZero() {
+		fmt.Fprintf(&b, "<xmp:CreateDate>%s</xmp:CreateDate>\n", xmpDate(info.CreationDate))
+	}
+	if !info.ModDate.IsZero() {
+		fmt.Fprintf(&b, "<xmp:ModifyDate>%s</xmp:ModifyDate>\n", xmpDate(info.ModDate))
+	}
+	b.WriteString("</rdf:Description>\n")
+
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:pdf="http://ns.adobe.com/pdf/1.3/">` + "\n")
+	if info.Producer != "" {
+		fmt.Fprintf(&b, "<pdf:Producer>%s</pdf:Producer>\n", xmlEscape(info.Producer))
+	}
+	if info.Keywords != "" {
+		fmt.Fprintf(&b, "<pdf:Keywords>%s</pdf:Keywords>\n", xmlEscape(info.Keywords))
+	}
+	b.WriteString("</rdf:Description>\n")
+
+	if conformance != NoConformance {
+		b.WriteString(`<rdf:Description rdf:about="" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/">` + "\n")
+		fmt.Fprintf(&b, "<pdfaid:part>%d</pdfaid:part>\n<pdfaid:conformance>B</pdfaid:conformance>\n", conformance.part())
+		b.WriteString("</rdf:Description>\n")
+	}
+
+	// PDF/A requires the schemas not defined by XMP to be described
+	var extensions []xmpSchema
+	if tagged {
+		b.WriteString(`<rdf:Description rdf:about="" xmlns:pdfuaid="http://www.aiim.org/pdfua/ns/id/">` + "\n")
+		b.WriteString("<pdfuaid:part>1</pdfuaid:part>\n")
+		b.WriteString("</rdf:Description>\n")
+		extensions = append(extensions, pdfuaSchema)
+	}
+
+	for _, ns := range doc.namespaces {
+		if !ns.isValid() {
+			continue
+		}
+		fmt.Fprintf(&b, "<rdf:Description rdf:about=\"\" xmlns:%s=\"%s\">\n", ns.Prefix, xmlEscape(ns.URI))
+		schema := xmpSchema{name: ns.Prefix, uri: ns.URI, prefix: ns.Prefix}
+		for _, name := range sortedStrings(ns.Properties) {
+			fmt.Fprintf(&b, "<%s:%s>%s</%s:%s>\n", ns.Prefix, name, xmlEscape(ns.Properties[name]), ns.Prefix, name)
+			schema.properties = append(schema.properties, xmpProperty{name: name, valueType: "Text", category: "external", description: name})
+		}
+		b.WriteString("</rdf:Description>\n")
+		extensions = append(extensions, schema)
+	}
+
+	if conformance != NoConformance && len(extensions) != 0 {
+		writeExtensionSchemas(&b, extensions)
+	}
+
+	b.WriteString("</rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString(`<?xpacket end="w"?>`)
+	return b.Bytes()
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmpDate formats `t` as expected by XMP, with the same
+// precision and time zone as the document information dictionary.
+func xmpDate(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05Z07:00")
+}
+
+func sortedStrings(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// xmpSchema is the description of a schema not defined by XMP,
+// as required by PDF/A.
+type xmpSchema struct {
+	name, uri, prefix string
+	properties        []xmpProperty
+}
+
+type xmpProperty struct {
+	name, valueType, category, description string
+}
+
+// pdfuaSchema describes the PDF/UA identification schema.
+var pdfuaSchema = xmpSchema{
+	name:   "PDF/UA Universal Accessibility Schema",
+	uri:    "http://www.aiim.org/pdfua/ns/id/",
+	prefix: "pdfuaid",
+	properties: []xmpProperty{{
+		name: "part", valueType: "Integer", category: "internal",
+		description: "Indicates, which part of ISO 14289 standard is followed",
+	}},
+}
+
+// writeExtensionSchemas writes the PDF/A extension schema container describing `schemas`.
+func writeExtensionSchemas(b *bytes.Buffer, schemas []xmpSchema) {
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:pdfaExtension="http://www.aiim.org/pdfa/ns/extension/" xmlns:pdfaSchema="http://www.aiim.org/pdfa/ns/schema#" xmlns:pdfaProperty="http://www.aiim.org/pdfa/ns/property#">` + "\n")
+	b.WriteString("<pdfaExtension:schemas><rdf:Bag>")
+	for _, schema := range schemas {
+		b.WriteString("<rdf:li rdf:parseType=\"Resource\">\n")
+		fmt.Fprintf(b, "<pdfaSchema:schema>%s</pdfaSchema:schema>\n", xmlEscape(schema.name))
+		fmt.Fprintf(b, "<pdfaSchema:namespaceURI>%s</pdfaSchema:namespaceURI>\n", xmlEscape(schema.uri))
+		fmt.Fprintf(b, "<pdfaSchema:prefix>%s</pdfaSchema:prefix>\n", schema.prefix)
+		b.WriteString("<pdfaSchema:property><rdf:Seq>")
+		for _, prop := range schema.properties {
+			b.WriteString("<rdf:li rdf:parseType=\"Resource\">\n")
+			fmt.Fprintf(b, "<pdfaProperty:name>%s</pdfaProperty:name>\n", prop.name)
+			fmt.Fprintf(b, "<pdfaProperty:valueType>%s</pdfaProperty:valueType>\n", prop.valueType)
+			fmt.Fprintf(b, "<pdfaProperty:category>%s</pdfaProperty:category>\n", prop.category)
+			fmt.Fprintf(b, "<pdfaProperty:description>%s</pdfaProperty:description>\n", xmlEscape(prop.description))
+			b.WriteString("</rdf:li>")
+		}
+		b.WriteString("</rdf:Seq></pdfaSchema:property>\n")
+		b.WriteString("</rdf:li>")
+	}
+	b.WriteString("</rdf:Bag></pdfaExtension:schemas>\n")
+	b.WriteString("</rdf:Description>\n")
+}
@@ -0,0 +1,57 @@
+package goweasyprint
+
+import (
+	"context"
+	"io"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	"github.com/benoitkugler/pdf/model"
+)
+
+// progressStep is the number of bytes written between
+// two Serialization events
+const progressStep = 1 << 16
+
+// progressWriter reports the number of bytes written
+type progressWriter struct {
+	w        io.Writer
+	callback progress.Func
+
+	written, reported int
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += n
+	if pw.written-pw.reported >= progressStep {
+		pw.reported = pw.written
+		pw.callback.Report(progress.Serialization, pw.written, 0)
+	}
+	return n, err
+}
+
+// newProgressWriter wraps `target`, and reports the start of the serialization.
+func (opts Options) newProgressWriter(ctx context.Context, target io.Writer) *progressWriter {
+	opts.Progress.Report(progress.Serialization, 0, 0)
+	return &progressWriter{w: contextWriter{ctx: ctx, w: target}, callback: opts.Progress}
+}
+
+// done reports the end of the serialization.
+func (pw *progressWriter) done() {
+	pw.callback.Report(progress.Serialization, pw.written, pw.written)
+}
+
+// writeDocument serializes `doc`, finalized by `output`, into `target`,
+// reporting the progress.
+func (opts Options) writeDocument(ctx context.Context, doc model.Document, output *pdf.Output, target io.Writer) error {
+	w := opts.newProgressWriter(ctx, target)
+	writeOpts := opts.writeOptions()
+	writeOpts.Metadata = output.XMPMetadata()
+	writeOpts.ViewerPreferences = output.ViewerPreferences()
+	if err := pdf.Write(doc, w, writeOpts); err != nil {
+		return err
+	}
+	w.done()
+	return nil
+}
@@ -0,0 +1,79 @@
+// Package progress defines the events reported
+// while converting a document, so that long conversions
+// may be monitored.
+package progress
+
+import "fmt"
+
+// Phase is one of the steps of a conversion.
+type Phase uint8
+
+const (
+	// Parsing is the fetching and parsing of the HTML and CSS inputs.
+	Parsing Phase = iota
+	// Layout is the creation of the pages. It is reported when it starts,
+	// and when it ends, with the number of pages.
+	Layout
+	// Drawing is the drawing of the pages, counted in pages.
+	Drawing
+	// FontSubsetting is the embedding of the fonts, counted in fonts.
+	FontSubsetting
+	// ImageEncoding is reported while drawing, each time an image is encoded.
+	// Since the images are discovered during the drawing, the total is unknown.
+	ImageEncoding
+	// Serialization is the writing of the PDF file, counted in bytes.
+	Serialization
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Parsing:
+		return "parsing"
+	case Layout:
+		return "layout"
+	case Drawing:
+		return "drawing"
+	case FontSubsetting:
+		return "font subsetting"
+	case ImageEncoding:
+		return "image encoding"
+	case Serialization:
+		return "serialization"
+	default:
+		return fmt.Sprintf("<phase %d>", p)
+	}
+}
+
+// Event reports the advancement of a phase.
+// Each phase starts with Current == 0, and, if its total is
+// known, ends with Current == Total.
+type Event struct {
+	Phase Phase
+
+	// Current is the number of items processed so far.
+	Current int
+
+	// Total is the number of items to process, or 0 if it is not known.
+	Total int
+}
+
+func (e Event) String() string {
+	if e.Total == 0 {
+		return fmt.Sprintf("%s (%d)", e.Phase, e.Current)
+	}
+	return fmt.Sprintf("%s (%d/%d)", e.Phase, e.Current, e.Total)
+}
+
+// Func is called with the events of a conversion, in order.
+// The events are reported one at a time, but possibly from
+// different goroutines. Func should return quickly.
+type Func func(Event)
+
+// Report calls `f` with the given event. A nil Func
+// simply discards the events.
+func (f Func) Report(phase Phase, current, total int) {
+	if f == nil {
+		return
+	}
+	f(Event{Phase: phase, Current: current, Total: total})
+}
@@ -0,0 +1,22 @@
+package progress
+
+import "testing"
+
+func TestReport(t *testing.T) {
+	var nilFunc Func
+	nilFunc.Report(Drawing, 1, 2) // no-op
+
+	var events []Event
+	f := Func(func(e Event) { events = append(events, e) })
+	f.Report(Drawing, 1, 2)
+	f.Report(ImageEncoding, 3, 0)
+	if len(events) != 2 || events[0] != (Event{Drawing, 1, 2}) {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if s := events[0].String(); s != "drawing (1/2)" {
+		t.Fatalf("unexpected string %s", s)
+	}
+	if s := events[1].String(); s != "image encoding (3)" {
+		t.Fatalf("unexpected string %s", s)
+	}
+}
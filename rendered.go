@@ -0,0 +1,202 @@
+package goweasyprint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/backend"
+	"github.com/benoitkugler/webrender/html/document"
+	"github.com/benoitkugler/webrender/text"
+	"github.com/benoitkugler/webrender/utils"
+)
+
+// RenderedDocument is a laid out document, which may be written several times,
+// with different output settings, without repeating the (costly) layout step.
+//
+// It is safe to write a RenderedDocument from multiple goroutines, but the
+// drawing steps are serialized, as are the layout and drawing steps of the documents
+// sharing the same font configuration.
+type RenderedDocument struct {
+	doc        document.Document
+	baseUrl    string
+	root       *utils.HTMLNode // used by tagged outputs
+	fields     []pdf.FormField // see `Options.Forms`
+	fontConfig text.FontConfiguration
+
+	mu sync.Mutex // protects the drawing
+
+	anchorsOnce sync.Once
+	anchors     [][]backend.Anchor
+}
+
+// PageSize is the size of a page, including its margins but not its bleed,
+// in CSS pixels. One CSS pixel is 0.75 PDF point, at zoom 1.
+type PageSize struct {
+	Width, Height float64
+}
+
+// Render parses and lays out an HTML document, using the layout settings of `opts`
+// (BaseUrl, UrlFetcher, MediaType, Stylesheets, PresentationalHints, Forms, Diagnostics and Progress).
+// `fontConfig` is mandatory.
+func Render(htmlContent ContentInput, fontConfig text.FontConfiguration, opts Options) (*RenderedDocument, error) {
+	return RenderContext(context.Background(), htmlContent, fontConfig, opts)
+}
+
+// RenderContext is the same as Render, but stops as soon as possible
+// once `ctx` is done, returning `ctx.Err()`. See `ConvertContext` for more details.
+//
+// Note that `ctx` is also used by the resource fetching done when writing the document,
+// like for the attachments referenced in the HTML.
+func RenderContext(ctx context.Context, htmlContent ContentInput, fontConfig text.FontConfiguration, opts Options) (*RenderedDocument, error) {
+	opts = opts.prepare(ctx)
+	doc, parsedHtml, fields, err := renderContext(ctx, htmlContent, fontConfig, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &RenderedDocument{doc: doc, baseUrl: parsedHtml.BaseUrl, root: parsedHtml.Root, fields: fields, fontConfig: fontConfig}, nil
+}
+
+// BaseUrl returns the base URL used to resolve the links of the document.
+func (rd *RenderedDocument) BaseUrl() string { return rd.baseUrl }
+
+// PageCount returns the number of pages of the document.
+func (rd *RenderedDocument) PageCount() int { return len(rd.doc.Pages) }
+
+// PageSizes returns the size of each page.
+func (rd *RenderedDocument) PageSizes() []PageSize {
+	out := make([]PageSize, len(rd.doc.Pages))
+	for i, page := range rd.doc.Pages {
+		out[i] = PageSize{Width: float64(page.Width), Height: float64(page.Height)}
+	}
+	return out
+}
+
+// Anchors returns the named anchors (targets of internal links) of each page,
+// with coordinates in PDF points at zoom 1, the origin being the bottom-left corner of the page.
+//
+// Anchors are only exposed by the drawing step, so the first call paints the document.
+func (rd *RenderedDocument) Anchors() [][]backend.Anchor {
+	rd.anchorsOnce.Do(func() {
+		output := pdf.NewOutput()
+		rd.Paint(output, 1, nil)
+		rd.anchors = output.Anchors()
+	})
+	return rd.anchors
+}
+
+// Paint draws the document on the given target (which may be a fresh `pdf.Output`,
+// or any other backend), with the given zoom factor and additional attachments.
+// See `Options.Zoom` and `Options.Attachments` for more details.
+func (rd *RenderedDocument) Paint(target backend.Document, zoom float64, attachments []backend.Attachment) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	defer lockFontConfig(rd.fontConfig)()
+	rd.doc.Write(target, Options{Zoom: zoom}.zoom(), attachments)
+}
+
+// Write writes the document as a PDF file in `target`, using
+// the output settings of `opts` (Zoom, Attachments, Pages, PageLabels, ViewerPreferences, Stream, Metadata, Reproducible, Timestamp,
+// Compression, Conformance, Encryption, Signature, Tagged, SharedCache, Diagnostics, Progress and Strict).
+// The layout settings of `opts` are ignored.
+func (rd *RenderedDocument) Write(target io.Writer, opts Options) error {
+	return rd.WriteContext(context.Background(), target, opts)
+}
+
+// WriteContext is the same as Write, but stops as soon as possible
+// once `ctx` is done, returning `ctx.Err()`.
+func (rd *RenderedDocument) WriteContext(ctx context.Context, target io.Writer, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	return rd.write(ctx, target, opts.withCollector())
+}
+
+// write expects prepared options
+func (rd *RenderedDocument) write(ctx context.Context, target io.Writer, opts Options) (err error) {
+	if opts.Stream {
+		return rd.writeStream(ctx, target, opts)
+	}
+
+	var output *pdf.Output
+	defer recoverPanic(ctx, currentPage(&output), opts.Diagnostics, &err)
+
+	output, err = opts.newOutput(ctx, rd.PageCount())
+	if err != nil {
+		return err
+	}
+	if opts.Tagged {
+		output.SetStructure(htmlStructure(rd.root, rd.baseUrl, "Document"))
+	}
+	output.SetFormFields(rd.fields)
+	output.SetDirection(htmlDirection(rd.root))
+
+	rd.Paint(output, opts.Zoom, opts.Attachments)
+	pdfDoc := output.Finalize()
+	if err := opts.strictErr(); err != nil {
+		return err
+	}
+	return opts.writeDocument(ctx, pdfDoc, output, target)
+}
+
+// writeStream expects prepared options
+func (rd *RenderedDocument) writeStream(ctx context.Context, target io.Writer, opts Options) (err error) {
+	if opts.Pages != "" {
+		return errors.New("page selection is not supported in streaming mode")
+	}
+	if opts.Encryption != nil {
+		return errors.New("encryption is not supported in streaming mode")
+	}
+	if opts.Signature != nil {
+		return errors.New("signing is not supported in streaming mode")
+	}
+	if len(rd.fields) != 0 {
+		return errors.New("form fields are not supported in streaming mode")
+	}
+	w := opts.newProgressWriter(ctx, target)
+	output := pdf.NewStreamOutputContext(ctx, w)
+	defer recoverPanic(ctx, output.CurrentPage, opts.Diagnostics, &err)
+	if opts.Diagnostics != nil {
+		output.SetDiagnostics(opts.Diagnostics)
+	}
+	if opts.Progress != nil {
+		output.SetProgress(opts.Progress, rd.PageCount())
+	}
+	output.SetSharedCache(opts.SharedCache)
+	output.SetCompression(opts.Compression)
+	output.SetConformance(opts.Conformance)
+	if md := opts.metadata(); md != nil {
+		output.SetMetadata(*md)
+	}
+	output.SetPageLabels(opts.PageLabels)
+	output.SetViewerPreferences(opts.ViewerPreferences)
+	output.SetDirection(htmlDirection(rd.root))
+	if opts.Reproducible {
+		output.SetReproducible()
+	}
+	if opts.Tagged {
+		output.SetStructure(htmlStructure(rd.root, rd.baseUrl, "Document"))
+	}
+
+	rd.Paint(output, opts.Zoom, opts.Attachments)
+	if err := output.Close(); err != nil {
+		return err
+	}
+	w.done()
+	return opts.strictErr()
+}
+
+// htmlDirection returns the page direction given by <html dir>.
+func htmlDirection(root *utils.HTMLNode) pdf.Direction {
+	switch strings.ToLower(strings.TrimSpace(root.Get("dir"))) {
+	case "rtl":
+		return pdf.RightToLeft
+	case "ltr":
+		return pdf.LeftToRight
+	default:
+		return pdf.DefaultDirection
+	}
+}
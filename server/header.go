@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// class names (and running element names) of the header and footer
+const (
+	headerName = "gotenbergHeader"
+	footerName = "gotenbergFooter"
+)
+
+// insertHeaderFooter adds the content of the [header] and [footer]
+// HTML documents (if not empty) at the start of the [index] body,
+// as running elements.
+func insertHeaderFooter(index, header, footer []byte) ([]byte, error) {
+	if len(header) == 0 && len(footer) == 0 {
+		return index, nil
+	}
+
+	doc, err := html.Parse(bytes.NewReader(index))
+	if err != nil {
+		return nil, err
+	}
+	head, body := findElement(doc, atom.Head), findElement(doc, atom.Body)
+	if head == nil || body == nil { // should not happen with html.Parse
+		return index, nil
+	}
+	title := ""
+	if node := findElement(head, atom.Title); node != nil {
+		title = textContent(node)
+	}
+
+	// insert the footer first so that the header comes first
+	for _, part := range [...]struct {
+		name    string
+		content []byte
+	}{{footerName, footer}, {headerName, header}} {
+		if len(part.content) == 0 {
+			continue
+		}
+		partDoc, err := html.Parse(bytes.NewReader(part.content))
+		if err != nil {
+			return nil, err
+		}
+		fillSpecialClasses(partDoc, title)
+
+		// move the stylesheets to the main document
+		for _, style := range findElements(partDoc, atom.Style) {
+			style.Parent.RemoveChild(style)
+			head.AppendChild(style)
+		}
+
+		container := &html.Node{
+			Type: html.ElementNode, Data: "div", DataAtom: atom.Div,
+			Attr: []html.Attribute{{Key: "class", Val: part.name}},
+		}
+		if partBody := findElement(partDoc, atom.Body); partBody != nil {
+			for child := partBody.FirstChild; child != nil; child = partBody.FirstChild {
+				partBody.RemoveChild(child)
+				container.AppendChild(child)
+			}
+		}
+		body.InsertBefore(container, body.FirstChild)
+	}
+
+	var out bytes.Buffer
+	err = html.Render(&out, doc)
+	return out.Bytes(), err
+}
+
+// fillSpecialClasses sets the text of the elements with
+// the title, url and date classes.
+func fillSpecialClasses(doc *html.Node, title string) {
+	values := map[string]string{
+		"title": title,
+		"url":   assetsUrl + "index.html",
+		"date":  time.Now().Format("1/2/2006"),
+	}
+	walk(doc, func(node *html.Node) {
+		if node.Type != html.ElementNode {
+			return
+		}
+		for _, attr := range node.Attr {
+			if attr.Key != "class" {
+				continue
+			}
+			for _, class := range strings.Fields(attr.Val) {
+				if value, ok := values[class]; ok {
+					for child := node.FirstChild; child != nil; child = node.FirstChild {
+						node.RemoveChild(child)
+					}
+					node.AppendChild(&html.Node{Type: html.TextNode, Data: value})
+				}
+			}
+		}
+	})
+}
+
+func walk(node *html.Node, f func(*html.Node)) {
+	f(node)
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		walk(child, f)
+	}
+}
+
+func findElements(root *html.Node, tag atom.Atom) (out []*html.Node) {
+	walk(root, func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == tag {
+			out = append(out, node)
+		}
+	})
+	return out
+}
+
+func findElement(root *html.Node, tag atom.Atom) *html.Node {
+	if l := findElements(root, tag); len(l) != 0 {
+		return l[0]
+	}
+	return nil
+}
+
+func textContent(node *html.Node) string {
+	var out strings.Builder
+	walk(node, func(n *html.Node) {
+		if n.Type == html.TextNode {
+			out.WriteString(n.Data)
+		}
+	})
+	return strings.TrimSpace(out.String())
+}
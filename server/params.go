@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// params stores the page settings of a conversion request.
+type params struct {
+	paperWidth, paperHeight                          string // CSS lengths
+	marginTop, marginBottom, marginLeft, marginRight string // CSS lengths
+	preferCssPageSize                                bool
+	landscape                                        bool
+	printBackground                                  bool
+	mediaType                                        string
+}
+
+// lengthRe matches the lengths accepted by Gotenberg, where
+// a missing unit means inches
+var lengthRe = regexp.MustCompile(`^\d*\.?\d+(pt|px|in|mm|cm|pc)?$`)
+
+func parseLength(field, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	match := lengthRe.FindStringSubmatch(value)
+	if match == nil {
+		return "", badRequest("invalid length for %s: %q", field, value)
+	}
+	if match[1] == "" {
+		value += "in"
+	}
+	return value, nil
+}
+
+// parseParams reads the form fields, using the Gotenberg defaults
+// for the missing ones.
+func parseParams(values map[string][]string) (params, error) {
+	out := params{
+		paperWidth: "8.5in", paperHeight: "11in",
+		marginTop: "0.39in", marginBottom: "0.39in", marginLeft: "0.39in", marginRight: "0.39in",
+		mediaType: "print",
+	}
+	get := func(field string) (string, bool) {
+		if v := values[field]; len(v) != 0 && v[0] != "" {
+			return v[0], true
+		}
+		return "", false
+	}
+
+	for _, field := range [...]struct {
+		name string
+		dst  *string
+	}{
+		{"paperWidth", &out.paperWidth},
+		{"paperHeight", &out.paperHeight},
+		{"marginTop", &out.marginTop},
+		{"marginBottom", &out.marginBottom},
+		{"marginLeft", &out.marginLeft},
+		{"marginRight", &out.marginRight},
+	} {
+		if v, ok := get(field.name); ok {
+			l, err := parseLength(field.name, v)
+			if err != nil {
+				return params{}, err
+			}
+			*field.dst = l
+		}
+	}
+
+	for _, field := range [...]struct {
+		name string
+		dst  *bool
+	}{
+		{"preferCssPageSize", &out.preferCssPageSize},
+		{"landscape", &out.landscape},
+		{"printBackground", &out.printBackground},
+	} {
+		if v, ok := get(field.name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return params{}, badRequest("invalid boolean for %s: %q", field.name, v)
+			}
+			*field.dst = b
+		}
+	}
+
+	if v, ok := get("emulatedMediaType"); ok {
+		if v != "print" && v != "screen" {
+			return params{}, badRequest("invalid value for emulatedMediaType: %q", v)
+		}
+		out.mediaType = v
+	}
+
+	return out, nil
+}
+
+// stylesheet returns the user stylesheet implementing the page settings.
+// Unless preferCssPageSize is set, the settings have precedence over
+// the document stylesheets.
+func (p params) stylesheet() string {
+	important := " !important"
+	if p.preferCssPageSize {
+		important = ""
+	}
+
+	var css strings.Builder
+	css.WriteString("@page {")
+	if !p.preferCssPageSize {
+		width, height := p.paperWidth, p.paperHeight
+		if p.landscape {
+			width, height = height, width
+		}
+		fmt.Fprintf(&css, " size: %s %s%s;", width, height, important)
+	}
+	fmt.Fprintf(&css, " margin: %s %s %s %s%s;", p.marginTop, p.marginRight, p.marginBottom, p.marginLeft, important)
+	fmt.Fprintf(&css, " @top-center { content: element(%s); width: 100%% }", headerName)
+	fmt.Fprintf(&css, " @bottom-center { content: element(%s); width: 100%% }", footerName)
+	css.WriteString(" }\n")
+
+	for _, name := range [...]string{headerName, footerName} {
+		fmt.Fprintf(&css, ".%[1]s { position: running(%[1]s) }\n", name)
+		fmt.Fprintf(&css, ".%s .pageNumber::before { content: counter(page) }\n", name)
+		fmt.Fprintf(&css, ".%s .totalPages::before { content: counter(pages) }\n", name)
+	}
+
+	if !p.printBackground {
+		css.WriteString("* { background: transparent !important }\n")
+	}
+	return css.String()
+}
@@ -0,0 +1,272 @@
+// Package server implements an HTTP conversion service,
+// compatible with the HTML route of the Gotenberg API :
+//
+//	POST /forms/chromium/convert/html
+//	GET /health
+//
+// The HTML route expects a multipart form, with an index.html file and its assets
+// (stylesheets, images, fonts), and the following optional fields :
+// paperWidth, paperHeight, marginTop, marginBottom, marginLeft, marginRight,
+// preferCssPageSize, landscape, printBackground and emulatedMediaType.
+// Optional header.html and footer.html files are displayed in the top and bottom
+// page margins, and may use the pageNumber, totalPages, title, url and date classes.
+//
+// Fields with no equivalent in this implementation (like scale or nativePageRanges) are ignored.
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	goweasyprint "github.com/benoitkugler/go-weasyprint"
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/html/tree"
+	"github.com/benoitkugler/webrender/text"
+	"github.com/benoitkugler/webrender/utils"
+)
+
+const (
+	// ConvertHTMLRoute is the Gotenberg route converting an HTML file.
+	ConvertHTMLRoute = "/forms/chromium/convert/html"
+	// HealthRoute is the route used to check that the server is up.
+	HealthRoute = "/health"
+
+	// assetsUrl is the base URL used for the uploaded files
+	assetsUrl = "http://assets.invalid/"
+)
+
+// Config stores the settings of a Server.
+type Config struct {
+	// NewFontConfig builds the font configurations used by the conversions, and is mandatory
+	// (see `goweasyprint.NewFontConfigFunc`).
+	// Since a font configuration is used by one conversion at a time, the server keeps
+	// a pool of at most MaxConcurrency of them, built when needed.
+	NewFontConfig func() text.FontConfiguration
+
+	// UrlFetcher is used to resolve the resources which are not uploaded
+	// with the request (data URLs are always supported).
+	// If nil, such resources are not available.
+	UrlFetcher utils.UrlFetcher
+
+	// Cache, if not nil, stores the images and fonts used by the conversions,
+	// so that they are only parsed once.
+	Cache *pdf.SharedCache
+
+	// MaxConcurrency is the maximum number of simultaneous conversions,
+	// each one using its own font configuration.
+	// It defaults to the number of CPUs.
+	MaxConcurrency int
+
+	// Timeout is the maximum duration of one conversion, including
+	// the time spent waiting for a free slot. It defaults to 30 seconds.
+	Timeout time.Duration
+
+	// MaxMemory is the maximum number of bytes of the uploaded files
+	// kept in memory (see http.Request.ParseMultipartForm). It defaults to 32 MB.
+	MaxMemory int64
+
+	// MaxBodySize is the maximum size in bytes of a request, uploaded files included.
+	// It defaults to 64 MB.
+	MaxBodySize int64
+}
+
+// Server is an http.Handler converting HTML documents to PDF.
+type Server struct {
+	config Config
+	// pool of font configurations, nil until first used,
+	// which also limits the number of concurrent conversions
+	slots chan text.FontConfiguration
+	mux   *http.ServeMux
+}
+
+// New returns a server using the given config.
+func New(config Config) *Server {
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = runtime.NumCPU()
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.MaxMemory <= 0 {
+		config.MaxMemory = 32 << 20
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 64 << 20
+	}
+	s := &Server{
+		config: config,
+		slots:  make(chan text.FontConfiguration, config.MaxConcurrency),
+		mux:    http.NewServeMux(),
+	}
+	for range config.MaxConcurrency {
+		s.slots <- nil
+	}
+	s.mux.HandleFunc("GET "+HealthRoute, s.health)
+	s.mux.HandleFunc("POST "+ConvertHTMLRoute, s.convertHTML)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.mux.ServeHTTP(w, r) }
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"status":"up"}`)
+}
+
+// httpError is an error with an associated status code
+type httpError struct {
+	status int
+	err    error
+}
+
+func (he httpError) Error() string { return he.err.Error() }
+
+func badRequest(format string, args ...any) error {
+	return httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func (s *Server) convertHTML(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.Timeout)
+	defer cancel()
+
+	content, err := s.processConvertHTML(ctx, w, r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var he httpError
+		if errors.As(err, &he) {
+			status = he.status
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	filename := r.Header.Get("Gotenberg-Output-Filename")
+	if filename == "" {
+		filename = "result"
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".pdf"}))
+	w.Write(content)
+}
+
+func (s *Server) processConvertHTML(ctx context.Context, w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodySize)
+	if err := r.ParseMultipartForm(s.config.MaxMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, httpError{http.StatusRequestEntityTooLarge, err}
+		}
+		return nil, badRequest("invalid form: %s", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files, err := readFiles(r)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := files["index.html"]
+	if !ok {
+		return nil, badRequest("missing index.html file")
+	}
+
+	params, err := parseParams(r.MultipartForm.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err = insertHeaderFooter(index, files["header.html"], files["footer.html"])
+	if err != nil {
+		return nil, badRequest("invalid HTML: %s", err)
+	}
+
+	css, err := tree.NewCSSDefault(utils.InputString(params.stylesheet()))
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for a free slot
+	var fontConfig text.FontConfiguration
+	select {
+	case fontConfig = <-s.slots:
+		if fontConfig == nil {
+			fontConfig = s.config.NewFontConfig()
+		}
+		defer func() { s.slots <- fontConfig }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var out bytes.Buffer
+	err = goweasyprint.ConvertContext(ctx, &out, goweasyprint.InputString(index), fontConfig, goweasyprint.Options{
+		BaseUrl:     assetsUrl + "index.html",
+		UrlFetcher:  s.fetcher(files),
+		MediaType:   params.mediaType,
+		Stylesheets: []tree.CSS{css},
+		SharedCache: s.config.Cache,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// readFiles returns the uploaded files, indexed by name.
+func readFiles(r *http.Request) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	for _, headers := range r.MultipartForm.File {
+		for _, header := range headers {
+			f, err := header.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			out[path.Base(header.Filename)] = content
+		}
+	}
+	return out, nil
+}
+
+// fetcher returns an UrlFetcher serving the uploaded [files],
+// and delegating data URLs and other resources.
+func (s *Server) fetcher(files map[string][]byte) utils.UrlFetcher {
+	return func(url string) (utils.RemoteRessource, error) {
+		if name, ok := strings.CutPrefix(url, assetsUrl); ok {
+			name, _, _ = strings.Cut(name, "?")
+			name, _, _ = strings.Cut(name, "#")
+			content, ok := files[path.Base(name)]
+			if !ok {
+				return utils.RemoteRessource{}, fmt.Errorf("file %s not found", name)
+			}
+			// the parameters (like charset) are not expected
+			mimeType, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(name)), ";")
+			return utils.RemoteRessource{
+				Content:       bytes.NewReader(content),
+				MimeType:      mimeType,
+				RedirectedUrl: url,
+				Filename:      path.Base(name),
+			}, nil
+		}
+		if strings.HasPrefix(url, "data:") {
+			return utils.DefaultUrlFetcher(url)
+		}
+		if s.config.UrlFetcher == nil {
+			return utils.RemoteRessource{}, fmt.Errorf("remote resource %s not allowed", url)
+		}
+		return s.config.UrlFetcher(url)
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goweasyprint "github.com/benoitkugler/go-weasyprint"
+	"github.com/benoitkugler/go-weasyprint/pdf/test"
+	"github.com/benoitkugler/pdf/model"
+	"github.com/benoitkugler/pdf/reader"
+	"github.com/benoitkugler/webrender/text"
+	"github.com/benoitkugler/webrender/utils"
+	tu "github.com/benoitkugler/webrender/utils/testutils"
+)
+
+var newFontConfig func() text.FontConfiguration
+
+func init() {
+	// build the font index if needed
+	if _, err := test.LoadTestFontConfig("../pdf/test/"); err != nil {
+		panic(err)
+	}
+	var err error
+	newFontConfig, err = goweasyprint.NewFontConfigFunc(nil, "../pdf/test/cache.fc")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newForm returns a multipart request body with the given files and fields
+func newForm(t *testing.T, files map[string][]byte, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := w.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, w.FormDataContentType()
+}
+
+func postForm(t *testing.T, srv *httptest.Server, files map[string][]byte, fields map[string]string) *http.Response {
+	t.Helper()
+
+	body, contentType := newForm(t, files, fields)
+	resp, err := http.Post(srv.URL+ConvertHTMLRoute, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readPDF(t *testing.T, resp *http.Response) model.Document {
+	t.Helper()
+
+	defer resp.Body.Close()
+	var content bytes.Buffer
+	content.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, content.String())
+	}
+	doc, _, err := reader.ParsePDFReader(bytes.NewReader(content.Bytes()), reader.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestHealth(t *testing.T) {
+	srv := httptest.NewServer(New(Config{NewFontConfig: newFontConfig}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + HealthRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestConvertHTML(t *testing.T) {
+	cp := tu.CaptureLogs()
+	defer cp.AssertNoLogs(t)
+
+	image, err := os.ReadFile("../resources_test/pattern.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(New(Config{NewFontConfig: newFontConfig}))
+	defer srv.Close()
+
+	files := map[string][]byte{
+		"index.html": []byte(`<html><head><link rel="stylesheet" href="style.css"></head>
+			<body><p>Hello</p><img src="pattern.png"></body></html>`),
+		"style.css":   []byte(`p { color: red }`),
+		"pattern.png": image,
+	}
+
+	doc := readPDF(t, postForm(t, srv, files, nil))
+	pages := doc.Catalog.Pages.Flatten()
+	if len(pages) != 1 {
+		t.Fatalf("expected one page, got %d", len(pages))
+	}
+	if mb := pages[0].MediaBox; mb.Urx != 612 || mb.Ury != 792 { // US Letter
+		t.Fatalf("unexpected media box %v", mb)
+	}
+	if len(pages[0].Resources.XObject) == 0 {
+		t.Fatal("missing image")
+	}
+
+	doc = readPDF(t, postForm(t, srv, files, map[string]string{
+		"paperWidth": "3", "paperHeight": "4in", "landscape": "true", "marginTop": "1cm",
+	}))
+	if mb := doc.Catalog.Pages.Flatten()[0].MediaBox; mb.Urx != 288 || mb.Ury != 216 {
+		t.Fatalf("unexpected media box %v", mb)
+	}
+
+	// preferCssPageSize
+	files["style.css"] = []byte(`@page { size: 3in 4in }`)
+	doc = readPDF(t, postForm(t, srv, files, map[string]string{"preferCssPageSize": "true"}))
+	if mb := doc.Catalog.Pages.Flatten()[0].MediaBox; mb.Urx != 216 || mb.Ury != 288 {
+		t.Fatalf("unexpected media box %v", mb)
+	}
+	doc = readPDF(t, postForm(t, srv, files, nil))
+	if mb := doc.Catalog.Pages.Flatten()[0].MediaBox; mb.Urx != 612 || mb.Ury != 792 {
+		t.Fatalf("unexpected media box %v", mb)
+	}
+}
+
+func TestHeaderFooter(t *testing.T) {
+	srv := httptest.NewServer(New(Config{NewFontConfig: newFontConfig}))
+	defer srv.Close()
+
+	files := map[string][]byte{
+		"index.html":  []byte(`<html><head><title>My title</title></head><body><p>Hello</p><p style="break-before: page">World</p></body></html>`),
+		"header.html": []byte(`<html><head><style>p { color: blue }</style></head><body><p class="title"></p></body></html>`),
+		"footer.html": []byte(`<html><body><p><span class="pageNumber"></span> / <span class="totalPages"></span></p></body></html>`),
+	}
+	doc := readPDF(t, postForm(t, srv, files, nil))
+	if L := len(doc.Catalog.Pages.Flatten()); L != 2 {
+		t.Fatalf("expected 2 pages, got %d", L)
+	}
+
+	out, err := insertHeaderFooter(files["index.html"], files["header.html"], files["footer.html"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(out)
+	if !strings.Contains(s, `<body><div class="gotenbergHeader"><p class="title">My title</p></div><div class="gotenbergFooter">`) {
+		t.Fatalf("unexpected HTML %s", s)
+	}
+	if !strings.Contains(s, "<style>p { color: blue }</style></head>") {
+		t.Fatalf("unexpected HTML %s", s)
+	}
+}
+
+func TestConvertHTMLErrors(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	srv := httptest.NewServer(New(Config{
+		NewFontConfig: newFontConfig,
+		Timeout:       50 * time.Millisecond,
+		UrlFetcher: func(url string) (utils.RemoteRessource, error) {
+			<-block
+			return utils.RemoteRessource{}, nil
+		},
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		files  map[string][]byte
+		fields map[string]string
+		status int
+	}{
+		{map[string][]byte{"main.html": []byte("<p>Hello</p>")}, nil, http.StatusBadRequest},
+		{map[string][]byte{"index.html": []byte("<p>Hello</p>")}, map[string]string{"paperWidth": "wide"}, http.StatusBadRequest},
+		{map[string][]byte{"index.html": []byte("<p>Hello</p>")}, map[string]string{"landscape": "maybe"}, http.StatusBadRequest},
+		{map[string][]byte{"index.html": []byte(`<img src="http://example.com/image.png">`)}, nil, http.StatusServiceUnavailable},
+	} {
+		resp := postForm(t, srv, test.files, test.fields)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %d, got %d", test.status, resp.StatusCode)
+		}
+	}
+
+	// request too large
+	small := httptest.NewServer(New(Config{NewFontConfig: newFontConfig, MaxBodySize: 1 << 10}))
+	defer small.Close()
+	resp := postForm(t, small, map[string][]byte{"index.html": bytes.Repeat([]byte("<p>Hello</p>"), 200)}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// wrong method
+	resp, err := http.Get(srv.URL + ConvertHTMLRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	s := New(Config{NewFontConfig: newFontConfig, MaxConcurrency: 1, Timeout: time.Second})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	fontConfig := <-s.slots // simulate a running conversion
+	resp := postForm(t, srv, map[string][]byte{"index.html": []byte("<p>Hello</p>")}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	s.slots <- fontConfig
+	readPDF(t, postForm(t, srv, map[string][]byte{"index.html": []byte("<p>Hello</p>")}, nil))
+}
+
+// TestConcurrentConversions should be run with -race
+func TestConcurrentConversions(t *testing.T) {
+	image, err := os.ReadFile("../resources_test/pattern.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 4
+	var built atomic.Int32
+	srv := httptest.NewServer(New(Config{NewFontConfig: func() text.FontConfiguration {
+		built.Add(1)
+		return newFontConfig()
+	}, MaxConcurrency: N}))
+	defer srv.Close()
+
+	type request struct {
+		body        *bytes.Buffer
+		contentType string
+	}
+	var requests [N]request
+	for i := range requests {
+		html := fmt.Sprintf(`<h1>Conversion %d</h1><p style="font-family: serif">Hello</p><p><i>World</i></p>
+			<img src="pattern.png"><p style="break-before: page">%d</p>`, i, i)
+		body, contentType := newForm(t, map[string][]byte{"index.html": []byte(html), "pattern.png": image}, nil)
+		requests[i] = request{body, contentType}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, N)
+	for _, req := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+ConvertHTMLRoute, req.contentType, req.body)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			var content bytes.Buffer
+			content.ReadFrom(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("unexpected status %d: %s", resp.StatusCode, content.String())
+				return
+			}
+			doc, _, err := reader.ParsePDFReader(bytes.NewReader(content.Bytes()), reader.Options{})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if L := len(doc.Catalog.Pages.Flatten()); L != 2 {
+				errs <- fmt.Errorf("expected 2 pages, got %d", L)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := built.Load(); n < 1 || n > N {
+		t.Fatalf("unexpected number of font configurations %d", n)
+	}
+}
@@ -0,0 +1,193 @@
+package goweasyprint
+
+import (
+	"strings"
+
+	"github.com/benoitkugler/go-weasyprint/pdf"
+	"github.com/benoitkugler/webrender/utils"
+	"golang.org/x/net/html"
+)
+
+// blockTypes maps the HTML elements to the structure types
+// of their tagged PDF element. The other elements are inline,
+// and only contribute their text.
+var blockTypes = map[string]string{
+	"h1": "H1", "h2": "H2", "h3": "H3", "h4": "H4", "h5": "H5", "h6": "H6",
+	"p": "P", "pre": "P", "address": "P", "dt": "P", "dd": "P",
+	"ul": "L", "ol": "L", "li": "LI",
+	"table": "Table", "thead": "THead", "tbody": "TBody", "tfoot": "TFoot",
+	"tr": "TR", "th": "TH", "td": "TD", "caption": "Caption",
+	"blockquote": "BlockQuote", "figcaption": "Caption",
+	"section": "Sect", "article": "Art", "main": "Sect", "aside": "Sect", "nav": "Sect",
+	"header": "Sect", "footer": "Sect",
+	"div": "Div", "figure": "Div", "dl": "Div", "form": "Div", "fieldset": "Div",
+}
+
+// groupingTypes may not directly contain text, which
+// is then wrapped in an implicit paragraph.
+var groupingTypes = map[string]bool{
+	"Document": true, "Part": true, "Art": true, "Sect": true, "Div": true, "BlockQuote": true,
+	"L": true, "LI": true, "Table": true, "THead": true, "TBody": true, "TFoot": true, "TR": true,
+}
+
+// skippedElements are not drawn, or drawn as artifacts.
+var skippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true, "noscript": true, "svg": true,
+}
+
+// htmlStructure returns the logical structure of the document whose root element
+// is `root`, as expected by `pdf.Output.SetStructure`, using `typ` as the type
+// of the root element.
+// The language of the document is given by <html lang>, and the images with
+// an empty alternate text are considered decorative.
+func htmlStructure(root *utils.HTMLNode, baseUrl, typ string) *pdf.StructElement {
+	out := &pdf.StructElement{Type: typ, Lang: root.Get("lang")}
+	b := structBuilder{baseUrl: baseUrl}
+	for _, child := range root.NodeChildren(true) {
+		if child.Type == html.ElementNode && child.Data == "body" {
+			b.block(child, out)
+		}
+	}
+	return out
+}
+
+// structBuilder walks the HTML tree, grouping the text
+// found in each block into chunks.
+type structBuilder struct {
+	baseUrl string
+
+	container *pdf.StructElement // the current block element
+	inline    *pdf.StructElement // the element receiving the text, or nil if not known yet
+	text      strings.Builder    // the pending text
+}
+
+// block adds the content of `node` to the block element `elem`.
+func (b *structBuilder) block(node *utils.HTMLNode, elem *pdf.StructElement) {
+	b.flushText()
+	container := b.container
+	b.container, b.inline = elem, nil
+	b.walk(node)
+	b.flushText()
+	// the following inline content starts a new paragraph
+	b.container, b.inline = container, nil
+}
+
+// inlineTarget returns the element receiving the inline content,
+// creating an implicit paragraph if needed.
+func (b *structBuilder) inlineTarget() *pdf.StructElement {
+	if b.inline == nil {
+		if groupingTypes[b.container.Type] {
+			b.inline = &pdf.StructElement{Type: "P"}
+			b.container.Children = append(b.container.Children, b.inline)
+		} else {
+			b.inline = b.container
+		}
+	}
+	return b.inline
+}
+
+// flushText adds the pending text, if any, as a text chunk.
+func (b *structBuilder) flushText() {
+	text := b.text.String()
+	b.text.Reset()
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	target := b.inlineTarget()
+	target.Children = append(target.Children, &pdf.StructElement{Text: text})
+}
+
+func (b *structBuilder) walk(node *utils.HTMLNode) {
+	for _, child := range node.NodeChildren(false) {
+		if isText, text := child.IsText(); isText {
+			b.text.WriteString(text)
+			continue
+		}
+		if child.Type != html.ElementNode || skippedElements[child.Data] ||
+			child.HasAttr("hidden") || child.Get("aria-hidden") == "true" {
+			continue
+		}
+
+		switch tag := child.Data; {
+		case tag == "br":
+			b.text.WriteString(" ")
+		case child.HasAttr(formFieldAttr):
+			b.flushText()
+			field := &pdf.StructElement{Type: "Form", URL: child.Get(formFieldAttr), Alt: formFieldLabel(child), Lang: child.Get("lang")}
+			target := b.inlineTarget()
+			target.Children = append(target.Children, field)
+		case tag == "img":
+			b.flushText()
+			figure := &pdf.StructElement{Type: "Figure", Alt: strings.TrimSpace(child.Get("alt")), Lang: child.Get("lang")}
+			if figure.Alt == "" {
+				figure.Type = "Artifact"
+			}
+			target := b.inlineTarget()
+			target.Children = append(target.Children, figure)
+		case tag == "a" && child.HasAttr("href"):
+			link, ok := utils.GetLinkAttribute(child, "href", b.baseUrl)
+			if !ok {
+				b.walk(child)
+				continue
+			}
+			b.flushText()
+			elem := &pdf.StructElement{Type: "Link", URL: link[1], Lang: child.Get("lang")}
+			if link[0] == "internal" {
+				elem.URL = "#" + link[1]
+			}
+			target := b.inlineTarget()
+			target.Children = append(target.Children, elem)
+			b.inline = elem
+			b.walk(child)
+			b.flushText()
+			b.inline = target
+		case blockTypes[tag] != "":
+			b.flushText()
+			elem := &pdf.StructElement{Type: blockTypes[tag], Lang: child.Get("lang")}
+			b.container.Children = append(b.container.Children, elem)
+			b.inline = nil
+			switch tag {
+			case "th":
+				elem.Scope = headerScope(child)
+			case "li":
+				// the content of the item is wrapped in a list body
+				body := &pdf.StructElement{Type: "LBody"}
+				elem.Children = append(elem.Children, body)
+				elem = body
+			}
+			b.block(child, elem)
+		default: // inline element
+			b.walk(child)
+		}
+	}
+}
+
+// headerScope returns the cells (Row, Column or Both) the header cell `th`
+// applies to, given by its scope attribute, or deduced from its position.
+func headerScope(th *utils.HTMLNode) string {
+	switch strings.ToLower(th.Get("scope")) {
+	case "row", "rowgroup":
+		return "Row"
+	case "col", "colgroup":
+		return "Column"
+	}
+	row := th.Parent
+	if row != nil && row.Parent != nil && row.Parent.Data == "thead" {
+		return "Column"
+	}
+	// a header starting a row applies to the row
+	for sibling := th.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+		if sibling.Type == html.ElementNode {
+			return "Column"
+		}
+	}
+	if row != nil && row.Parent != nil {
+		// unless all the cells of the row are headers
+		for cell := row.FirstChild; cell != nil; cell = cell.NextSibling {
+			if cell.Type == html.ElementNode && cell.Data == "td" {
+				return "Row"
+			}
+		}
+	}
+	return "Column"
+}
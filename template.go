@@ -0,0 +1,224 @@
+package goweasyprint
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/benoitkugler/go-weasyprint/diagnostics"
+	"github.com/benoitkugler/go-weasyprint/progress"
+	"github.com/benoitkugler/webrender/text"
+)
+
+// Template is an html/template document, executed with some data
+// to produce the HTML content converted.
+type Template struct {
+	// Template is the parsed template (see also `ParseTemplateFS`).
+	Template *template.Template
+
+	// Name, if not empty, selects the executed template among
+	// the ones associated with Template.
+	Name string
+
+	// BaseDir is the directory used to resolve the relative URLs of the document
+	// (stylesheets, images, etc...), unless `Options.BaseUrl` is set.
+	// It defaults to the current directory.
+	BaseDir string
+}
+
+// TemplateError is returned when a template can't be parsed or executed.
+type TemplateError struct {
+	// Name is the name of the template containing the error, or empty if unknown.
+	Name string
+
+	// Line is the 1-based line of the error in the template, or 0 if unknown.
+	Line int
+
+	Err error
+}
+
+func (te *TemplateError) Error() string {
+	if te.Line > 0 {
+		return fmt.Sprintf("template %s, line %d: %s", te.Name, te.Line, te.Err)
+	}
+	return fmt.Sprintf("template %s: %s", te.Name, te.Err)
+}
+
+func (te *TemplateError) Unwrap() error { return te.Err }
+
+// the errors of text/template are formatted as "template: name:line:col: message"
+var templateErrorRe = regexp.MustCompile(`^template: (.*?):(\d+):`)
+
+// newTemplateError wraps `err` in a *TemplateError, extracting its location.
+func newTemplateError(name string, err error) error {
+	out := &TemplateError{Name: name, Err: err}
+	var escapeErr *template.Error
+	if errors.As(err, &escapeErr) {
+		out.Name, out.Line = escapeErr.Name, escapeErr.Line
+	} else if match := templateErrorRe.FindStringSubmatch(err.Error()); match != nil {
+		out.Name = match[1]
+		out.Line, _ = strconv.Atoi(match[2])
+	}
+	return out
+}
+
+// ParseTemplateFS is the same as template.ParseFS, but
+// errors are returned as *TemplateError.
+func ParseTemplateFS(fsys fs.FS, patterns ...string) (*template.Template, error) {
+	tmpl, err := template.ParseFS(fsys, patterns...)
+	if err != nil {
+		return nil, newTemplateError("", err)
+	}
+	return tmpl, nil
+}
+
+// execute returns the HTML content of the template.
+func (t Template) execute(data any) (InputString, error) {
+	var buf bytes.Buffer
+	var err error
+	if t.Name != "" {
+		err = t.Template.ExecuteTemplate(&buf, t.Name, data)
+	} else {
+		err = t.Template.Execute(&buf, data)
+	}
+	if err != nil {
+		name := t.Name
+		if name == "" {
+			name = t.Template.Name()
+		}
+		return "", newTemplateError(name, err)
+	}
+	return InputString(buf.String()), nil
+}
+
+// options returns `opts`, with a base URL defaulting to the base directory.
+func (t Template) options(opts Options) Options {
+	if opts.BaseUrl == "" {
+		opts.BaseUrl = t.BaseDir
+		if opts.BaseUrl == "" {
+			opts.BaseUrl = "."
+		}
+	}
+	return opts
+}
+
+// ConvertTemplate executes `tmpl` with `data`, and converts the
+// resulting HTML document to a PDF file, written in `target`.
+// See `Convert` for the other parameters.
+func ConvertTemplate(target io.Writer, tmpl Template, data any, fontConfig text.FontConfiguration, opts Options) error {
+	return ConvertTemplateContext(context.Background(), target, tmpl, data, fontConfig, opts)
+}
+
+// ConvertTemplateContext is the same as ConvertTemplate, but stops as soon as possible
+// once `ctx` is done, returning `ctx.Err()`. See `ConvertContext` for more details.
+func ConvertTemplateContext(ctx context.Context, target io.Writer, tmpl Template, data any, fontConfig text.FontConfiguration, opts Options) error {
+	content, err := tmpl.execute(data)
+	if err != nil {
+		return err
+	}
+	return ConvertContext(ctx, target, content, fontConfig, tmpl.options(opts))
+}
+
+// BatchError reports the failure of one of the records of ConvertTemplateBatch.
+type BatchError struct {
+	// Index is the index of the record.
+	Index int
+
+	Err error
+}
+
+func (be *BatchError) Error() string { return fmt.Sprintf("record %d: %s", be.Index, be.Err) }
+
+func (be *BatchError) Unwrap() error { return be.Err }
+
+// ConvertTemplateBatch converts one PDF file for each of the `records`, executing `tmpl`
+// with the record as data. The PDF file of the record `i` is written to the target returned
+// by `newTarget(i)`, which is closed once the conversion is done.
+//
+// The records are converted in parallel, by at most `parallelism` goroutines, which
+// defaults to the number of CPUs. Note that the layout and drawing steps of documents
+// using the same font configuration are serialized.
+//
+// A failing record does not stop the other ones : the returned error joins
+// a *BatchError for each failure. Each record is checked with its own diagnostics
+// (see `Options.Strict`), which are then added to `opts.Diagnostics`, if set.
+// `opts.Progress` is called with the events of all the records.
+func ConvertTemplateBatch(newTarget func(index int) (io.WriteCloser, error), tmpl Template, records []any,
+	parallelism int, fontConfig text.FontConfiguration, opts Options,
+) error {
+	return ConvertTemplateBatchContext(context.Background(), newTarget, tmpl, records, parallelism, fontConfig, opts)
+}
+
+// ConvertTemplateBatchContext is the same as ConvertTemplateBatch, but stops as soon as possible
+// once `ctx` is done, the records not converted yet failing with `ctx.Err()`.
+func ConvertTemplateBatchContext(ctx context.Context, newTarget func(index int) (io.WriteCloser, error), tmpl Template, records []any,
+	parallelism int, fontConfig text.FontConfiguration, opts Options,
+) error {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	if callback := opts.Progress; callback != nil { // the events must be reported one at a time
+		var mu sync.Mutex
+		opts.Progress = func(e progress.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			callback(e)
+		}
+	}
+
+	errs := make([]error, len(records))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(parallelism, len(records)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				if err := convertRecord(ctx, newTarget, tmpl, records[index], index, fontConfig, opts); err != nil {
+					errs[index] = &BatchError{Index: index, Err: err}
+				}
+			}
+		}()
+	}
+	for index := range records {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func convertRecord(ctx context.Context, newTarget func(index int) (io.WriteCloser, error), tmpl Template, record any, index int,
+	fontConfig text.FontConfiguration, opts Options,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	target, err := newTarget(index)
+	if err != nil {
+		return err
+	}
+	// the diagnostics of the other records must not fail this one
+	if collector := opts.Diagnostics; collector != nil {
+		opts.Diagnostics = new(diagnostics.Collector)
+		defer func() {
+			for _, d := range opts.Diagnostics.Diagnostics() {
+				collector.Add(d)
+			}
+		}()
+	}
+	err = ConvertTemplateContext(ctx, target, tmpl, record, fontConfig, opts)
+	if cErr := target.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}